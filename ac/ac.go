@@ -49,4 +49,10 @@ const (
 	RequestDenied
 	// IndeterminateForCtxNotFound はコンテキストが十分に集まっていないため、判断できないことを示す(間隔を置いてアクセスしてくれって感じ)
 	IndeterminateForCtxNotFound
+	// SubjectForCtxConsentWithdrawn はコンテキストの所有者が共有を拒否したか取り消したため、コンテキストを得られないことを示す
+	// Option はなし
+	SubjectForCtxConsentWithdrawn
+	// IndeterminateForCAPUnavailable はコンテキストを提供する CAP にアクセスできないため、判断できないことを示す
+	// Option はアクセスできない CAP の名前
+	IndeterminateForCAPUnavailable
 )
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/hatake5051/ztf-prototype/ac"
@@ -12,13 +13,16 @@ import (
 type Controller interface {
 	// AskForAuthorization は PEP が PDP に認可判断を尋ねる
 	// ユーザの識別がまだ、認証がまだ、コンテキストの取得がまだの場合などはエラーを返す
-	AskForAuthorization(session string, res ac.Resource, a ac.Action) error
+	// コンテキストを集めるための外部へのアクセスは ctx が終わると打ち切る
+	AskForAuthorization(ctx context.Context, session string, res ac.Resource, a ac.Action) error
 	// SubAgent は idp のための OpenID Connect RP として振る舞うエージェントを返す
 	// PEP はこのエージェントを ZTF の RP エンドポイントに配備する
 	SubAgent(idp string) (pip.AuthNAgent, error)
 	// CtxAgent は cap のための CAEP RP として振る舞うエージェントを返す
 	// PEP はこのエージェントを ZTF の RP エンドポイントに配備する
 	CtxAgent(cap string) (pip.CtxAgent, error)
+	// ForgetSession は session に紐づく PIP の情報を破棄する
+	ForgetSession(session string) error
 }
 
 // New は PIP と PDP を受け取って Controller を構成する
@@ -31,15 +35,20 @@ type ctrl struct {
 	pdp.PDP
 }
 
-func (c *ctrl) AskForAuthorization(session string, res ac.Resource, a ac.Action) error {
+func (c *ctrl) AskForAuthorization(ctx context.Context, session string, res ac.Resource, a ac.Action) error {
 	// すでに Subject in Access Request が認証済みでセッションが確立しているか確認
 	sub, err := c.PIP.GetSubject(session)
 	if err != nil {
 		if err, ok := err.(pip.Error); ok {
-			if err.Code() == pip.SubjectUnAuthenticated {
+			switch err.Code() {
+			case pip.SubjectUnAuthenticated:
 				return newE(err, ac.SubjectNotAuthenticated)
+			case pip.SubjectDisabled:
+				// 認証し直しても使えないので拒否する
+				return newE(err, ac.RequestDenied)
+			default:
+				return err
 			}
-			return err
 		}
 		return err
 	}
@@ -50,7 +59,7 @@ func (c *ctrl) AskForAuthorization(session string, res ac.Resource, a ac.Action)
 		return newE(fmt.Errorf("the subject(%v) is not arrowed to the action(%v) on the resource(%v)", sub.ID(), a.ID(), res.ID()), ac.RequestDenied)
 	}
 	// すでにコンテキストの Subject とセッションが確立しているか確認
-	ctxs, err := c.PIP.GetContexts(session, reqctxs)
+	ctxs, err := c.PIP.GetContexts(ctx, session, reqctxs)
 	if err != nil {
 		if err, ok := err.(pip.Error); ok {
 			switch err.Code() {
@@ -58,8 +67,12 @@ func (c *ctrl) AskForAuthorization(session string, res ac.Resource, a ac.Action)
 				return newEO(err, ac.SubjectNotAuthenticated, err.Option().(string))
 			case pip.SubjectForCtxUnAuthorizeButReqSubmitted:
 				return newE(err, ac.SubjectForCtxUnAuthorizedButReqSubmitted)
+			case pip.SubjectForCtxConsentWithdrawn:
+				return newE(err, ac.SubjectForCtxConsentWithdrawn)
 			case pip.CtxsNotFound:
 				return newE(err, ac.IndeterminateForCtxNotFound)
+			case pip.CAPUnavailable:
+				return newEO(err, ac.IndeterminateForCAPUnavailable, err.Option().(string))
 			default:
 				return err
 			}
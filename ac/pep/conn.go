@@ -0,0 +1,287 @@
+package pep
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hatake5051/ztf-prototype/ac"
+)
+
+// ReevaluateInterval は長く続く接続の認可判断をやり直す間隔
+var ReevaluateInterval = 30 * time.Second
+
+// CloseGracePeriod は接続を閉じると知らせてから、ハンドラが Close フレームなどを書き終えるのを待つ時間
+// これを過ぎても閉じられていない Hijack された接続は PEP が閉じる
+var CloseGracePeriod = 3 * time.Second
+
+const (
+	// ClosePolicyViolation は認可が取り消されたときに使う WebSocket の Close Code
+	ClosePolicyViolation = 1008
+	// CloseGoingAway はログアウトしたときに使う WebSocket の Close Code
+	CloseGoingAway = 1001
+)
+
+// Closing は PEP が長く続く接続を閉じる理由を表す
+type Closing struct {
+	// Code は WebSocket の Close Code (RFC 6455 Sec.7.4.1)
+	Code int
+	// Reason は人が読むための閉じる理由
+	Reason string
+}
+
+// ClosingFrom は PEP が接続を閉じようとしている時にその理由を返す
+// PEP は接続を閉じる時にリクエストの context.Context をキャンセルするので、
+// ハンドラは ctx.Done() を受け取ったらこれで理由を取り出し、 WebSocket なら Close フレームを、
+// SSE なら最後のイベントを書いてから戻る。 CloseGracePeriod を過ぎると Hijack された接続は閉じられる
+func ClosingFrom(ctx context.Context) (*Closing, bool) {
+	c, ok := ctx.Value(connKey{}).(*conn)
+	if !ok {
+		return nil, false
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.closing, c.closing != nil
+}
+
+// connKey はハンドラに渡す context.Context に conn を入れるキー
+type connKey struct{}
+
+// isLongLived は r が WebSocket への upgrade か Server-Sent Events の要求か判定する
+func isLongLived(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// conn は PEP を通過した後も続く接続を表す
+type conn struct {
+	session string
+	res     ac.Resource
+	a       ac.Action
+	// cancel はハンドラに渡した context.Context をキャンセルして、接続を閉じるよう知らせる
+	cancel context.CancelFunc
+	// done はハンドラが戻るか、 Hijack された接続が閉じられると閉じる
+	done     chan struct{}
+	doneOnce sync.Once
+	m        sync.Mutex
+	// nc は WebSocket などで Hijack された接続
+	nc      net.Conn
+	closing *Closing
+}
+
+// close は code と reason をハンドラに伝えて接続を閉じるよう知らせる
+// ハンドラが CloseGracePeriod の間に閉じなければ Hijack された接続を閉じる
+func (c *conn) close(code int, reason string) {
+	c.m.Lock()
+	if c.closing != nil {
+		c.m.Unlock()
+		return
+	}
+	c.closing = &Closing{code, reason}
+	c.m.Unlock()
+	c.cancel()
+	grace := time.NewTimer(CloseGracePeriod)
+	go func() {
+		defer grace.Stop()
+		select {
+		case <-c.done:
+		case <-grace.C:
+			c.m.Lock()
+			nc := c.nc
+			c.m.Unlock()
+			if nc != nil {
+				nc.Close()
+			}
+			c.finish()
+		}
+	}()
+}
+
+// finish はハンドラが接続を使い終えたことを記録する
+func (c *conn) finish() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// conns は長く続く接続をセッションごとに管理する
+type conns struct {
+	m    sync.Mutex
+	db   map[string]map[*conn]struct{} // session -> conns
+	once sync.Once
+}
+
+func (cs *conns) add(c *conn) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	if cs.db == nil {
+		cs.db = make(map[string]map[*conn]struct{})
+	}
+	if cs.db[c.session] == nil {
+		cs.db[c.session] = make(map[*conn]struct{})
+	}
+	cs.db[c.session][c] = struct{}{}
+}
+
+func (cs *conns) remove(c *conn) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	delete(cs.db[c.session], c)
+	if len(cs.db[c.session]) == 0 {
+		delete(cs.db, c.session)
+	}
+}
+
+// list は session の接続一覧を返す。session が空文字の時は全ての接続を返す
+func (cs *conns) list(session string) []*conn {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	var ret []*conn
+	for s, cc := range cs.db {
+		if session != "" && s != session {
+			continue
+		}
+		for c := range cc {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// closeSession は session の全ての接続を閉じる
+func (cs *conns) closeSession(session string, code int, reason string) {
+	for _, c := range cs.list(session) {
+		c.close(code, reason)
+		cs.remove(c)
+	}
+}
+
+// trackedWriter は長く続く接続の http.ResponseWriter をラップし、 Hijack された接続を conn に記録する
+type trackedWriter struct {
+	http.ResponseWriter
+	c  *conn
+	cs *conns
+	// hijacked は Hijack されたかどうか。ハンドラが戻っても接続は続くので管理から外さない
+	hijacked bool
+}
+
+func (w *trackedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *trackedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("pep: http.ResponseWriter は http.Hijacker を実装していない")
+	}
+	nc, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.c.m.Lock()
+	w.c.nc = nc
+	w.c.m.Unlock()
+	w.hijacked = true
+	return &trackedConn{nc, w.c, w.cs}, rw, nil
+}
+
+// trackedConn は Hijack された net.Conn をラップし、閉じられたら管理から外す
+type trackedConn struct {
+	net.Conn
+	c  *conn
+	cs *conns
+}
+
+func (c *trackedConn) Close() error {
+	c.cs.remove(c.c)
+	c.c.finish()
+	return c.Conn.Close()
+}
+
+// serveLongLived は長く続く接続を管理下に置いた上で next に処理させる
+func (p *pep) serveLongLived(next http.Handler, w http.ResponseWriter, r *http.Request, sessionID string, res ac.Resource, a ac.Action) {
+	ctx, cancel := context.WithCancel(r.Context())
+	c := &conn{
+		session: sessionID,
+		res:     res,
+		a:       a,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	p.conns.add(c)
+	p.conns.once.Do(func() { go p.reevaluateLoop() })
+	tw := &trackedWriter{ResponseWriter: w, c: c, cs: &p.conns}
+	next.ServeHTTP(tw, r.WithContext(context.WithValue(ctx, connKey{}, c)))
+	if !tw.hijacked {
+		c.finish()
+		cancel()
+		p.conns.remove(c)
+	}
+}
+
+// reevaluateLoop は定期的に長く続く接続の認可判断をやり直す
+func (p *pep) reevaluateLoop() {
+	t := time.NewTicker(ReevaluateInterval)
+	defer t.Stop()
+	for range t.C {
+		p.reevaluate(nil)
+	}
+}
+
+// reevaluate は affected が true を返す session の長く続く接続の認可判断をやり直し、認可されなくなった接続を閉じる
+// affected が nil の時は全ての接続を対象にする
+// 一つの CAP の応答が遅くても他のユーザの接続を閉じるのが遅れないよう、 session ごとに並行して判断する
+// 一つの接続の認可判断は ReevaluateInterval で打ち切り、次の機会にやり直す
+func (p *pep) reevaluate(affected func(session string) bool) {
+	bySession := make(map[string][]*conn)
+	for _, c := range p.conns.list("") {
+		if affected != nil && !affected(c.session) {
+			continue
+		}
+		bySession[c.session] = append(bySession[c.session], c)
+	}
+	var wg sync.WaitGroup
+	for _, cc := range bySession {
+		wg.Add(1)
+		go func(cc []*conn) {
+			defer wg.Done()
+			for _, c := range cc {
+				ctx, cancel := context.WithTimeout(context.Background(), ReevaluateInterval)
+				err := p.ctrl.AskForAuthorization(ctx, c.session, c.res, c.a)
+				cancel()
+				if err == nil {
+					continue
+				}
+				if !revoked(err) {
+					fmt.Printf("session(%s) の action(%s) on res(%s) の認可判断ができなかったので接続は閉じずに次の機会にやり直す %v\n", c.session, c.a.ID(), c.res.ID(), err)
+					continue
+				}
+				fmt.Printf("session(%s) の action(%s) on res(%s) は認可されなくなったので接続を閉じる %v\n", c.session, c.a.ID(), c.res.ID(), err)
+				c.close(ClosePolicyViolation, "access revoked")
+				p.conns.remove(c)
+			}
+		}(cc)
+	}
+	wg.Wait()
+}
+
+// revoked は認可判断のエラー err が接続を閉じるべきものか判定する
+// 認可が拒否されたか認証が失われたか、コンテキストの共有が取り消された時だけ閉じ、コンテキストが揃っていないなど一時的に判断できない時は閉じない
+func revoked(err error) bool {
+	e, ok := err.(ac.Error)
+	if !ok {
+		return false
+	}
+	switch e.ID() {
+	case ac.RequestDenied, ac.SubjectNotAuthenticated, ac.SubjectForCtxConsentWithdrawn:
+		return true
+	}
+	return false
+}
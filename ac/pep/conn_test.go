@@ -0,0 +1,142 @@
+package pep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hatake5051/ztf-prototype/ac"
+	"github.com/hatake5051/ztf-prototype/ac/controller"
+)
+
+// acErr は Controller が返す ac.Error
+type acErr ac.ErrorCode
+
+func (e acErr) Error() string    { return fmt.Sprintf("ac error %d", e) }
+func (e acErr) ID() ac.ErrorCode { return ac.ErrorCode(e) }
+func (e acErr) Option() string   { return "" }
+
+// testID は ac.Resource と ac.Action
+type testID string
+
+func (id testID) ID() string { return string(id) }
+
+// decisions は session ごとに決まった認可判断を返す controller.Controller
+type decisions struct {
+	controller.Controller
+	m    sync.Mutex
+	errs map[string]error
+}
+
+func (c *decisions) set(session string, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.errs[session] = err
+}
+
+func (c *decisions) AskForAuthorization(ctx context.Context, session string, res ac.Resource, a ac.Action) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.errs[session]
+}
+
+func TestReevaluate(t *testing.T) {
+	ctrl := &decisions{errs: make(map[string]error)}
+	p := &pep{ctrl: ctrl}
+	open := func(session string) (*conn, context.Context) {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := &conn{session: session, res: testID("res"), a: testID("get"), cancel: cancel, done: make(chan struct{})}
+		p.conns.add(c)
+		return c, context.WithValue(ctx, connKey{}, c)
+	}
+	_, permitted := open("permitted")
+	_, denied := open("denied")
+	_, loggedOut := open("logged-out")
+	_, withdrawn := open("withdrawn")
+	_, pending := open("pending")
+	_, broken := open("broken")
+	ctrl.set("denied", acErr(ac.RequestDenied))
+	ctrl.set("logged-out", acErr(ac.SubjectNotAuthenticated))
+	ctrl.set("withdrawn", acErr(ac.SubjectForCtxConsentWithdrawn))
+	ctrl.set("pending", acErr(ac.IndeterminateForCtxNotFound))
+	ctrl.set("broken", errors.New("CAP に繋がらない"))
+
+	// affected で対象外の session は認可判断をやり直さない
+	p.reevaluate(func(session string) bool { return session != "denied" })
+	if denied.Err() != nil {
+		t.Fatal("対象外の session の接続が閉じられた")
+	}
+
+	p.reevaluate(nil)
+	for name, ctx := range map[string]context.Context{"denied": denied, "logged-out": loggedOut, "withdrawn": withdrawn} {
+		if ctx.Err() == nil {
+			t.Errorf("%s の接続が閉じられていない", name)
+			continue
+		}
+		closing, ok := ClosingFrom(ctx)
+		if !ok || closing.Code != ClosePolicyViolation {
+			t.Errorf("%s の接続を閉じる理由 = %v, want code %d", name, closing, ClosePolicyViolation)
+		}
+	}
+	// 一時的に判断できないだけの接続は閉じない
+	for name, ctx := range map[string]context.Context{"permitted": permitted, "pending": pending, "broken": broken} {
+		if ctx.Err() != nil {
+			t.Errorf("%s の接続が閉じられた", name)
+		}
+	}
+	if n := len(p.conns.list("")); n != 3 {
+		t.Errorf("管理している接続 = %d, want 3", n)
+	}
+}
+
+func TestCloseHijacked(t *testing.T) {
+	defer func(d time.Duration) { CloseGracePeriod = d }(CloseGracePeriod)
+	CloseGracePeriod = 50 * time.Millisecond
+
+	t.Run("ハンドラが Close フレームを書いて閉じる", func(t *testing.T) {
+		server, client := net.Pipe()
+		var cs conns
+		ctx, cancel := context.WithCancel(context.Background())
+		c := &conn{session: "s", cancel: cancel, done: make(chan struct{}), nc: server}
+		cs.add(c)
+		tc := &trackedConn{server, c, &cs}
+		ctx = context.WithValue(ctx, connKey{}, c)
+		go func() {
+			<-ctx.Done()
+			closing, _ := ClosingFrom(ctx)
+			fmt.Fprintf(tc, "close %d %s", closing.Code, closing.Reason)
+			tc.Close()
+		}()
+		c.close(CloseGoingAway, "logged out")
+		b, err := ioutil.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "close 1001 logged out"; got != want {
+			t.Errorf("handler wrote %q, want %q", got, want)
+		}
+		if n := len(cs.list("")); n != 0 {
+			t.Errorf("閉じた接続が管理に残っている %d", n)
+		}
+	})
+
+	t.Run("ハンドラが閉じなければ猶予の後に閉じる", func(t *testing.T) {
+		server, client := net.Pipe()
+		_, cancel := context.WithCancel(context.Background())
+		c := &conn{session: "s", cancel: cancel, done: make(chan struct{}), nc: server}
+		start := time.Now()
+		c.close(ClosePolicyViolation, "access revoked")
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Read() = %v, want EOF", err)
+		}
+		if d := time.Since(start); d < CloseGracePeriod {
+			t.Errorf("猶予 %v を待たずに %v で閉じた", CloseGracePeriod, d)
+		}
+	})
+}
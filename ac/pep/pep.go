@@ -1,20 +1,28 @@
 package pep
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/hatake5051/ztf-prototype/ac"
 	"github.com/hatake5051/ztf-prototype/ac/controller"
 	"github.com/hatake5051/ztf-prototype/ac/pip"
+	ztfsession "github.com/hatake5051/ztf-prototype/actors/session"
 )
 
+// AuthorizationTimeout は MW で一つの要求の認可判断を待つ時間
+// CAP や IdP の応答が遅くても、これを過ぎれば要求を失敗させる
+var AuthorizationTimeout = 30 * time.Second
+
 // PEP は Policy Enforcement Point を表すのに加えて、 PIP で必要なエンドポイントを設定する
 type PEP interface {
 	// Protect は r を保護する
@@ -30,6 +38,8 @@ type PEP interface {
 	Redirect(host string, isCAP bool) http.HandlerFunc
 	// Callback は IdP からリダイレクトバックする先のエンドポイントに対応する http.HandlerFunc を返す
 	Callback(host string, isCAP bool) http.HandlerFunc
+	// Logout はセッションを破棄し、そのセッションで続いている WebSocket や SSE の接続を閉じる
+	Logout(w http.ResponseWriter, r *http.Request)
 }
 
 // New は PEP を構築する。
@@ -65,11 +75,14 @@ type pep struct {
 	ctrl    controller.Controller
 	store   sessions.Store
 	helper  Helper
+	// conns は MW を通過した後も続く WebSocket や SSE の接続を管理する
+	conns conns
 }
 
 func (p *pep) Protect(r *mux.Router) {
 	r.Use(p.MW)
 	r.PathPrefix(path.Join("/", p.prefix, "pip/sub/0/callback")).HandlerFunc(p.Callback(p.idp, false))
+	r.PathPrefix(path.Join("/", p.prefix, "logout")).HandlerFunc(p.Logout)
 	s := r.PathPrefix(path.Join("/", p.prefix, "pip/ctx")).Subrouter()
 	for i, cap := range p.capList {
 		s.PathPrefix(fmt.Sprintf("/%d/callback", i)).HandlerFunc(p.Callback(cap, true))
@@ -83,24 +96,62 @@ const (
 	snRedirect = "AC_PEP_REDIRECT"
 )
 
-func (p *pep) getSessionID(r *http.Request) (string, error) {
-	session, err := p.store.Get(r, snPEP)
+// getSessionID は PEP のセッションからセッション ID を取得する
+// まだセッション ID がない場合は新しく生成してクッキーに保存する
+func (p *pep) getSessionID(w http.ResponseWriter, r *http.Request) (string, error) {
+	session, err := p.session(r, snPEP)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
-	if v, ok := session.Values[sidPEP]; ok {
-		return v.(string), nil
+	if v, ok := session.Values[sidPEP].(string); ok {
+		return v, nil
 	}
+	return p.newSessionID(w, r, session)
+}
 
+// renewSessionID はセッション固定攻撃を防ぐためにセッション ID を新しく払い出す
+func (p *pep) renewSessionID(w http.ResponseWriter, r *http.Request) (string, error) {
+	session, err := p.session(r, snPEP)
+	if err != nil {
+		return "", err
+	}
+	old, hasOld := session.Values[sidPEP].(string)
+	// 古いセッションはストアから消し、次の Save でストア上の識別子も新しくなる
+	if err := ztfsession.Renew(r, w, session); err != nil {
+		return "", err
+	}
+	sessionID, err := p.newSessionID(w, r, session)
+	if err != nil {
+		return "", err
+	}
+	// 古いセッション ID で認証済みの状態が PIP に残らないようにする
+	if hasOld {
+		if err := p.ctrl.ForgetSession(old); err != nil {
+			return "", err
+		}
+	}
+	return sessionID, nil
+}
+
+func (p *pep) newSessionID(w http.ResponseWriter, r *http.Request, session *sessions.Session) (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
 	sessionID := base64.StdEncoding.EncodeToString(b)
 	session.Values[sidPEP] = sessionID
+	if err := session.Save(r, w); err != nil {
+		return "", err
+	}
 	return sessionID, nil
 }
 
+// session は name のセッションを取得する
+// 鍵のローテーションなどで既存のクッキーを復号できなかった場合は新しいセッションとして扱う
+func (p *pep) session(r *http.Request, name string) (*sessions.Session, error) {
+	return ztfsession.Get(p.store, r, name)
+}
+
 func (p *pep) MW(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("request comming with %s\n", r.URL.String())
@@ -108,7 +159,7 @@ func (p *pep) MW(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		sessionID, err := p.getSessionID(r)
+		sessionID, err := p.getSessionID(w, r)
 		if err != nil {
 			http.Error(w, "session: cookie-pep is not exist in store :"+err.Error(), http.StatusInternalServerError)
 			return
@@ -118,11 +169,14 @@ func (p *pep) MW(next http.Handler) http.Handler {
 			http.Error(w, "parseAccessRequest failed: :"+err.Error(), http.StatusForbidden)
 			return
 		}
-		if err := sessions.Save(r, w); err != nil {
-			http.Error(w, fmt.Sprintf("セッションの保存に失敗 %v", err), http.StatusInternalServerError)
+		ctx, cancel := context.WithTimeout(r.Context(), AuthorizationTimeout)
+		err = p.ctrl.AskForAuthorization(ctx, sessionID, res, a)
+		cancel()
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, fmt.Sprintf("認可判断が %v 以内に終わらなかった %v", AuthorizationTimeout, err), http.StatusGatewayTimeout)
 			return
 		}
-		if err := p.ctrl.AskForAuthorization(sessionID, res, a); err != nil {
+		if err != nil {
 			if err, ok := err.(ac.Error); ok {
 				switch err.ID() {
 				case ac.RequestDenied:
@@ -131,6 +185,9 @@ func (p *pep) MW(next http.Handler) http.Handler {
 				case ac.SubjectForCtxUnAuthorizedButReqSubmitted:
 					http.Error(w, fmt.Sprintf("コンテキスト所有者に確認をとりに行っています"), http.StatusAccepted)
 					return
+				case ac.SubjectForCtxConsentWithdrawn:
+					http.Error(w, fmt.Sprintf("コンテキスト所有者がコンテキストの共有を取り消しています"), http.StatusForbidden)
+					return
 				case ac.SubjectNotAuthenticated:
 					if err.Option() == "" {
 						p.Redirect(p.idp, false)(w, r)
@@ -140,6 +197,9 @@ func (p *pep) MW(next http.Handler) http.Handler {
 					return
 				case ac.IndeterminateForCtxNotFound:
 					http.Error(w, fmt.Sprintf("少し時間を置いてからアクセスしてください"), http.StatusAccepted)
+				case ac.IndeterminateForCAPUnavailable:
+					http.Error(w, fmt.Sprintf("コンテキストの提供元(%s)にアクセスできません。少し時間を置いてからアクセスしてください", err.Option()), http.StatusServiceUnavailable)
+					return
 				default:
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
@@ -148,6 +208,11 @@ func (p *pep) MW(next http.Handler) http.Handler {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if isLongLived(r) {
+			// 認可判断が覆ったら閉じられるように管理下に置く
+			p.serveLongLived(next, w, r, sessionID, res, a)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -159,16 +224,54 @@ func (p *pep) RecvCtx(transmitter string) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if err := a.RecvCtx(r); err != nil {
+		affected, err := a.RecvCtx(r)
+		if err != nil {
+			if err, ok := err.(pip.Error); ok && err.Code() == pip.CtxInvalid {
+				// 送り直しても受け付けられないことを RFC 8935 Sec.2.3 のエラー応答で伝える
+				code, ok := err.Option().(string)
+				if !ok || code == "" {
+					code = "invalid_request"
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{
+					"err":         code,
+					"description": err.Error(),
+				})
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// コンテキストが更新されたユーザの続いている接続の認可判断をやり直す
+		go p.reevaluate(affected)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (p *pep) Logout(w http.ResponseWriter, r *http.Request) {
+	session, err := p.session(r, snPEP)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if sessionID, ok := session.Values[sidPEP].(string); ok {
+		p.conns.closeSession(sessionID, CloseGoingAway, "logged out")
+		if err := p.ctrl.ForgetSession(sessionID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Write([]byte("ログアウトしました"))
 }
 func (p *pep) Redirect(host string, isCAP bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session, err := p.store.Get(r, snRedirect)
+		session, err := p.session(r, snRedirect)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -211,7 +314,15 @@ func (p *pep) Callback(host string, isCAP bool) http.HandlerFunc {
 		}
 
 		// sessionID と openid.IDToken を紐付ける
-		sessionID, err := p.getSessionID(r)
+		// IdP での認証直後はセッション固定攻撃を防ぐためセッション ID を払い出し直す
+		// CAP での認証はすでに IdP で認証済みのセッションに紐づくため払い出し直さない
+		var sessionID string
+		var err error
+		if isCAP {
+			sessionID, err = p.getSessionID(w, r)
+		} else {
+			sessionID, err = p.renewSessionID(w, r)
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -222,7 +333,7 @@ func (p *pep) Callback(host string, isCAP bool) http.HandlerFunc {
 		}
 
 		// Redirect back する先があるかチェック
-		session, err := p.store.Get(r, snRedirect)
+		session, err := p.session(r, snRedirect)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -0,0 +1,54 @@
+package pep
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/hatake5051/ztf-prototype/ac"
+	"github.com/hatake5051/ztf-prototype/ac/controller"
+)
+
+// hangingCtrl は ctx が終わるまで認可判断を返さない controller.Controller
+type hangingCtrl struct {
+	controller.Controller
+}
+
+func (c *hangingCtrl) AskForAuthorization(ctx context.Context, session string, res ac.Resource, a ac.Action) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// fixedHelper は全ての要求を res への get として扱う
+type fixedHelper struct{}
+
+func (fixedHelper) ParseAccessRequest(r *http.Request) (ac.Resource, ac.Action, error) {
+	return testID("res"), testID("get"), nil
+}
+
+func TestMWAuthorizationTimeout(t *testing.T) {
+	defer func(d time.Duration) { AuthorizationTimeout = d }(AuthorizationTimeout)
+	AuthorizationTimeout = 50 * time.Millisecond
+
+	p := New("auth", "https://idp.example", nil, &hangingCtrl{}, sessions.NewCookieStore([]byte("test-hash-key")), fixedHelper{})
+	called := false
+	h := p.MW(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("認可判断が終わらないまま要求が返らない")
+	}
+	if called || w.Code != http.StatusGatewayTimeout {
+		t.Errorf("認可判断が時間切れの要求 = %d, next を呼んだ %v", w.Code, called)
+	}
+}
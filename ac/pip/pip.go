@@ -1,6 +1,7 @@
 package pip
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/hatake5051/ztf-prototype/ac"
@@ -26,6 +27,16 @@ const (
 	SubjectForCtxUnAuthorizeButReqSubmitted
 	// CtxsNotFound は ctx をまだ rp が所持していないことを表す(CAPからもらう認可は下りているが、まだCAP からもらっていないとか)
 	CtxsNotFound
+	// CtxInvalid は CAP から受け取ったコンテキストを受け付けられないことを表す
+	// Option() として RFC 8935 Sec.2.4 のエラーコード string を返す
+	CtxInvalid
+	// SubjectDisabled は Subject のアカウントが無効化・削除されていて、認証し直しても使えないことを表す
+	SubjectDisabled
+	// SubjectForCtxConsentWithdrawn は res owner がコンテキストの共有を拒否したか、許可を取り消したことを表す
+	SubjectForCtxConsentWithdrawn
+	// CAPUnavailable は CAP や その認可サーバの設定情報を取得できず、コンテキストを得られないことを表す
+	// Option() として CAP の名前 string を返す
+	CAPUnavailable
 )
 
 // AuthNAgent は OIDC フローを実装する
@@ -39,7 +50,9 @@ type AuthNAgent interface {
 // さらに外部で収集したコンテキストを収集する
 type CtxAgent interface {
 	AuthNAgent
-	RecvCtx(r *http.Request) error
+	// RecvCtx は外部で収集したコンテキストを受け取る
+	// affected は session のユーザのコンテキストが受け取ったもので変わったかを判定する
+	RecvCtx(r *http.Request) (affected func(session string) bool, err error)
 }
 
 // PIP はサブジェクトやコンテキストを管理する
@@ -47,6 +60,8 @@ type PIP interface {
 	// GetSubject は session に紐づくユーザ情報を返す
 	// session に紐づくユーザ情報がない場合 (e.g. 認証がまだ)などのときは
 	// SubjectUnAuthenticated エラーを返す
+	// ユーザのアカウントが無効化されているときは
+	// SubjectDisabled エラーを返す
 	GetSubject(session string) (ac.Subject, error)
 	// SubjectAuthNAgent は idp に対応する認証エージェントを返す
 	// このエージェントは OpenID Connect の RP として振る舞うことができるため
@@ -58,8 +73,14 @@ type PIP interface {
 	// SubjectForCtxUnAuthenticated エラーコードを返す
 	// コンテキストを CAP からもらうにはユーザの承認が必要なときは
 	// SubjectForCtxUnAuthorizeButReqSubmitted
+	// コンテキストの所有者が共有を拒否したり取り消したりしたときは
+	// SubjectForCtxConsentWithdrawn
 	// コンテキストを CAP からまだ提供されていないときは
 	// CtxsNotFound
-	GetContexts(session string, reqctxs []ac.ReqContext) ([]ac.Context, error)
+	// CAP へのアクセスは ctx が終わると打ち切る
+	GetContexts(ctx context.Context, session string, reqctxs []ac.ReqContext) ([]ac.Context, error)
 	ContextAgent(cap string) (CtxAgent, error)
+	// ForgetSession は session に紐づくユーザやコンテキストのサブジェクトの情報を破棄する
+	// セッション ID を払い出し直した時に古いセッション ID で認証済みの状態が残らないようにする
+	ForgetSession(session string) error
 }
@@ -0,0 +1,275 @@
+package cap
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/hatake5051/ztf-prototype/caep"
+)
+
+// AdminConf は CAP の運用者向け管理 API の設定情報
+type AdminConf struct {
+	// Token は管理 API を叩く時に Authorization: Bearer で提示するトークン
+	// 空の時は管理 API を公開しない
+	Token string `json:"token"`
+}
+
+// AdminReceiver は管理 API で見せる Receiver の状態
+type AdminReceiver struct {
+	ID   string `json:"recv_id"`
+	Host string `json:"host"`
+	// Streams は Receiver が作った Stream
+	Streams []AdminStream `json:"streams"`
+	// OutboxDepth は配送待ちの SET の数
+	OutboxDepth int `json:"outbox_depth"`
+	// DeadLetters は配送を諦めた SET の数
+	DeadLetters int `json:"dead_letters"`
+	// LastDelivery は最後の Push 配送の結果。まだ配送を試みていなければ nil
+	LastDelivery *caep.Delivery `json:"last_delivery,omitempty"`
+}
+
+// AdminStream は管理 API で見せる Stream の状態
+type AdminStream struct {
+	Config       *caep.StreamConfig `json:"config"`
+	Status       string             `json:"status"`
+	StatusReason string             `json:"status_reason,omitempty"`
+	// Subjects は Stream に追加されたサブジェクトごとの status とスコープ
+	Subjects []AdminSubject `json:"subjects"`
+}
+
+// AdminSubject は管理 API で見せるサブジェクトの status
+type AdminSubject struct {
+	// Key は サブジェクトを指定する時に使う識別子
+	Key         string              `json:"key"`
+	Subject     caep.Subject        `json:"subject"`
+	Status      string              `json:"status"`
+	EventScopes map[string][]string `json:"events_scopes"`
+}
+
+// AdminDisableReq は管理 API で Receiver やサブジェクトを disabled にする時のリクエスト
+type AdminDisableReq struct {
+	// Subject は disabled にするサブジェクトの Key 。空の時は Receiver の全ての Stream を disabled にする
+	Subject string `json:"subject,omitempty"`
+	// Reason は Receiver に Stream Updated Event で伝える理由
+	Reason string `json:"reason"`
+}
+
+// admin は Transmitter が管理する Stream を運用者が確認、操作するための API を提供する
+type admin struct {
+	token      string
+	tr         caep.Tr
+	streams    *trStreamDB
+	statusRepo *trStatusDB
+}
+
+// Router は管理 API を r に構築する
+func (a *admin) Router(r *mux.Router) {
+	s := r.PathPrefix("/admin").Subrouter()
+	s.Use(a.authMW)
+	s.HandleFunc("/streams", a.ListReceivers).Methods(http.MethodGet)
+	s.HandleFunc("/streams/{recvID}", a.ReadReceiver).Methods(http.MethodGet)
+	s.HandleFunc("/streams/{recvID}/disable", a.Disable).Methods(http.MethodPost)
+	s.HandleFunc("/streams/{recvID}/dead-letters", a.ListDeadLetters).Methods(http.MethodGet)
+	s.HandleFunc("/streams/{recvID}/dead-letters/{jti}/replay", a.ReplayDeadLetter).Methods(http.MethodPost)
+}
+
+// authMW は Authorization ヘッダのトークンが設定されたものと一致するか検証する
+func (a *admin) authMW(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hh := strings.Split(r.Header.Get("Authorization"), " ")
+		if len(hh) != 2 || hh[0] != "Bearer" || subtle.ConstantTimeCompare([]byte(hh[1]), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "管理 API のトークンが正しくない", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admin) ListReceivers(w http.ResponseWriter, r *http.Request) {
+	var ret []AdminReceiver
+	for _, recv := range a.streams.registered() {
+		v, err := a.receiver(recv.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ret = append(ret, *v)
+	}
+	writeJSON(w, ret)
+}
+
+func (a *admin) ReadReceiver(w http.ResponseWriter, r *http.Request) {
+	recvID := mux.Vars(r)["recvID"]
+	if _, err := a.streams.Registration(recvID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	v, err := a.receiver(recvID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, v)
+}
+
+// Disable は Receiver の全ての Stream か、 Stream に追加されたサブジェクトを強制的に disabled にする
+func (a *admin) Disable(w http.ResponseWriter, r *http.Request) {
+	recvID := mux.Vars(r)["recvID"]
+	if _, err := a.streams.Registration(recvID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || contentType != "application/json" {
+		http.Error(w, "Content-Type は application/json である必要がある", http.StatusBadRequest)
+		return
+	}
+	req := new(AdminDisableReq)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "disabled by administrator"
+	}
+	streams, err := a.streams.List(recvID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	found := false
+	for _, s := range streams {
+		streamID := s.StreamConf.StreamID
+		var sub *caep.Subject
+		if req.Subject != "" {
+			status, err := a.statusRepo.Load(recvID, streamID, req.Subject)
+			if err != nil {
+				// この Stream にはサブジェクトが追加されていない
+				continue
+			}
+			sub = &status.Subject
+		}
+		found = true
+		if err := a.tr.UpdateStatus(recvID, streamID, sub, caep.StatusDisabled, req.Reason); err != nil {
+			http.Error(w, fmt.Sprintf("stream(%s) を disabled にできなかった %v", streamID, err), http.StatusConflict)
+			return
+		}
+		fmt.Printf("管理 API で recvID(%s) の stream(%s) の subject(%s) を disabled にした reason: %s\n", recvID, streamID, req.Subject, req.Reason)
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("recvID(%s) に disabled にできる stream がない", recvID), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListDeadLetters は Receiver 宛の配送を諦めた SET を返す
+func (a *admin) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	recvID := mux.Vars(r)["recvID"]
+	if _, err := a.streams.Registration(recvID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	dead, err := a.tr.DeadLetters(recvID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dead == nil {
+		dead = []caep.OutboxSET{}
+	}
+	writeJSON(w, dead)
+}
+
+// ReplayDeadLetter は Receiver 宛の配送を諦めた SET を jti で指定して配送し直す
+func (a *admin) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	recvID, jti := vars["recvID"], vars["jti"]
+	dead, err := a.tr.DeadLetters(recvID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	found := false
+	for _, s := range dead {
+		if s.JTI == jti {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("recvID(%s) 宛の jti(%s) の SET は dead letter にない", recvID, jti), http.StatusNotFound)
+		return
+	}
+	if err := a.tr.Replay(recvID, jti); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	fmt.Printf("管理 API で recvID(%s) 宛の dead letter(jti: %s) を配送し直した\n", recvID, jti)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// receiver は recvID の Receiver の状態をまとめる
+func (a *admin) receiver(recvID string) (*AdminReceiver, error) {
+	reg, err := a.streams.Registration(recvID)
+	if err != nil {
+		return nil, err
+	}
+	ret := &AdminReceiver{ID: reg.ID, Host: reg.Host, Streams: []AdminStream{}}
+	streams, err := a.streams.List(recvID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].StreamConf.StreamID < streams[j].StreamConf.StreamID
+	})
+	for _, s := range streams {
+		status := s.Status
+		if status == "" {
+			status = caep.StatusEnabled
+		}
+		v := AdminStream{
+			Config:       s.StreamConf,
+			Status:       status,
+			StatusReason: s.StatusReason,
+			Subjects:     []AdminSubject{},
+		}
+		for _, ss := range a.statusRepo.list(recvID, s.StreamConf.StreamID) {
+			v.Subjects = append(v.Subjects, AdminSubject{
+				Key:         ss.Subject.Key(),
+				Subject:     ss.Subject,
+				Status:      ss.Status,
+				EventScopes: ss.EventScopes,
+			})
+		}
+		ret.Streams = append(ret.Streams, v)
+	}
+	outbox, err := a.tr.Outbox(recvID)
+	if err != nil {
+		return nil, err
+	}
+	ret.OutboxDepth = len(outbox)
+	dead, err := a.tr.DeadLetters(recvID)
+	if err != nil {
+		return nil, err
+	}
+	ret.DeadLetters = len(dead)
+	if d, ok := a.tr.LastDelivery(recvID); ok {
+		ret.LastDelivery = d
+	}
+	return ret, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("管理 API の応答の書き込みに失敗 %v\n", err)
+	}
+}
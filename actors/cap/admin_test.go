@@ -0,0 +1,78 @@
+package cap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/hatake5051/ztf-prototype/caep"
+)
+
+func TestAdminDeadLetters(t *testing.T) {
+	tr := &deadLetterTr{dead: map[string]caep.OutboxSET{"jti1": {RecvID: "rp1", StreamID: "stream1", JTI: "jti1", LastError: "500"}}}
+	streams := newTrStreamDB()
+	streams.register(&caep.Receiver{ID: "rp1", StreamConf: &caep.StreamConfig{}})
+	r := mux.NewRouter()
+	(&admin{token: "secret", tr: tr, streams: streams}).Router(r)
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodGet, "/admin/streams/rp1/dead-letters", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("トークンが違う一覧 = %d, want 401", w.Code)
+	}
+	w := do(http.MethodGet, "/admin/streams/rp1/dead-letters", "secret")
+	var got []caep.OutboxSET
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("dead letter の一覧 = %d %v", w.Code, err)
+	}
+	if len(got) != 1 || got[0].JTI != "jti1" || got[0].LastError != "500" {
+		t.Errorf("dead letter の一覧 = %+v", got)
+	}
+	if w := do(http.MethodGet, "/admin/streams/unknown/dead-letters", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("登録されていない Receiver の一覧 = %d, want 404", w.Code)
+	}
+
+	if w := do(http.MethodPost, "/admin/streams/rp1/dead-letters/unknown/replay", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("dead letter にない jti の replay = %d, want 404", w.Code)
+	}
+	if w := do(http.MethodPost, "/admin/streams/rp1/dead-letters/jti1/replay", "secret"); w.Code != http.StatusNoContent {
+		t.Fatalf("replay = %d %s", w.Code, w.Body)
+	}
+	if len(tr.replayed) != 1 || tr.replayed[0] != "rp1/jti1" {
+		t.Errorf("配送し直した SET = %v", tr.replayed)
+	}
+}
+
+// deadLetterTr は dead letter の一覧と replay だけを扱う caep.Tr
+type deadLetterTr struct {
+	caep.Tr
+	dead     map[string]caep.OutboxSET // jti -> SET
+	replayed []string
+}
+
+func (tr *deadLetterTr) DeadLetters(recvID string) ([]caep.OutboxSET, error) {
+	var ret []caep.OutboxSET
+	for _, s := range tr.dead {
+		if s.RecvID == recvID {
+			ret = append(ret, s)
+		}
+	}
+	return ret, nil
+}
+
+func (tr *deadLetterTr) Replay(recvID, jti string) error {
+	if _, ok := tr.dead[jti]; !ok {
+		return fmt.Errorf("jti(%s) は dead letter にない", jti)
+	}
+	delete(tr.dead, jti)
+	tr.replayed = append(tr.replayed, recvID+"/"+jti)
+	return nil
+}
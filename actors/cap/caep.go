@@ -1,9 +1,12 @@
 package cap
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hatake5051/ztf-prototype/caep"
 	"github.com/hatake5051/ztf-prototype/uma"
@@ -15,12 +18,12 @@ type verifier struct {
 	jwtURL string
 }
 
-func (v *verifier) Stream(authHeader string) (recvID string, err error) {
+func (v *verifier) Stream(rctx context.Context, authHeader string) (recvID string, err error) {
 	hh := strings.Split(authHeader, " ")
 	if len(hh) != 2 && hh[0] != "Bearer" {
 		return "", fmt.Errorf("authheader のフォーマットがおかしい %s", authHeader)
 	}
-	jwkset, err := jwk.FetchHTTP(v.jwtURL)
+	jwkset, err := jwk.FetchHTTPWithContext(rctx, v.jwtURL)
 	if err != nil {
 		return "", err
 	}
@@ -32,12 +35,12 @@ func (v *verifier) Stream(authHeader string) (recvID string, err error) {
 	return vv.(string), nil
 }
 
-func (v *verifier) Status(authHeader string, req *caep.ReqChangeOfStreamStatus) (recvID string, status *caep.StreamStatus, err error) {
+func (v *verifier) Status(rctx context.Context, authHeader string, req *caep.ReqChangeOfStreamStatus) (recvID string, status *caep.StreamStatus, err error) {
 	hh := strings.Split(authHeader, " ")
 	if len(hh) != 2 && hh[0] != "Bearer" {
 		return "", nil, fmt.Errorf("authheader のフォーマットがおかしい %s", authHeader)
 	}
-	jwkset, err := jwk.FetchHTTP(v.jwtURL)
+	jwkset, err := jwk.FetchHTTPWithContext(rctx, v.jwtURL)
 	if err != nil {
 		return "", nil, err
 	}
@@ -57,13 +60,32 @@ func (v *verifier) Status(authHeader string, req *caep.ReqChangeOfStreamStatus)
 
 type addsubverifier struct {
 	verifier
-	uma uma.ResSrv
-	db  resDB
+	uma    uma.ResSrv
+	db     resDB
+	filter *scopeFilter
+	// rpts は add subject の時の RPT を覚えて、失効や認可の変更を status に反映する
+	rpts *rptTracker
 }
 
-func (v *addsubverifier) AddSub(authHeader string, req *caep.ReqAddSub) (recvID string, status *caep.StreamStatus, err error) {
+// Status は Receiver がサブジェクトを enabled に戻す時、 add subject で提示した RPT がまだ有効か確かめる
+// RPT が失効したり取り消されたりした後は、新しい RPT で add subject し直さなければ enabled に戻せない
+func (v *addsubverifier) Status(rctx context.Context, authHeader string, req *caep.ReqChangeOfStreamStatus) (recvID string, status *caep.StreamStatus, err error) {
+	recvID, status, err = v.verifier.Status(rctx, authHeader, req)
+	if err != nil {
+		return "", nil, err
+	}
+	if req != nil && req.Status == caep.StatusEnabled && !req.Subject.IsZero() && !v.rpts.valid(recvID, &req.Subject) {
+		return "", nil, newTrE(fmt.Errorf("recvID(%s) の subject(%s) には有効な RPT がないので enabled に戻せない。 add subject し直してください", recvID, req.Subject.Key()), caep.TransErrorForbidden)
+	}
+	return recvID, status, nil
+}
+
+func (v *addsubverifier) AddSub(rctx context.Context, authHeader string, req *caep.ReqAddSub) (recvID string, status *caep.StreamStatus, err error) {
 	hh := strings.Split(authHeader, " ")
-	spagID := req.Sub.SpagID
+	spagID, err := spagIDOf(&req.Sub)
+	if err != nil {
+		return "", nil, newTrE(err, caep.TransErrorNotFound)
+	}
 	if len(hh) != 2 && hh[0] != "Bearer" {
 		// RPT トークンがないということは .. ?
 		var reqs []uma.ResReqForPT
@@ -72,16 +94,26 @@ func (v *addsubverifier) AddSub(authHeader string, req *caep.ReqAddSub) (recvID
 			if err != nil {
 				continue
 			}
+			// CAP が扱っていないスコープは要求しない
+			var supported []string
+			for _, s := range scopes {
+				if contains(v.filter.ctxs[ctxID], s) {
+					supported = append(supported, s)
+				}
+			}
+			if len(supported) == 0 {
+				continue
+			}
 			req := uma.ResReqForPT{
 				ID:     res.ID,
-				Scopes: scopes,
+				Scopes: supported,
 			}
 			reqs = append(reqs, req)
 		}
 		if len(reqs) == 0 {
 			return "", nil, newTrE(fmt.Errorf("this sub(id: %s) は一つもコンテキストをCAEPの対象としていない", spagID), caep.TransErrorNotFound)
 		}
-		pt, err := v.uma.PermissionTicket(reqs)
+		pt, err := v.uma.PermissionTicket(rctx, reqs)
 		if err != nil {
 			return "", nil, err
 		}
@@ -89,7 +121,7 @@ func (v *addsubverifier) AddSub(authHeader string, req *caep.ReqAddSub) (recvID
 		m := map[string]string{"WWW-Authenticate": s}
 		return "", nil, newTrEO(fmt.Errorf("UMA NoRPT"), caep.TransErrorUnAuthorized, m)
 	}
-	jwkset, err := jwk.FetchHTTP(v.jwtURL)
+	jwkset, err := jwk.FetchHTTPWithContext(rctx, v.jwtURL)
 	if err != nil {
 		return "", nil, err
 	}
@@ -98,92 +130,173 @@ func (v *addsubverifier) AddSub(authHeader string, req *caep.ReqAddSub) (recvID
 		return "", nil, err
 	}
 
+	if exp := tok.Expiration(); !exp.IsZero() && time.Now().After(exp) {
+		return "", nil, fmt.Errorf("RPT の有効期限が切れている")
+	}
+
 	vv, _ := tok.Get("azp")
 	recvID = vv.(string)
-	eventscopes, err := permittedEventScopesFrom(tok)
+	eventscopes, err := v.filter.permissions(spagID, tok)
 	if err != nil {
 		return "", nil, err
 	}
+	if len(eventscopes) == 0 {
+		return "", nil, fmt.Errorf("RPT は sub(id: %s) のコンテキストを一つも認可していない", spagID)
+	}
+	v.rpts.track(trackedRPT{
+		RecvID:  recvID,
+		SpagID:  spagID,
+		Subject: req.Sub,
+		RPT:     hh[1],
+		Exp:     tok.Expiration(),
+	})
 	status = &caep.StreamStatus{
-		Status:      "enabled",
-		SpagID:      spagID,
+		Status:      caep.StatusEnabled,
+		Subject:     req.Sub,
 		EventScopes: eventscopes,
 	}
 	return recvID, status, nil
 }
 
-func permittedEventScopesFrom(tok jwt.Token) (map[string][]string, error) {
-	eventscopes := make(map[string][]string)
-	vv, ok := tok.Get("authorization")
-	if !ok {
-		return nil, fmt.Errorf("RPTパースえらー")
-	}
-	v1, ok := vv.(map[string]interface{})
-	v2, ok := v1["permissions"]
-	v3, ok := v2.([]interface{})
-	for _, v4 := range v3 {
-		v5, ok := v4.(map[string]interface{})
-		if !ok {
-			return nil, fmt.Errorf("RPTパースえらー")
-		}
-		v6, ok := v5["scopes"]
-		v7, ok := v6.([]interface{})
-		var scopes []string
-		for _, v8 := range v7 {
-			s, ok := v8.(string)
-			if !ok {
-				return nil, fmt.Errorf("RPTパースえらー")
-			}
-			scopes = append(scopes, s)
-		}
-		v9, ok := v5["rsname"]
-		ctxID, ok := v9.(string)
-		eventscopes[ctxID] = scopes
+// spagIDOf は Receiver が指定した subject から CAP でのユーザ識別子を取り出す
+// CAP のユーザは認可サーバでの sub を iss_sub 形式か opaque 形式で指定してもらう
+func spagIDOf(sub *caep.Subject) (string, error) {
+	p := sub.Principal()
+	if p == nil {
+		return "", fmt.Errorf("subject にユーザが含まれていない")
 	}
-	return eventscopes, nil
+	if id, ok := p.Find(caep.SubjectFormatIssSub); ok {
+		return id.Sub, nil
+	}
+	if id, ok := p.Find(caep.SubjectFormatOpaque); ok {
+		return id.ID, nil
+	}
+	return "", fmt.Errorf("subject(%s) から CAP のユーザを識別できない", sub.Key())
 }
 
+// trStreamDB は Receiver の登録情報とその Stream を保持する
 type trStreamDB struct {
-	m  sync.RWMutex
-	db map[string]caep.Receiver
+	m sync.RWMutex
+	// recvs は recvID -> Stream の雛形となる登録情報
+	recvs map[string]caep.Receiver
+	// db は recvID -> streamID -> Stream
+	db map[string]map[string]caep.Receiver
+}
+
+func newTrStreamDB() *trStreamDB {
+	return &trStreamDB{
+		recvs: make(map[string]caep.Receiver),
+		db:    make(map[string]map[string]caep.Receiver),
+	}
+}
+
+// register は Receiver を登録する。 Stream は Receiver が作る
+func (db *trStreamDB) register(recv *caep.Receiver) {
+	db.m.Lock()
+	defer db.m.Unlock()
+	db.recvs[recv.ID] = *recv
 }
 
-func (db *trStreamDB) Load(recvID string) (*caep.Receiver, error) {
+// registered は登録されている全ての Receiver を recvID の順に返す
+func (db *trStreamDB) registered() []caep.Receiver {
 	db.m.RLock()
 	defer db.m.RUnlock()
-	recv, ok := db.db[recvID]
+	var ret []caep.Receiver
+	for _, recv := range db.recvs {
+		ret = append(ret, recv)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+func (db *trStreamDB) Registration(recvID string) (*caep.Receiver, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	recv, ok := db.recvs[recvID]
 	if !ok {
 		return nil, fmt.Errorf("recvID(%s) は登録されてません", recvID)
 	}
+	conf := *recv.StreamConf
+	recv.StreamConf = &conf
 	return &recv, nil
 }
 
+func (db *trStreamDB) Load(recvID, streamID string) (*caep.Receiver, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	recv, ok := db.db[recvID][streamID]
+	if !ok {
+		return nil, fmt.Errorf("recvID(%s) には stream(%s) がない", recvID, streamID)
+	}
+	return &recv, nil
+}
+
+func (db *trStreamDB) List(recvID string) ([]caep.Receiver, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	var ret []caep.Receiver
+	for _, recv := range db.db[recvID] {
+		ret = append(ret, recv)
+	}
+	return ret, nil
+}
+
 func (db *trStreamDB) Save(recv *caep.Receiver) error {
 	db.m.Lock()
 	defer db.m.Unlock()
-	db.db[recv.ID] = *recv
+	if _, ok := db.recvs[recv.ID]; !ok {
+		return fmt.Errorf("recvID(%s) は登録されてません", recv.ID)
+	}
+	streams, ok := db.db[recv.ID]
+	if !ok {
+		streams = make(map[string]caep.Receiver)
+		db.db[recv.ID] = streams
+	}
+	streams[recv.StreamConf.StreamID] = *recv
 	return nil
 }
 
+func (db *trStreamDB) Delete(recvID, streamID string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	delete(db.db[recvID], streamID)
+	return nil
+}
+
+// trStatusDB は Stream ごとのサブジェクトの status を保持する
 type trStatusDB struct {
 	m  sync.RWMutex
-	db map[string]map[string]caep.StreamStatus
+	db map[string]map[string]caep.StreamStatus // recvID -> streamID/subKey -> status
 }
 
-func (db *trStatusDB) Load(recvID, spagID string) (*caep.StreamStatus, error) {
+func (db *trStatusDB) Load(recvID, streamID, subKey string) (*caep.StreamStatus, error) {
 	db.m.RLock()
 	defer db.m.RUnlock()
 	subs, ok := db.db[recvID]
 	if !ok || subs == nil {
 		return nil, fmt.Errorf("recvID(%s) にはまだ status が一つもない", recvID)
 	}
-	status, ok := subs[spagID]
+	status, ok := subs[streamID+"/"+subKey]
 	if !ok {
-		return nil, fmt.Errorf("recvID(%s) には spagID(%s) のステータスがない", recvID, spagID)
+		return nil, fmt.Errorf("recvID(%s) の stream(%s) には subject(%s) のステータスがない", recvID, streamID, subKey)
 	}
 	return &status, nil
 }
 
+// list は recvID の streamID の Stream に追加された全てのサブジェクトの status を返す
+func (db *trStatusDB) list(recvID, streamID string) []caep.StreamStatus {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	var ret []caep.StreamStatus
+	for key, status := range db.db[recvID] {
+		if strings.HasPrefix(key, streamID+"/") {
+			ret = append(ret, status)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Subject.Key() < ret[j].Subject.Key() })
+	return ret
+}
+
 func (db *trStatusDB) Save(recvID string, status *caep.StreamStatus) error {
 	db.m.Lock()
 	defer db.m.Unlock()
@@ -192,7 +305,29 @@ func (db *trStatusDB) Save(recvID string, status *caep.StreamStatus) error {
 		subs = make(map[string]caep.StreamStatus)
 		db.db[recvID] = subs
 	}
-	subs[status.SpagID] = *status
+	subs[status.StreamID+"/"+status.Subject.Key()] = *status
+	return nil
+}
+
+func (db *trStatusDB) Delete(recvID, streamID, subKey string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	subs, ok := db.db[recvID]
+	if !ok || subs == nil {
+		return fmt.Errorf("recvID(%s) にはまだ status が一つもない", recvID)
+	}
+	delete(subs, streamID+"/"+subKey)
+	return nil
+}
+
+func (db *trStatusDB) DeleteStream(recvID, streamID string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	for key := range db.db[recvID] {
+		if strings.HasPrefix(key, streamID+"/") {
+			delete(db.db[recvID], key)
+		}
+	}
 	return nil
 }
 
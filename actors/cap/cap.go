@@ -1,12 +1,14 @@
 package cap
 
 import (
+	"encoding/json"
 	"fmt"
 	"mime"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	ztfsession "github.com/hatake5051/ztf-prototype/actors/session"
 	"github.com/hatake5051/ztf-prototype/caep"
 	"github.com/hatake5051/ztf-prototype/openid"
 	"github.com/lestrrat-go/jwx/jwa"
@@ -15,22 +17,28 @@ import (
 
 // New は CAP のサーバを構築する
 func (c *Conf) New() *mux.Router {
-	store := sessions.NewCookieStore([]byte("super-secret-key"))
+	store, err := c.Session.New()
+	if err != nil {
+		panic(fmt.Sprintf("セッションストアの構成に失敗 %v", err))
+	}
 	u := c.UMA.to().New()
 	us, db := newUMASrv(u, c.CAP.Contexts, store)
+	filter := &scopeFilter{ctxs: c.CAP.Contexts, res: db}
 	jwtURL := "http://idp.ztf-proto.k3.ipv6.mobi/auth/realms/context-share/protocol/openid-connect/certs"
 	v := &addsubverifier{
 		verifier{jwtURL},
 		u,
 		db,
+		filter,
+		nil,
 	}
-	recvRepo := &trStreamDB{db: make(map[string]caep.Receiver)}
+	recvRepo := newTrStreamDB()
 	var eventsupported []string
 	for ctxID := range c.CAP.Contexts {
 		eventsupported = append(eventsupported, ctxID)
 	}
 	for recvID, v := range c.CAEP.Receivers {
-		recvRepo.Save(&caep.Receiver{
+		recvRepo.register(&caep.Receiver{
 			ID:   recvID,
 			Host: v.Host,
 			StreamConf: &caep.StreamConfig{
@@ -42,16 +50,24 @@ func (c *Conf) New() *mux.Router {
 	}
 	recvs := &recvs{
 		inner: recvRepo,
-		db:    make(map[string][]string),
+		db:    make(map[string][]streamRef),
 	}
 	statusRepo := &trStatusDB{db: make(map[string]map[string]caep.StreamStatus)}
 	d := &distributer{
-		inner: statusRepo,
-		ctxs:  c.CAP.Contexts,
-		recvs: recvs,
+		inner:  statusRepo,
+		ctxs:   c.CAP.Contexts,
+		recvs:  recvs,
+		filter: filter,
+	}
+	outbox, err := newTrOutboxDB(c.CAEP.OutboxFile)
+	if err != nil {
+		panic(fmt.Sprintf("Outbox の読み込みに失敗 %v", err))
 	}
-	tr := c.CAEP.to().New(recvs, d, v)
+	tr := c.CAEP.to().New(recvs, d, outbox, v)
 	d.tr = tr
+	v.rpts = newRPTTracker(u, filter, statusRepo, recvs, c.UMA.rptCheckInterval())
+	v.rpts.tr = tr
+	go v.rpts.run()
 	cap := &cap{
 		ctxs:     c.CAP.Contexts,
 		store:    store,
@@ -62,6 +78,15 @@ func (c *Conf) New() *mux.Router {
 	}
 	r := mux.NewRouter()
 	tr.Router(r)
+	if c.Admin != nil && c.Admin.Token != "" {
+		a := &admin{
+			token:      c.Admin.Token,
+			tr:         tr,
+			streams:    recvRepo,
+			statusRepo: statusRepo,
+		}
+		a.Router(r)
+	}
 
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/hello/", http.StatusFound) })
 	s1 := r.PathPrefix("/hello").Subrouter()
@@ -87,7 +112,7 @@ type cap struct {
 }
 
 func (c *cap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	session, err := c.store.Get(r, "CAP_AUTHN")
+	session, err := ztfsession.Get(c.store, r, "CAP_AUTHN")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -110,7 +135,7 @@ func (c *cap) OIDCMW(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		session, err := c.store.Get(r, "CAP_AUTHN")
+		session, err := ztfsession.Get(c.store, r, "CAP_AUTHN")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -132,11 +157,16 @@ func (c *cap) OIDCCallback(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	session, err := c.store.Get(r, "CAP_AUTHN")
+	session, err := ztfsession.Get(c.store, r, "CAP_AUTHN")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// セッション固定攻撃を防ぐためログイン後は新しいセッションとして保存する
+	if err := ztfsession.Renew(r, w, session); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	session.Values["name"] = idToken.PreferredUsername()
 	if err := session.Save(r, w); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -153,34 +183,54 @@ func (c *cap) OIDCCallback(w http.ResponseWriter, r *http.Request) {
 func (c *cap) Recv(w http.ResponseWriter, r *http.Request) {
 	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		setErr(w, caep.SetErrInvalidRequest, err.Error())
 		return
 	}
 	if contentType != "application/secevent+jwt" {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		setErr(w, caep.SetErrInvalidRequest, "content-type が application/secevent+jwt ではない")
 		return
 	}
 
 	tok, err := jwt.Parse(r.Body, jwt.WithVerify(jwa.HS256, []byte("for-agent-sending")))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		setErr(w, caep.SetErrAuthenticationFailed, err.Error())
 		return
 	}
 	v, ok := tok.Get("events")
 	if !ok {
-		http.Error(w, "送られてきたSETに events property がない", http.StatusInternalServerError)
+		setErr(w, caep.SetErrInvalidRequest, "送られてきたSETに events property がない")
 		return
 	}
-	e, ok := caep.NewSETEventsClaimFromJson(v)
-	if !ok {
-		http.Error(w, "送られてきたSET events property のパースに失敗", http.StatusInternalServerError)
+	events, err := caep.DecodeEvents(v)
+	if err != nil {
+		setErr(w, caep.SetErrInvalidRequest, err.Error())
 		return
 	}
-	c.distr.RecvAndDistribute(e)
+	// 一つでもコンテキストの変更でないイベントがあれば SET ごと受け付けない
+	var ctxs []*caep.SSEEventClaim
+	for _, e := range events {
+		e, ok := e.(*caep.SSEEventClaim)
+		if !ok {
+			setErr(w, caep.SetErrInvalidRequest, "コンテキストの変更を表すイベントではない")
+			return
+		}
+		ctxs = append(ctxs, e)
+	}
+	for _, e := range ctxs {
+		c.distr.RecvAndDistribute(e)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// setErr は SET を受け付けられないことを RFC 8935 Sec.2.3 のエラー応答で伝える
+func setErr(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(&caep.SetErr{Err: code, Description: description})
 }
 
 func (c *cap) CtxList(w http.ResponseWriter, r *http.Request) {
-	session, err := c.store.Get(r, "UMA_PROTECTION_API_AUTHN")
+	session, err := ztfsession.Get(c.store, r, "UMA_PROTECTION_API_AUTHN")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -217,7 +267,7 @@ func (c *cap) OIDCMWForUMAProtectionAPI(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		session, err := c.store.Get(r, "UMA_PROTECTION_API_AUTHN")
+		session, err := ztfsession.Get(c.store, r, "UMA_PROTECTION_API_AUTHN")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -239,11 +289,16 @@ func (c *cap) OIDCCallbackForUMAProtectionAPI(w http.ResponseWriter, r *http.Req
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	session, err := c.store.Get(r, "UMA_PROTECTION_API_AUTHN")
+	session, err := ztfsession.Get(c.store, r, "UMA_PROTECTION_API_AUTHN")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// セッション固定攻撃を防ぐためログイン後は新しいセッションとして保存する
+	if err := ztfsession.Renew(r, w, session); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	session.Values["subject"] = idToken.Subject()
 	session.Values["name"] = idToken.PreferredUsername()
 	if err := session.Save(r, w); err != nil {
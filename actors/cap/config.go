@@ -1,16 +1,28 @@
 package cap
 
 import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/hatake5051/ztf-prototype/actors/session"
 	"github.com/hatake5051/ztf-prototype/caep"
 	"github.com/hatake5051/ztf-prototype/openid"
 	"github.com/hatake5051/ztf-prototype/uma"
+	"github.com/lestrrat-go/jwx/jwa"
 )
 
 // Conf は CAP の設定情報
 type Conf struct {
-	CAP  *CAPConf  `json:"cap"`
-	UMA  *UMAConf  `json:"uma"`
-	CAEP *CAEPConf `json:"caep"`
+	CAP     *CAPConf      `json:"cap"`
+	UMA     *UMAConf      `json:"uma"`
+	CAEP    *CAEPConf     `json:"caep"`
+	Session *session.Conf `json:"session"`
+	// Admin は運用者向け管理 API の設定情報。 nil の時は管理 API を公開しない
+	Admin *AdminConf `json:"admin"`
 }
 
 // CAPConf は CAP その者の設定情報
@@ -24,6 +36,22 @@ type UMAConf struct {
 	AuthZ        string `json:"authZ"`
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
+	// RPTCheckInterval は Receiver の RPT を Introspection し直す間隔 ("30s" など)
+	// 空の時は 1 分
+	RPTCheckInterval string `json:"rpt_check_interval"`
+}
+
+// rptCheckInterval は RPT を確認する間隔を返す
+// パースに失敗するとパニック
+func (c *UMAConf) rptCheckInterval() time.Duration {
+	if c.RPTCheckInterval == "" {
+		return defaultRPTCheckInterval
+	}
+	d, err := time.ParseDuration(c.RPTCheckInterval)
+	if err != nil {
+		panic(fmt.Sprintf("rpt_check_interval(%s) のパースに失敗 %v", c.RPTCheckInterval, err))
+	}
+	return d
 }
 
 func (c *UMAConf) to() *uma.ResSrvConf {
@@ -74,10 +102,55 @@ type CAEPConf struct {
 		ClientID string `json:"client_id"`
 		Host     string `json:"host"`
 	} `json:"receivers"`
+	SigningKey *SigningKey `json:"signing_key"`
+	// PollEndpoint は Receiver が Poll で SET を取りに来るエンドポイント
+	// 空の時は Push でのみ配送する
+	PollEndpoint string `json:"poll_endpoint"`
+	// OutboxFile は Push で配送待ちの SET と dead letter を保存するファイルのパス
+	// 空の時はメモリにのみ保持するので、 CAP を再起動すると配送待ちの SET は失われる
+	OutboxFile string `json:"outbox_file"`
+	// BatchWindow は同じ subject に対するコンテキストの変更をまとめて送るまで待つ時間 ("500ms" など)
+	// 空の時はまとめずにすぐ送る
+	BatchWindow string `json:"batch_window"`
+}
+
+// SigningKey は CAP が SET に署名する鍵の設定情報
+type SigningKey struct {
+	// Alg は署名アルゴリズム (RS256, ES256 など)
+	Alg string `json:"alg"`
+	// KeyFile は PEM 形式の秘密鍵のパス。空の時は起動時に生成する
+	KeyFile string `json:"key_file"`
+	// KeyID は JWKS で公開する時の kid
+	KeyID string `json:"kid"`
+}
+
+func (c *SigningKey) load() (crypto.Signer, error) {
+	if c.KeyFile == "" {
+		return nil, nil
+	}
+	raw, err := ioutil.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("署名鍵(%s) は PEM 形式ではない", c.KeyFile)
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		s, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("署名鍵(%s) は署名に使えない", c.KeyFile)
+		}
+		return s, nil
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
 }
 
 func (c *CAEPConf) to() *caep.TransConf {
-	return &caep.TransConf{
+	conf := &caep.TransConf{
 		Tr: &caep.Transmitter{
 			Issuer:                   c.Metadata.Issuer,
 			JwksURI:                  c.Metadata.JwksURI,
@@ -89,5 +162,23 @@ func (c *CAEPConf) to() *caep.TransConf {
 			RemoveSubjectEndpoint:    c.Metadata.RemoveSubjectEndpoint,
 			VerificationEndpoint:     c.Metadata.VerificationEndpoint,
 		},
+		PollEndpoint: c.PollEndpoint,
+	}
+	if c.BatchWindow != "" {
+		d, err := time.ParseDuration(c.BatchWindow)
+		if err != nil {
+			panic(fmt.Sprintf("batch_window(%s) のパースに失敗 %v", c.BatchWindow, err))
+		}
+		conf.BatchWindow = d
+	}
+	if c.SigningKey != nil {
+		key, err := c.SigningKey.load()
+		if err != nil {
+			panic(fmt.Sprintf("SET の署名鍵の読み込みに失敗 %v", err))
+		}
+		conf.SigAlg = jwa.SignatureAlgorithm(c.SigningKey.Alg)
+		conf.SigKey = key
+		conf.SigKeyID = c.SigningKey.KeyID
 	}
+	return conf
 }
@@ -2,7 +2,6 @@ package cap
 
 import (
 	"fmt"
-	"strings"
 	"sync"
 
 	"github.com/hatake5051/ztf-prototype/caep"
@@ -13,29 +12,69 @@ type ctx struct {
 	ScopeValues map[string]string
 }
 
+// streamRef はコンテキストの配送先となる Stream を指す
+type streamRef struct {
+	RecvID   string
+	StreamID string
+}
+
 type recvs struct {
 	inner caep.RecvRepo
 	m     sync.RWMutex
-	db    map[string][]string // ctxID -> ctxID デリバーされるレシーバーID
+	db    map[string][]streamRef // ctxID -> ctxID デリバーされる Stream
+}
+
+func (r *recvs) Registration(recvID string) (*caep.Receiver, error) {
+	return r.inner.Registration(recvID)
 }
 
-func (r *recvs) Load(recvID string) (*caep.Receiver, error) {
-	return r.inner.Load(recvID)
+func (r *recvs) Load(recvID, streamID string) (*caep.Receiver, error) {
+	return r.inner.Load(recvID, streamID)
+}
+
+func (r *recvs) List(recvID string) ([]caep.Receiver, error) {
+	return r.inner.List(recvID)
 }
 
 func (r *recvs) Save(recv *caep.Receiver) error {
 	if err := r.inner.Save(recv); err != nil {
 		return err
 	}
+	ref := streamRef{recv.ID, recv.StreamConf.StreamID}
 	r.m.Lock()
 	defer r.m.Unlock()
+	r.forget(ref)
 	for _, ctxID := range recv.StreamConf.EventsDelivered {
-		r.db[ctxID] = append(r.db[ctxID], recv.ID)
+		r.db[ctxID] = append(r.db[ctxID], ref)
 	}
 	return nil
 }
 
-func (r *recvs) WhereDistribution(ctxID string) []string {
+func (r *recvs) Delete(recvID, streamID string) error {
+	if err := r.inner.Delete(recvID, streamID); err != nil {
+		return err
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.forget(streamRef{recvID, streamID})
+	return nil
+}
+
+// forget は ref をどのコンテキストの配送先からも外す
+// 呼び出し側で r.m のロックを取っておくこと
+func (r *recvs) forget(ref streamRef) {
+	for ctxID, refs := range r.db {
+		var rest []streamRef
+		for _, s := range refs {
+			if s != ref {
+				rest = append(rest, s)
+			}
+		}
+		r.db[ctxID] = rest
+	}
+}
+
+func (r *recvs) WhereDistribution(ctxID string) []streamRef {
 	r.m.RLock()
 	defer r.m.RUnlock()
 	return r.db[ctxID]
@@ -46,6 +85,8 @@ type distributer struct {
 	ctxs  map[string][]string
 	recvs *recvs
 	tr    caep.Tr
+	// filter は RPT で認可されたスコープだけを送るようにする
+	filter *scopeFilter
 }
 
 func (d *distributer) RecvAndDistribute(e *caep.SSEEventClaim) {
@@ -54,128 +95,96 @@ func (d *distributer) RecvAndDistribute(e *caep.SSEEventClaim) {
 		ID:          e.ID,
 		ScopeValues: e.Property,
 	}
-	spagID := e.Subject.SpagID
-	recvers := d.recvs.WhereDistribution(e.ID)
-	for _, recvID := range recvers {
-		d.Ditribute(c, spagID, recvID)
+	subKey := e.Subject.Key()
+	streams := d.recvs.WhereDistribution(e.ID)
+	for _, s := range streams {
+		d.Ditribute(c, subKey, s)
 	}
 }
 
-func (d *distributer) Ditribute(c *ctx, spagID, recvID string) {
-	recv, err := d.recvs.Load(recvID)
+// Ditribute はコンテキストを subKey で識別される subject を登録している Stream に送る
+func (d *distributer) Ditribute(c *ctx, subKey string, s streamRef) {
+	recv, err := d.recvs.Load(s.RecvID, s.StreamID)
 	if err != nil {
-		fmt.Printf("recvID(%s) に対応するレシーバがいないよ\n", recvID)
+		fmt.Printf("recvID(%s) の stream(%s) がないよ\n", s.RecvID, s.StreamID)
 		return
 	}
 	aud := []caep.Receiver{*recv}
-	status, err := d.inner.Load(recvID, spagID)
+	status, err := d.inner.Load(s.RecvID, s.StreamID, subKey)
 	if err != nil {
-		fmt.Printf("recvID(%s) には spagID(%s) が登録されてないみたい\n", recvID, spagID)
+		fmt.Printf("recvID(%s) の stream(%s) には subject(%s) が登録されてないみたい\n", s.RecvID, s.StreamID, subKey)
 		return
 	}
-	var scopes []string
-	for ctxName, ss := range status.EventScopes {
-		ctxID := ""
-		for cid := range d.ctxs {
-			if strings.Contains(ctxName, cid) {
-				ctxID = cid
-				break
-			}
-		}
-		if ctxID == c.ID {
-			scopes = ss
-			break
-		}
-	}
-	prop := make(map[string]string)
-	for scope, v := range c.ScopeValues {
-		for _, s := range scopes {
-			if scope == s {
-				prop[scope] = v
-				break
-			}
-		}
-	}
-
-	ev := &caep.SSEEventClaim{
-		ID: c.ID,
-		Subject: struct {
-			SubType string "json:\"subject_type\""
-			SpagID  string "json:\"spag_id\""
-		}{"spag", status.SpagID},
-		Property: prop,
+	// paused や disabled の時は Transmitter が保留するか捨てる
+	ev, ok := d.filter.filter(status, c)
+	if !ok {
+		fmt.Printf("recvID(%s) の stream(%s) の subject(%s) には ctx(%s) が認可されていないので送信しない\n", s.RecvID, s.StreamID, subKey, c.ID)
+		return
 	}
 	if err := d.tr.Transmit(aud, ev); err != nil {
-		fmt.Printf("送信に失敗 to RecvID(%s) %v because %v\n", recvID, ev, err)
+		fmt.Printf("送信に失敗 to RecvID(%s) %v because %v\n", s.RecvID, ev, err)
 	}
 }
 
 func (d *distributer) DistributeDueToSubStatus(recvID string, status *caep.StreamStatus) {
-	if status.Status != "enabled" {
+	// paused の間の変更は Transmitter が保留しているので、全てのコンテキストを送るのは enabled の時だけ
+	if status.Status != caep.StatusEnabled {
 		return
 	}
-	cm := make(map[string]ctx)
-	for ctxID, scopes := range d.ctxs {
-		sv := make(map[string]string)
-		for _, s := range scopes {
-			sv[s] = s + ":value"
-		}
-		cm[ctxID] = ctx{
-			ID:          ctxID,
-			ScopeValues: sv,
-		}
-	}
-	recv, err := d.recvs.Load(recvID)
+	recv, err := d.recvs.Load(recvID, status.StreamID)
 	if err != nil {
-		fmt.Printf("recvID(%s) に対応するレシーバがいないよ\n", recvID)
+		fmt.Printf("recvID(%s) の stream(%s) がないよ\n", recvID, status.StreamID)
 		return
 	}
 	aud := []caep.Receiver{*recv}
-	for ctxName, scopes := range status.EventScopes {
-		ctxID := ""
-		for cid := range d.ctxs {
-			if strings.Contains(ctxName, cid) {
-				ctxID = cid
-				break
-			}
-		}
-		ctx, ok := cm[ctxID]
+	// subject の認可された全てのコンテキストを一つの SET にまとめて送る
+	var evs []caep.Event
+	for ctxID := range status.EventScopes {
+		scopes, ok := d.ctxs[ctxID]
 		if !ok {
-			fmt.Printf("no ctx stored in db[spagid: %s, ctxID: %s]\n", status.SpagID, ctxID)
+			fmt.Printf("no ctx stored in db[subject: %s, ctxID: %s]\n", status.Subject.Key(), ctxID)
 			continue
 		}
-		prop := make(map[string]string)
-		for scope, v := range ctx.ScopeValues {
-			for _, s := range scopes {
-				if scope == s {
-					prop[scope] = v
-					break
-				}
-			}
-		}
-
-		ev := &caep.SSEEventClaim{
-			ID: ctx.ID,
-			Subject: struct {
-				SubType string "json:\"subject_type\""
-				SpagID  string "json:\"spag_id\""
-			}{"spag", status.SpagID},
-			Property: prop,
+		sv := make(map[string]string)
+		for _, s := range scopes {
+			sv[s] = s + ":value"
 		}
-		if err := d.tr.Transmit(aud, ev); err != nil {
-			fmt.Printf("送信に失敗 to RecvID(%s) %v because %v\n", recvID, ev, err)
+		ev, ok := d.filter.filter(status, &ctx{ID: ctxID, ScopeValues: sv})
+		if !ok {
+			continue
 		}
+		evs = append(evs, ev)
+	}
+	if len(evs) == 0 {
+		return
 	}
+	if err := d.tr.Transmit(aud, evs...); err != nil {
+		fmt.Printf("送信に失敗 to RecvID(%s) %v because %v\n", recvID, evs, err)
+	}
+}
+
+func (d *distributer) Load(recvID, streamID, subKey string) (*caep.StreamStatus, error) {
+	return d.inner.Load(recvID, streamID, subKey)
 }
 
-func (d *distributer) Load(recvID, spagID string) (*caep.StreamStatus, error) {
-	return d.inner.Load(recvID, spagID)
+func (d *distributer) Delete(recvID, streamID, subKey string) error {
+	return d.inner.Delete(recvID, streamID, subKey)
+}
+
+func (d *distributer) DeleteStream(recvID, streamID string) error {
+	return d.inner.DeleteStream(recvID, streamID)
 }
 
 func (d *distributer) Save(recvID string, status *caep.StreamStatus) error {
+	prev, err := d.inner.Load(recvID, status.StreamID, status.Subject.Key())
+	resumed := err == nil && prev.Status == caep.StatusPaused
 	if err := d.inner.Save(recvID, status); err != nil {
 		return err
 	}
+	if resumed {
+		// paused から戻った時は Transmitter が保留していた変更を送るので、全てのコンテキストは送らない
+		return nil
+	}
 	d.DistributeDueToSubStatus(recvID, status)
 	return nil
 }
@@ -0,0 +1,150 @@
+package cap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hatake5051/ztf-prototype/caep"
+)
+
+// trOutboxDB は Push で配送待ちの SET と dead letter を保持する
+// file を指定した時は変更の度にファイルに書き出し、 CAP を再起動しても配送を続けられるようにする
+type trOutboxDB struct {
+	m    sync.RWMutex
+	file string
+	db   map[string]map[string]caep.OutboxSET // recvID -> jti -> SET
+	dead map[string]map[string]caep.OutboxSET
+}
+
+// outboxFile は trOutboxDB をファイルに書き出す時の形式
+type outboxFile struct {
+	Outbox      map[string]map[string]caep.OutboxSET `json:"outbox"`
+	DeadLetters map[string]map[string]caep.OutboxSET `json:"dead_letters"`
+}
+
+// newTrOutboxDB は file に保存された Outbox を読み込む
+// file が空文字の時はメモリにのみ保持する
+func newTrOutboxDB(file string) (*trOutboxDB, error) {
+	db := &trOutboxDB{
+		file: file,
+		db:   make(map[string]map[string]caep.OutboxSET),
+		dead: make(map[string]map[string]caep.OutboxSET),
+	}
+	if file == "" {
+		return db, nil
+	}
+	raw, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f outboxFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("Outbox のファイル(%s) のパースに失敗 %v", file, err)
+	}
+	if f.Outbox != nil {
+		db.db = f.Outbox
+	}
+	if f.DeadLetters != nil {
+		db.dead = f.DeadLetters
+	}
+	return db, nil
+}
+
+// flush は Outbox をファイルに書き出す
+// 書き出している途中で落ちても壊れないよう、一時ファイルに書いてから置き換える
+// 呼び出し側で db.m のロックを取っておくこと
+func (db *trOutboxDB) flush() error {
+	if db.file == "" {
+		return nil
+	}
+	raw, err := json.Marshal(&outboxFile{Outbox: db.db, DeadLetters: db.dead})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(db.file), filepath.Base(db.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), db.file)
+}
+
+func (db *trOutboxDB) Save(set *caep.OutboxSET) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	save(db.db, set)
+	return db.flush()
+}
+
+func (db *trOutboxDB) Delete(recvID, jti string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	delete(db.db[recvID], jti)
+	return db.flush()
+}
+
+func (db *trOutboxDB) List(recvID string) ([]caep.OutboxSET, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	return list(db.db, recvID), nil
+}
+
+func (db *trOutboxDB) SaveDeadLetter(set *caep.OutboxSET) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	save(db.dead, set)
+	return db.flush()
+}
+
+func (db *trOutboxDB) DeleteDeadLetter(recvID, jti string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	delete(db.dead[recvID], jti)
+	return db.flush()
+}
+
+func (db *trOutboxDB) ListDeadLetters(recvID string) ([]caep.OutboxSET, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	return list(db.dead, recvID), nil
+}
+
+func save(db map[string]map[string]caep.OutboxSET, set *caep.OutboxSET) {
+	sets, ok := db[set.RecvID]
+	if !ok {
+		sets = make(map[string]caep.OutboxSET)
+		db[set.RecvID] = sets
+	}
+	sets[set.JTI] = *set
+}
+
+func list(db map[string]map[string]caep.OutboxSET, recvID string) []caep.OutboxSET {
+	var ret []caep.OutboxSET
+	for id, sets := range db {
+		if recvID != "" && id != recvID {
+			continue
+		}
+		for _, s := range sets {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,181 @@
+package cap
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hatake5051/ztf-prototype/caep"
+	"github.com/hatake5051/ztf-prototype/uma"
+)
+
+// defaultRPTCheckInterval は RPT を Introspection し直す間隔の既定値
+const defaultRPTCheckInterval = time.Minute
+
+// introspectionTimeout は一つの RPT の Introspection の応答を待つ時間
+const introspectionTimeout = 10 * time.Second
+
+// trackedRPT は Receiver が add subject の時に提示した RPT を表す
+type trackedRPT struct {
+	RecvID  string
+	SpagID  string
+	Subject caep.Subject
+	RPT     string
+	// Exp は RPT の有効期限。ゼロ値の時は期限を見ない
+	Exp time.Time
+}
+
+// rptTracker は Receiver がサブジェクトを追加した時の RPT を覚えておき、
+// 失効したり認可が狭まったりするとサブジェクトの status を変更して Receiver に伝える
+type rptTracker struct {
+	uma      uma.ResSrv
+	filter   *scopeFilter
+	statuses caep.SubStatusRepo
+	recvs    caep.RecvRepo
+	tr       caep.Tr
+	interval time.Duration
+	m        sync.Mutex
+	db       map[string]trackedRPT // recvID/subKey -> RPT
+}
+
+func newRPTTracker(u uma.ResSrv, filter *scopeFilter, statuses caep.SubStatusRepo, recvs caep.RecvRepo, interval time.Duration) *rptTracker {
+	if interval <= 0 {
+		interval = defaultRPTCheckInterval
+	}
+	return &rptTracker{
+		uma:      u,
+		filter:   filter,
+		statuses: statuses,
+		recvs:    recvs,
+		interval: interval,
+		db:       make(map[string]trackedRPT),
+	}
+}
+
+// track は recvID が sub を追加した時の RPT を覚える
+// 同じ Receiver が同じサブジェクトを追加し直した時は新しい RPT に置き換える
+func (t *rptTracker) track(rpt trackedRPT) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.db[rpt.RecvID+"/"+rpt.Subject.Key()] = rpt
+}
+
+// valid は recvID が sub を追加した時の RPT を追跡していて、有効期限が切れていないか判定する
+func (t *rptTracker) valid(recvID string, sub *caep.Subject) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	rpt, ok := t.db[recvID+"/"+sub.Key()]
+	if !ok {
+		return false
+	}
+	return rpt.Exp.IsZero() || time.Now().Before(rpt.Exp)
+}
+
+// current は rpt が recvID と sub について今追跡している RPT か判定する
+// 確認している間に add subject し直されていれば、古い RPT で status を変えない
+func (t *rptTracker) current(rpt trackedRPT) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	cur, ok := t.db[rpt.RecvID+"/"+rpt.Subject.Key()]
+	return ok && cur.RPT == rpt.RPT
+}
+
+func (t *rptTracker) untrack(rpt trackedRPT) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	key := rpt.RecvID + "/" + rpt.Subject.Key()
+	// 確認している間に新しい RPT に置き換わっていれば残す
+	if cur, ok := t.db[key]; ok && cur.RPT == rpt.RPT {
+		delete(t.db, key)
+	}
+}
+
+// run は interval ごとに全ての RPT を確認する
+func (t *rptTracker) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.checkAll()
+	}
+}
+
+func (t *rptTracker) checkAll() {
+	t.m.Lock()
+	var rpts []trackedRPT
+	for _, rpt := range t.db {
+		rpts = append(rpts, rpt)
+	}
+	t.m.Unlock()
+	for _, rpt := range rpts {
+		t.check(rpt)
+	}
+}
+
+// check は RPT の有効期限と Introspection の結果から、サブジェクトに認可されている範囲を見直す
+func (t *rptTracker) check(rpt trackedRPT) {
+	if !rpt.Exp.IsZero() && time.Now().After(rpt.Exp) {
+		t.disable(rpt, "RPT の有効期限が切れた")
+		return
+	}
+	rctx, cancel := context.WithTimeout(context.Background(), introspectionTimeout)
+	in, err := t.uma.Introspect(rctx, rpt.RPT)
+	cancel()
+	if err != nil {
+		// 認可サーバに問い合わせられない時は有効期限だけで判断する
+		fmt.Printf("recvID(%s) の subject(%s) の RPT の Introspection に失敗 %v\n", rpt.RecvID, rpt.Subject.Key(), err)
+		return
+	}
+	if !in.Active {
+		t.disable(rpt, "RPT が取り消された")
+		return
+	}
+	granted := t.filter.granted(rpt.SpagID, in.Permissions)
+	t.forEachStatus(rpt, func(status *caep.StreamStatus) {
+		sub := rpt.Subject
+		// 読んでから保存するまでを status の変更と同じロックの中で行い、 add subject し直した時の status を古い RPT で上書きしない
+		err := t.tr.UpdateScopes(rpt.RecvID, status.StreamID, &sub, func(status *caep.StreamStatus) (map[string][]string, bool) {
+			if !t.current(rpt) {
+				return nil, false
+			}
+			return narrow(status.EventScopes, granted)
+		}, "RPT で認可されたスコープが狭まった")
+		if err != nil {
+			fmt.Printf("recvID(%s) の stream(%s) の subject(%s) のスコープを狭められなかった %v\n", rpt.RecvID, status.StreamID, sub.Key(), err)
+		}
+	})
+}
+
+// disable は RPT で追加された全ての Stream でサブジェクトを disabled にする
+func (t *rptTracker) disable(rpt trackedRPT, reason string) {
+	if !t.current(rpt) {
+		return
+	}
+	t.forEachStatus(rpt, func(status *caep.StreamStatus) {
+		t.disableStream(rpt, status.StreamID, reason)
+	})
+	t.untrack(rpt)
+}
+
+func (t *rptTracker) disableStream(rpt trackedRPT, streamID, reason string) {
+	sub := rpt.Subject
+	if err := t.tr.UpdateStatus(rpt.RecvID, streamID, &sub, caep.StatusDisabled, reason); err != nil {
+		fmt.Printf("recvID(%s) の stream(%s) の subject(%s) を disabled にできなかった %v\n", rpt.RecvID, streamID, sub.Key(), err)
+	}
+}
+
+// forEachStatus は Receiver の Stream のうちサブジェクトを登録しているものの status に対して f を呼ぶ
+func (t *rptTracker) forEachStatus(rpt trackedRPT, f func(status *caep.StreamStatus)) {
+	streams, err := t.recvs.List(rpt.RecvID)
+	if err != nil {
+		fmt.Printf("recvID(%s) の Stream 一覧の取得に失敗 %v\n", rpt.RecvID, err)
+		return
+	}
+	for _, recv := range streams {
+		status, err := t.statuses.Load(rpt.RecvID, recv.StreamConf.StreamID, rpt.Subject.Key())
+		if err != nil {
+			continue
+		}
+		f(status)
+	}
+}
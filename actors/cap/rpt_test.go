@@ -0,0 +1,74 @@
+package cap
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hatake5051/ztf-prototype/caep"
+	"github.com/hatake5051/ztf-prototype/uma"
+)
+
+func TestRPTTrackerCheck(t *testing.T) {
+	sub := *caep.NewIssSub("https://idp.example", "alice")
+	rpt := trackedRPT{RecvID: "rp1", SpagID: "alice", Subject: sub, RPT: "old"}
+	newTracker := func(perms ...uma.Permission) (*rptTracker, *stubTr) {
+		status := &caep.StreamStatus{StreamID: "stream1", Status: caep.StatusEnabled, Subject: sub, EventScopes: map[string][]string{"ctx1": {"s1", "s2"}}}
+		tr := &stubTr{status: status}
+		tracker := newRPTTracker(&stubResSrv{in: &uma.Introspection{Active: true, Permissions: perms}}, newTestScopeFilter(), tr, &stubRecvs{}, 0)
+		tracker.tr = tr
+		tracker.track(rpt)
+		return tracker, tr
+	}
+
+	// 認可が狭まればサブジェクトのスコープも狭める
+	tracker, tr := newTracker(uma.Permission{ResourceID: "res-alice-ctx1", Scopes: []string{"s1"}})
+	tracker.check(rpt)
+	if want := map[string][]string{"ctx1": {"s1"}}; !reflect.DeepEqual(tr.status.EventScopes, want) {
+		t.Errorf("狭めた後のスコープ = %v, want %v", tr.status.EventScopes, want)
+	}
+
+	// 確認している間に add subject し直されていれば、古い RPT ではスコープを変えない
+	tracker, tr = newTracker()
+	tracker.track(trackedRPT{RecvID: "rp1", SpagID: "alice", Subject: sub, RPT: "new"})
+	tracker.check(rpt)
+	if len(tr.status.EventScopes["ctx1"]) != 2 {
+		t.Errorf("古い RPT でスコープを変えた %v", tr.status.EventScopes)
+	}
+}
+
+type stubResSrv struct {
+	uma.ResSrv
+	in *uma.Introspection
+}
+
+func (u *stubResSrv) Introspect(ctx context.Context, rpt string) (*uma.Introspection, error) {
+	return u.in, nil
+}
+
+// stubTr は stream1 に登録されたサブジェクトを一つだけ持つ Transmitter
+type stubTr struct {
+	caep.Tr
+	caep.SubStatusRepo
+	status *caep.StreamStatus
+}
+
+func (tr *stubTr) Load(recvID, streamID, subKey string) (*caep.StreamStatus, error) {
+	status := *tr.status
+	return &status, nil
+}
+
+func (tr *stubTr) UpdateScopes(recvID, streamID string, sub *caep.Subject, update func(status *caep.StreamStatus) (map[string][]string, bool), reason string) error {
+	if scopes, changed := update(tr.status); changed {
+		tr.status.EventScopes = scopes
+	}
+	return nil
+}
+
+type stubRecvs struct {
+	caep.RecvRepo
+}
+
+func (r *stubRecvs) List(recvID string) ([]caep.Receiver, error) {
+	return []caep.Receiver{{ID: recvID, StreamConf: &caep.StreamConfig{StreamID: "stream1"}}}, nil
+}
@@ -0,0 +1,115 @@
+package cap
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hatake5051/ztf-prototype/caep"
+	"github.com/hatake5051/ztf-prototype/uma"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+// scopeFilter は Receiver に送るコンテキストを RPT で認可された範囲に絞る
+// UMA のリソースとコンテキストの対応付けとスコープの絞り込みはここでだけ行う
+type scopeFilter struct {
+	ctxs map[string][]string // ctxID -> scopes
+	res  resDB
+}
+
+// permissions は RPT の permissions を ctxID -> 認可されたスコープ に変換する
+func (f *scopeFilter) permissions(spagID string, tok jwt.Token) (map[string][]string, error) {
+	v, ok := tok.Get("authorization")
+	if !ok {
+		return nil, fmt.Errorf("RPT に authorization クレームがない")
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	authz := new(struct {
+		Permissions []uma.Permission `json:"permissions"`
+	})
+	if err := json.Unmarshal(b, authz); err != nil {
+		return nil, fmt.Errorf("RPT の authorization クレームのパースに失敗 %v", err)
+	}
+	if authz.Permissions == nil {
+		return nil, fmt.Errorf("RPT に permissions がない")
+	}
+	return f.granted(spagID, authz.Permissions), nil
+}
+
+// granted は UMA の permissions を ctxID -> 認可されたスコープ に変換する
+// spagID のユーザのリソースでないものや、 CAP が扱っていないスコープは取り除く
+func (f *scopeFilter) granted(spagID string, perms []uma.Permission) map[string][]string {
+	ret := make(map[string][]string)
+	for _, perm := range perms {
+		ctxID, err := f.res.CtxIDOf(spagID, perm.ResourceID)
+		if err != nil {
+			fmt.Printf("RPT の permission(rsid: %s) はコンテキストに対応しないので無視する %v\n", perm.ResourceID, err)
+			continue
+		}
+		scopes := ret[ctxID]
+		for _, scope := range perm.Scopes {
+			if contains(f.ctxs[ctxID], scope) && !contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		if len(scopes) == 0 {
+			continue
+		}
+		ret[ctxID] = scopes
+	}
+	return ret
+}
+
+// narrow は current のうち granted でも認可されているものだけを残す
+// 認可が広がっていても current より広げることはしない。狭まった時は narrowed が true になる
+func narrow(current, granted map[string][]string) (ret map[string][]string, narrowed bool) {
+	ret = make(map[string][]string)
+	for ctxID, scopes := range current {
+		var rest []string
+		for _, s := range scopes {
+			if contains(granted[ctxID], s) {
+				rest = append(rest, s)
+			} else {
+				narrowed = true
+			}
+		}
+		if len(rest) > 0 {
+			ret[ctxID] = rest
+		}
+	}
+	return ret, narrowed
+}
+
+// filter は status で認可されたスコープの値だけを c から取り出して subject 宛のイベントにする
+// コンテキストが認可されていなかったり、認可されたスコープの値が一つもなければ ok が false になる
+func (f *scopeFilter) filter(status *caep.StreamStatus, c *ctx) (ev *caep.SSEEventClaim, ok bool) {
+	granted, ok := status.EventScopes[c.ID]
+	if !ok {
+		return nil, false
+	}
+	prop := make(map[string]string)
+	for scope, v := range c.ScopeValues {
+		if contains(granted, scope) && contains(f.ctxs[c.ID], scope) {
+			prop[scope] = v
+		}
+	}
+	if len(prop) == 0 {
+		return nil, false
+	}
+	return &caep.SSEEventClaim{
+		ID:       c.ID,
+		Subject:  status.Subject,
+		Property: prop,
+	}, true
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package cap
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hatake5051/ztf-prototype/caep"
+	"github.com/hatake5051/ztf-prototype/uma"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+func TestScopeFilterPermissions(t *testing.T) {
+	f := newTestScopeFilter()
+	rpt := func(perms string) jwt.Token {
+		var authz map[string]interface{}
+		if err := json.Unmarshal([]byte(`{"permissions":`+perms+`}`), &authz); err != nil {
+			t.Fatal(err)
+		}
+		tok := jwt.New()
+		tok.Set("authorization", authz)
+		return tok
+	}
+
+	// CAP が扱っていないスコープや、他のユーザのリソースの permission は取り除く
+	got, err := f.permissions("alice", rpt(`[
+		{"rsid":"res-alice-ctx1","scopes":["s1","unknown","s1"]},
+		{"rsid":"res-alice-ctx2","scopes":["unknown"]},
+		{"rsid":"res-bob-ctx1","scopes":["s2"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"ctx1": {"s1"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("permissions() = %v, want %v", got, want)
+	}
+
+	for name, tok := range map[string]jwt.Token{
+		"authorization がない": jwt.New(),
+		"permissions がない":   rpt(`null`),
+		"scopes が文字列でない":    rpt(`[{"rsid":"res-alice-ctx1","scopes":[1]}]`),
+	} {
+		if _, err := f.permissions("alice", tok); err == nil {
+			t.Errorf("%s RPT を受け付けた", name)
+		}
+	}
+}
+
+func TestScopeFilterFilter(t *testing.T) {
+	f := newTestScopeFilter()
+	sub := caep.NewIssSub("https://idp.example", "alice")
+	status := &caep.StreamStatus{Subject: *sub, EventScopes: map[string][]string{"ctx1": {"s1", "unknown"}}}
+
+	// 認可されたスコープのうち CAP が扱っているものの値だけを送る
+	ev, ok := f.filter(status, &ctx{ID: "ctx1", ScopeValues: map[string]string{"s1": "v1", "s2": "v2", "unknown": "v"}})
+	if !ok {
+		t.Fatal("認可されたコンテキストを送らない")
+	}
+	if want := map[string]string{"s1": "v1"}; ev.ID != "ctx1" || !reflect.DeepEqual(ev.Subject, *sub) || !reflect.DeepEqual(ev.Property, want) {
+		t.Errorf("filter() = %+v, want property %v", ev, want)
+	}
+
+	if _, ok := f.filter(status, &ctx{ID: "ctx2", ScopeValues: map[string]string{"s3": "v3"}}); ok {
+		t.Error("認可されていないコンテキストを送る")
+	}
+	if _, ok := f.filter(status, &ctx{ID: "ctx1", ScopeValues: map[string]string{"s2": "v2"}}); ok {
+		t.Error("認可されたスコープの値がないコンテキストを送る")
+	}
+}
+
+func newTestScopeFilter() *scopeFilter {
+	return &scopeFilter{
+		ctxs: map[string][]string{"ctx1": {"s1", "s2"}, "ctx2": {"s3"}},
+		res: &memResDB{db: map[string]string{
+			"alice/res-alice-ctx1": "ctx1",
+			"alice/res-alice-ctx2": "ctx2",
+			"bob/res-bob-ctx1":     "ctx1",
+		}},
+	}
+}
+
+type memResDB struct {
+	db map[string]string // spagID/resID -> ctxID
+}
+
+func (r *memResDB) Load(spagID, ctxID string) (*uma.Res, error) {
+	for k, v := range r.db {
+		if v == ctxID && strings.HasPrefix(k, spagID+"/") {
+			return &uma.Res{ID: strings.TrimPrefix(k, spagID+"/")}, nil
+		}
+	}
+	return nil, fmt.Errorf("spagID(%s) の ctx(%s) のリソースがない", spagID, ctxID)
+}
+
+func (r *memResDB) CtxIDOf(spagID, resID string) (string, error) {
+	ctxID, ok := r.db[spagID+"/"+resID]
+	if !ok {
+		return "", fmt.Errorf("spagID(%s) の resource(%s) がない", spagID, resID)
+	}
+	return ctxID, nil
+}
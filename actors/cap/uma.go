@@ -1,12 +1,15 @@
 package cap
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/sessions"
+	ztfsession "github.com/hatake5051/ztf-prototype/actors/session"
 	"github.com/hatake5051/ztf-prototype/uma"
 )
 
@@ -38,7 +41,7 @@ type umasrv struct {
 }
 
 func (u *umasrv) CRUD(w http.ResponseWriter, r *http.Request) {
-	session, err := u.store.Get(r, "UMA_PROTECTION_API_AUTHN")
+	session, err := ztfsession.Get(u.store, r, "UMA_PROTECTION_API_AUTHN")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -74,7 +77,7 @@ func (u *umasrv) CRUD(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("クエリが正しくないよ request: %#v", r), http.StatusBadRequest)
 		return
 	}
-	newres, err := u.uma.CRUD(r.Method, res)
+	newres, err := u.uma.CRUD(r.Context(), r.Method, res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -100,6 +103,8 @@ func (u *umasrv) CRUD(w http.ResponseWriter, r *http.Request) {
 
 type resDB interface {
 	Load(spagID, ctxID string) (*uma.Res, error)
+	// CtxIDOf は spagID のユーザの resID のリソースに対応するコンテキストの ID を返す
+	CtxIDOf(spagID, resID string) (string, error)
 }
 
 type umaDB struct {
@@ -112,6 +117,49 @@ type umaDB struct {
 }
 
 func (db *umaDB) Load(spagID, ctxID string) (*uma.Res, error) {
+	db.fetch(spagID)
+	db.m1.RLock()
+	defer db.m1.RUnlock()
+	resIDs, ok := db.db1[spagID]
+	if !ok || resIDs == nil {
+		return nil, fmt.Errorf("spagID(%s) はリソースを一つも持っていない", spagID)
+	}
+	for _, rid := range resIDs {
+		res, ok := db.db2[rid]
+		if !ok {
+			continue
+		}
+		if cid, ok := ctxIDOfResName(res.Name); ok && cid == ctxID {
+			return &res, nil
+		}
+	}
+	return nil, fmt.Errorf("spagID(%s) は ctxID(%s) のリソースを持っていない", spagID, ctxID)
+}
+
+func (db *umaDB) CtxIDOf(spagID, resID string) (string, error) {
+	db.fetch(spagID)
+	db.m1.RLock()
+	defer db.m1.RUnlock()
+	if !contains(db.db1[spagID], resID) {
+		return "", fmt.Errorf("spagID(%s) は resID(%s) のリソースを持っていない", spagID, resID)
+	}
+	res, ok := db.db2[resID]
+	if !ok {
+		return "", fmt.Errorf("resID(%s) の詳細がない", resID)
+	}
+	ctxID, ok := ctxIDOfResName(res.Name)
+	if !ok {
+		return "", fmt.Errorf("resID(%s) の名前(%s) がコンテキストのリソースではない", resID, res.Name)
+	}
+	return ctxID, nil
+}
+
+// umaFetchTimeout は登録済みリソースの取得を待つ時間
+const umaFetchTimeout = 30 * time.Second
+
+// fetch は spagID のユーザの登録済みリソースを一度だけ認可サーバから取得する
+// 取得した結果は全ての要求で共有するので、呼び出した要求の context.Context ではなく umaFetchTimeout で打ち切る
+func (db *umaDB) fetch(spagID string) {
 	db.m2.Lock()
 	once, ok := db.onces[spagID]
 	if !ok {
@@ -119,7 +167,9 @@ func (db *umaDB) Load(spagID, ctxID string) (*uma.Res, error) {
 		db.onces[spagID] = once
 	}
 	once.Do(func() {
-		resIDs, err := db.uma.List(spagID)
+		rctx, cancel := context.WithTimeout(context.Background(), umaFetchTimeout)
+		defer cancel()
+		resIDs, err := db.uma.List(rctx, spagID)
 		if err != nil {
 			fmt.Printf("spagID(%s) の登録済みリソース一覧に取得に失敗 %v\n", spagID, err)
 			return
@@ -127,7 +177,7 @@ func (db *umaDB) Load(spagID, ctxID string) (*uma.Res, error) {
 		db.m1.Lock()
 		db.db1[spagID] = resIDs
 		for _, rid := range resIDs {
-			res, err := db.uma.CRUD("GET", &uma.Res{ID: rid})
+			res, err := db.uma.CRUD(rctx, "GET", &uma.Res{ID: rid})
 			if err != nil {
 				fmt.Printf("spagID(%s) の resID(%s) の詳細取得に失敗 %v\n", spagID, rid, err)
 				continue
@@ -137,19 +187,6 @@ func (db *umaDB) Load(spagID, ctxID string) (*uma.Res, error) {
 		db.m1.Unlock()
 	})
 	db.m2.Unlock()
-	db.m1.RLock()
-	defer db.m1.RUnlock()
-	resIDs, ok := db.db1[spagID]
-	if !ok || resIDs == nil {
-		return nil, fmt.Errorf("spagID(%s) はリソースを一つも持っていない", spagID)
-	}
-	for _, rid := range resIDs {
-		res, ok := db.db2[rid]
-		if ok && strings.Contains(res.Name, ctxID) {
-			return &res, nil
-		}
-	}
-	return nil, fmt.Errorf("spagID(%s) は ctxID(%s) のリソースを持っていない", spagID, ctxID)
 }
 
 func (db *umaDB) Save(spagID string, res *uma.Res) error {
@@ -163,3 +200,13 @@ func (db *umaDB) Save(spagID string, res *uma.Res) error {
 func resName(name, ctxID string) string {
 	return fmt.Sprintf("sub:%s:ctx:%s", name, ctxID)
 }
+
+// ctxIDOfResName は UMA のリソース名からコンテキストの ID を取り出す
+// リソース名は resName で作ったもの
+func ctxIDOfResName(name string) (string, bool) {
+	i := strings.LastIndex(name, ":ctx:")
+	if i < 0 || !strings.HasPrefix(name, "sub:") {
+		return "", false
+	}
+	return name[i+len(":ctx:"):], true
+}
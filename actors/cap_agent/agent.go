@@ -12,11 +12,8 @@ import (
 
 func Send() error {
 	ev := &caep.SSEEventClaim{
-		ID: "ctx-1",
-		Subject: struct {
-			SubType string "json:\"subject_type\""
-			SpagID  string "json:\"spag_id\""
-		}{"spag", "26ba8184-895f-420d-8591-611784805fe3"},
+		ID:      "ctx-1",
+		Subject: *caep.NewIssSub("http://idp.ztf-proto.k3.ipv6.mobi/auth/realms/context-share", "26ba8184-895f-420d-8591-611784805fe3"),
 		Property: map[string]string{
 			"scope1": "new-value!!!!!",
 			"scope2": "newwwwwwwwww-valueeeee!!!!",
@@ -39,7 +36,7 @@ func Send() error {
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		return fmt.Errorf("respons status code unmatched : %v", resp.Status)
 	}
 	fmt.Printf("送信に成功  set: %s\n", ss)
@@ -5,17 +5,18 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
 	"github.com/hatake5051/ztf-prototype/ac"
 	"github.com/hatake5051/ztf-prototype/ac/controller"
 	"github.com/hatake5051/ztf-prototype/ac/pdp"
 	"github.com/hatake5051/ztf-prototype/ac/pep"
 	"github.com/hatake5051/ztf-prototype/actors/rp/pip"
+	"github.com/hatake5051/ztf-prototype/actors/session"
 )
 
 type ACConf struct {
-	PIPConf *pip.Conf
-	PDPConf *pdp.Conf
+	PIPConf     *pip.Conf
+	PDPConf     *pdp.Conf
+	SessionConf *session.Conf
 }
 
 func (c *ACConf) New(prefix string) AC {
@@ -34,7 +35,10 @@ func (c *ACConf) New(prefix string) AC {
 	for k, _ := range c.PIPConf.CAP2RP {
 		capList = append(capList, k)
 	}
-	store := sessions.NewCookieStore([]byte("super-secret-key"))
+	store, err := c.SessionConf.New()
+	if err != nil {
+		panic(fmt.Sprintf("セッションストアの構成に失敗 %v", err))
+	}
 	pep := pep.New(prefix, idp, capList, ctrl, store, &helper{})
 	return pep
 }
@@ -19,8 +19,9 @@ func main() {
 		panic(err)
 	}
 	ac := &rp.ACConf{
-		PIPConf: conf.PIP.To(),
-		PDPConf: conf.PDP.To(),
+		PIPConf:     conf.PIP.To(conf.HTTPClient()),
+		PDPConf:     conf.PDP.To(),
+		SessionConf: conf.Session,
 	}
 	r := rp.New(ac.New)
 	http.Handle("/", r)
@@ -1,22 +1,51 @@
 package rp
 
 import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
 	"github.com/hatake5051/ztf-prototype/ac/controller"
 	"github.com/hatake5051/ztf-prototype/ac/pdp"
 	"github.com/hatake5051/ztf-prototype/actors/rp/pip"
+	"github.com/hatake5051/ztf-prototype/actors/session"
 	"github.com/hatake5051/ztf-prototype/caep"
 	"github.com/hatake5051/ztf-prototype/openid"
+	"github.com/lestrrat-go/jwx/jwa"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/clientcredentials"
 )
 
 type Conf struct {
-	PIP PIP `json:"pip"`
-	PDP PDP `json:"pdp"`
+	PIP     PIP           `json:"pip"`
+	PDP     PDP           `json:"pdp"`
+	Session *session.Conf `json:"session"`
+	// HTTPTimeout は CAP や IdP へのアクセス一回の応答を待つ時間 ("10s" など)。空の時は defaultHTTPTimeout
+	HTTPTimeout string `json:"http_timeout"`
+}
+
+// defaultHTTPTimeout は CAP や IdP へのアクセス一回の応答を待つ時間の既定値
+const defaultHTTPTimeout = 30 * time.Second
+
+// HTTPClient は RP が CAP や IdP へのアクセスに共有する *http.Client を返す
+func (conf *Conf) HTTPClient() *http.Client {
+	timeout := defaultHTTPTimeout
+	if conf.HTTPTimeout != "" {
+		d, err := time.ParseDuration(conf.HTTPTimeout)
+		if err != nil {
+			panic(fmt.Sprintf("http_timeout(%s) のパースに失敗 %v", conf.HTTPTimeout, err))
+		}
+		timeout = d
+	}
+	return &http.Client{Timeout: timeout}
 }
 
 func (conf *Conf) New(repo pip.Repository) controller.Controller {
-	pip, err := conf.PIP.To().New(repo)
+	pip, err := conf.PIP.To(conf.HTTPClient()).New(repo)
 	if err != nil {
 		panic(err)
 	}
@@ -40,10 +69,11 @@ type PIP struct {
 	*CtxPIP `json:"ctx"`
 }
 
-func (c *PIP) To() *pip.Conf {
+// To は client を CAP や IdP へのアクセスに使う PIP の設定情報に変換する
+func (c *PIP) To(client *http.Client) *pip.Conf {
 	return &pip.Conf{
-		SubPIPConf: c.SubPIP.to(),
-		CtxPIPConf: c.CtxPIP.to(),
+		SubPIPConf: c.SubPIP.to(client),
+		CtxPIPConf: c.CtxPIP.to(client),
 	}
 }
 
@@ -54,10 +84,10 @@ type SubPIP struct {
 	RPConfig map[string]*OIDCRP `json:"rp_config"`
 }
 
-func (c *SubPIP) to() *pip.SubPIPConf {
+func (c *SubPIP) to(client *http.Client) *pip.SubPIPConf {
 	tmp := make(map[string]*openid.Conf)
 	for k, v := range c.RPConfig {
-		tmp[k] = v.to()
+		tmp[k] = v.to(client)
 	}
 	return &pip.SubPIPConf{
 		IssuerList: c.IssList,
@@ -72,12 +102,13 @@ type OIDCRP struct {
 	RedirectURL  string `json:"redirect_url"`
 }
 
-func (c *OIDCRP) to() *openid.Conf {
+func (c *OIDCRP) to(client *http.Client) *openid.Conf {
 	return &openid.Conf{
 		Issuer:       c.Iss,
 		ClientID:     c.ClientID,
 		ClientSecret: c.ClientSecret,
 		RedirectURL:  c.RedirectURL,
+		HTTPClient:   client,
 	}
 }
 
@@ -89,10 +120,10 @@ type CtxPIP struct {
 	CAPToRP map[string]*CAPRP `json:"cap_to_rp"`
 }
 
-func (c *CtxPIP) to() *pip.CtxPIPConf {
+func (c *CtxPIP) to(client *http.Client) *pip.CtxPIPConf {
 	tmp := make(map[string]*pip.CAPRPConf)
 	for k, v := range c.CAPToRP {
-		tmp[k] = v.to()
+		tmp[k] = v.to(client)
 	}
 	return &pip.CtxPIPConf{
 		CtxID2CAP: c.CtxToCAP,
@@ -105,10 +136,10 @@ type CAPRP struct {
 	Recv  *Recv             `json:"recv"`
 }
 
-func (c *CAPRP) to() *pip.CAPRPConf {
+func (c *CAPRP) to(client *http.Client) *pip.CAPRPConf {
 	return &pip.CAPRPConf{
-		AuthN: c.AuthN.to(),
-		Recv:  c.Recv.to(),
+		AuthN: c.AuthN.to(client),
+		Recv:  c.Recv.to(client),
 	}
 }
 
@@ -118,10 +149,10 @@ type AuthNForCAEPRecv struct {
 	OIDCRP  *OIDCRP `json:"rp_config"`
 }
 
-func (c *AuthNForCAEPRecv) to() *pip.AuthNForCAEPRecvConf {
+func (c *AuthNForCAEPRecv) to(client *http.Client) *pip.AuthNForCAEPRecvConf {
 	return &pip.AuthNForCAEPRecvConf{
 		CAPName: c.CAPName,
-		OIDCRP:  c.OIDCRP.to(),
+		OIDCRP:  c.OIDCRP.to(client),
 	}
 }
 
@@ -134,11 +165,11 @@ type Recv struct {
 	UMAConf *UMAClient `json:"uma"`
 }
 
-func (c *Recv) to() *pip.CAEPRecvConf {
+func (c *Recv) to(client *http.Client) *pip.CAEPRecvConf {
 	return &pip.CAEPRecvConf{
-		CAEPRecv:   c.CAEPRecv.to(),
-		Oauth2Conf: c.Oauth2Conf.to(),
-		UMAConf:    c.UMAConf.to(),
+		CAEPRecv:   c.CAEPRecv.to(client),
+		Oauth2Conf: c.Oauth2Conf.to(client),
+		UMAConf:    c.UMAConf.to(client),
 	}
 }
 
@@ -150,28 +181,103 @@ type CAEPRecv struct {
 	Endpoint string `json:"pushed_endpoint"`
 	// Issuer は Transmitter のホスト名
 	Iss string `json:"iss"`
+	// Encryption が設定されていれば Transmitter に SET の暗号化を求める
+	Encryption *CAEPRecvEncryption `json:"encryption"`
+	// Poll が true の時は Push ではなく Poll で SET を受け取る
+	Poll bool `json:"poll"`
 }
 
-func (c *CAEPRecv) to() *caep.RecvConf {
-	return &caep.RecvConf{
+func (c *CAEPRecv) to(client *http.Client) *caep.RecvConf {
+	conf := &caep.RecvConf{
 		Host:         c.Host,
 		RecvEndpoint: c.Endpoint,
 		Issuer:       c.Iss,
+		Poll:         c.Poll,
+		HTTPClient:   client,
 	}
+	if c.Encryption != nil {
+		conf.Encryption = &caep.RecvEncryptionConf{
+			Alg: jwa.KeyEncryptionAlgorithm(c.Encryption.Alg),
+			Enc: jwa.ContentEncryptionAlgorithm(c.Encryption.Enc),
+		}
+	}
+	return conf
+}
+
+// CAEPRecvEncryption は SET の暗号化の設定情報
+// 復号鍵は起動時に生成し、 StreamConfig で Transmitter に伝える
+type CAEPRecvEncryption struct {
+	// Alg は鍵暗号化アルゴリズム。空の時は RSA-OAEP-256
+	Alg string `json:"alg"`
+	// Enc はコンテンツ暗号化アルゴリズム。空の時は A256GCM
+	Enc string `json:"enc"`
 }
 
 type Oauth2ClientCred struct {
 	ClientID      string `json:"client_id"`
 	ClientSecret  string `json:"client_secret"`
 	TokenEndpoint string `json:"token_endpoint"`
+	// AuthMethod は token endpoint でのクライアント認証方式
+	// client_secret_basic (既定), private_key_jwt, tls_client_auth のいずれか
+	AuthMethod string `json:"auth_method"`
+	// Alg, KeyFile, KeyID は private_key_jwt の時に client assertion に署名する鍵の設定
+	// Alg が空の時は RS256
+	Alg     string `json:"alg"`
+	KeyFile string `json:"key_file"`
+	KeyID   string `json:"kid"`
+	// TLSCertFile と TLSKeyFile は tls_client_auth の時のクライアント証明書と秘密鍵 (PEM 形式)
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
 }
 
-func (c *Oauth2ClientCred) to() *clientcredentials.Config {
-	return &clientcredentials.Config{
+func (c *Oauth2ClientCred) to(client *http.Client) *pip.ClientCredConf {
+	conf := &pip.ClientCredConf{
 		ClientID:     c.ClientID,
 		ClientSecret: c.ClientSecret,
 		TokenURL:     c.TokenEndpoint,
+		AuthMethod:   c.AuthMethod,
+		SigAlg:       jwa.SignatureAlgorithm(c.Alg),
+		SigKeyID:     c.KeyID,
+		HTTPClient:   client,
+	}
+	if c.KeyFile != "" {
+		key, err := loadSigningKey(c.KeyFile)
+		if err != nil {
+			panic(fmt.Sprintf("client assertion の署名鍵の読み込みに失敗 %v", err))
+		}
+		conf.SigKey = key
+	}
+	if c.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			panic(fmt.Sprintf("クライアント証明書の読み込みに失敗 %v", err))
+		}
+		conf.TLSCert = &cert
+	}
+	return conf
+}
+
+// loadSigningKey は PEM 形式の秘密鍵を読み込む
+func loadSigningKey(file string) (crypto.Signer, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("署名鍵(%s) は PEM 形式ではない", file)
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		s, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("署名鍵(%s) は署名に使えない", file)
+		}
+		return s, nil
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
 	}
+	return x509.ParseECPrivateKey(block.Bytes)
 }
 
 // UMAClientConf は CAP で UMAClint となるための設定情報
@@ -188,8 +294,9 @@ type UMAClient struct {
 	} `json:"client_credential"`
 }
 
-func (c *UMAClient) to() *pip.UMAClientConf {
+func (c *UMAClient) to(client *http.Client) *pip.UMAClientConf {
 	return &pip.UMAClientConf{
+		HTTPClient: client,
 		ReqPartyCredential: struct {
 			Issuer string
 			Name   string
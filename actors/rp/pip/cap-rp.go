@@ -2,18 +2,21 @@ package pip
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	acpip "github.com/hatake5051/ztf-prototype/ac/pip"
 	"github.com/hatake5051/ztf-prototype/caep"
+	"github.com/hatake5051/ztf-prototype/internal/wellknown"
 	ztfopenid "github.com/hatake5051/ztf-prototype/openid"
 	"github.com/hatake5051/ztf-prototype/uma"
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/lestrrat-go/jwx/jwt/openid"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/clientcredentials"
 )
 
 // CAPRPConf は CAP の RP となるための設定情報
@@ -26,13 +29,15 @@ type CAPRPConf struct {
 }
 
 // new は CAPRP を ctxManager implements する
-func (conf *CAPRPConf) new(sm smForCtxManager, db ctxDB, umaClientDB umaClientDB) (ctxManager, error) {
+// register は RP アプリケーションのイベントの handler と middleware を caep.Recv に登録する
+func (conf *CAPRPConf) new(sm smForCtxManager, db ctxDB, umaClientDB umaClientDB, jtiDB caep.JTIStore, onAccount func(caep.Event) error, register func(caep.Recv)) (ctxManager, error) {
 	sm1 := conf.AuthN.new(sm)
 	crp := &caprp{
-		sm: sm1,
-		db: db,
+		capName: conf.AuthN.CAPName,
+		sm:      sm1,
+		db:      db,
 	}
-	recv1, err := conf.Recv.new(umaClientDB, crp.setCtx)
+	recv1, err := conf.Recv.new(umaClientDB, jtiDB, crp.setCtx, onAccount, register)
 	if err != nil {
 		return nil, err
 	}
@@ -44,14 +49,33 @@ func (conf *CAPRPConf) new(sm smForCtxManager, db ctxDB, umaClientDB umaClientDB
 // cap から ctx を収集する
 // TODO さらに own domain で収集した ctx を cap へ提供する
 type caprp struct {
-	sm   *authNForCAEPRecv
-	recv *caeprecv
-	db   ctxDB
+	capName string
+	sm      *authNForCAEPRecv
+	recv    *caeprecv
+	db      ctxDB
 }
 
-func (cm *caprp) Get(session string, req []reqCtx) ([]ctx, error) {
+func (cm *caprp) Get(rctx context.Context, session string, req []reqCtx) ([]ctx, error) {
+	ctxs, err := cm.get(rctx, session, req)
+	if err != nil && isUnavailable(err) {
+		// CAP やその認可サーバの設定情報を取得できていない
+		return nil, newEO(err, acpip.CAPUnavailable, cm.capName)
+	}
+	return ctxs, err
+}
+
+// isUnavailable は err が CAP やその認可サーバの設定情報を取得できなかったことによるものか判定する
+func isUnavailable(err error) bool {
+	if e, ok := err.(caep.RecvError); ok && e.Code() == caep.RecvErrorCodeUnavailable {
+		return true
+	}
+	var we *wellknown.Error
+	return errors.As(err, &we)
+}
+
+func (cm *caprp) get(rctx context.Context, session string, req []reqCtx) ([]ctx, error) {
 	// caep.EventStream を設定しておく
-	if err := cm.recv.SetupStream(req); err != nil {
+	if err := cm.recv.SetupStream(rctx, req); err != nil {
 		return nil, err
 	}
 	// subject for context を session から取得
@@ -61,9 +85,9 @@ func (cm *caprp) Get(session string, req []reqCtx) ([]ctx, error) {
 		return nil, err
 	}
 	// subject の stream での status を得る
-	if err := cm.recv.IsEnabledStatusFor(sub); err != nil {
+	if err := cm.recv.IsEnabledStatusFor(rctx, sub); err != nil {
 		// sub が stream で enable でない、 addsub を行う
-		if err := cm.recv.AddSub(sub, req); err != nil {
+		if err := cm.recv.AddSub(rctx, sub, req); err != nil {
 			// err は pip.Error(ReqSubmitted) を満たす場合あり
 			return nil, err
 		}
@@ -81,10 +105,29 @@ func (cm *caprp) Get(session string, req []reqCtx) ([]ctx, error) {
 func (cm *caprp) Agent() (acpip.CtxAgent, error) {
 	return &ctxagent{
 		cm.sm.Agent(),
-		cm.recv.Recv,
+		cm.recvCtx,
+	}, nil
+}
+
+// recvCtx は Push で届いた SET を処理し、コンテキストが変わったサブジェクトの session か判定する関数を返す
+func (cm *caprp) recvCtx(r *http.Request) (func(session string) bool, error) {
+	aff, err := cm.recv.Recv(r)
+	if err != nil {
+		return nil, err
+	}
+	return func(session string) bool {
+		if aff.all {
+			return true
+		}
+		sub, err := cm.sm.GetSub(session)
+		return err == nil && aff.spagIDs[sub.SpagID]
 	}, nil
 }
 
+func (cm *caprp) Forget(session string) error {
+	return cm.sm.sm.Delete(session)
+}
+
 func (cm *caprp) setCtx(spagID string, c *ctx) error {
 	fmt.Printf("caeprecv spagid:%s context:%v  \n", spagID, c)
 	return cm.db.Set(spagID, c)
@@ -97,15 +140,15 @@ type AuthNForCAEPRecvConf struct {
 }
 
 func (c *AuthNForCAEPRecvConf) new(sm smForCtxManager) *authNForCAEPRecv {
-	return &authNForCAEPRecv{c.CAPName, sm, c.OIDCRP}
+	return &authNForCAEPRecv{c.CAPName, sm, c.OIDCRP.New()}
 }
 
 // authNForCAEPRecv は 受け取りたいコンテキストのサブジェクトの認証を担う
 // またセッションを管理する
 type authNForCAEPRecv struct {
-	capName    string
-	sm         smForCtxManager
-	oidcrpConf *ztfopenid.Conf
+	capName string
+	sm      smForCtxManager
+	oidcrp  ztfopenid.RP
 }
 
 // GetSub は session に紐づくサブジェクトがいればそれを返す。
@@ -121,61 +164,118 @@ func (a *authNForCAEPRecv) GetSub(session string) (*subForCtx, error) {
 }
 
 func (a *authNForCAEPRecv) Agent() *authnagent {
-	oidcrp := a.oidcrpConf.New()
 	return &authnagent{
-		oidcrp,
+		a.oidcrp,
 		a.setSub,
 	}
 }
 
 // setSub はOIDC 認証フローで獲得できた IDToken をセッションに保存する
 func (a *authNForCAEPRecv) setSub(session string, token openid.Token) error {
-	sub := &subForCtx{token.Subject()}
+	sub := &subForCtx{token.Issuer(), token.Subject()}
 	if err := a.sm.Set(session, sub); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (sub *subForCtx) toCAEP() string {
-	return sub.SpagID
+// toCAEP は subForCtx を CAP とやりとりする subject (iss_sub 形式) に変換する
+func (sub *subForCtx) toCAEP() *caep.Subject {
+	return caep.NewIssSub(sub.Iss, sub.SpagID)
+}
+
+// spagIDFrom は CAP から届いた subject からコンテキストの持ち主の識別子を取り出す
+func spagIDFrom(sub *caep.Subject) (string, error) {
+	p := sub.Principal()
+	if p == nil {
+		return "", fmt.Errorf("subject にユーザが含まれていない")
+	}
+	if id, ok := p.Find(caep.SubjectFormatIssSub); ok {
+		return id.Sub, nil
+	}
+	return "", fmt.Errorf("subject(%s) からユーザを識別できない", sub.Key())
 }
 
 // CAEPRecvConf は CAEP の Receiver となるための設定情報
 type CAEPRecvConf struct {
 	CAEPRecv *caep.RecvConf
 	// Oauth2Conf は stream config/status endpoit の保護に使う
-	Oauth2Conf *clientcredentials.Config
+	Oauth2Conf *ClientCredConf
 	// UMAConf は sub add endpoint の保護に使う
 	UMAConf *UMAClientConf
 }
 
-func (c *CAEPRecvConf) new(db umaClientDB, setCtx func(spagID string, c *ctx) error) (*caeprecv, error) {
+func (c *CAEPRecvConf) new(db umaClientDB, jtiDB caep.JTIStore, setCtx func(spagID string, c *ctx) error, onAccount func(caep.Event) error, register func(caep.Recv)) (*caeprecv, error) {
 	umaCli, err := c.UMAConf.new(db)
 	if err != nil {
 		return nil, err
 	}
-	t, err := c.Oauth2Conf.Token(context.Background())
+	ts, err := c.Oauth2Conf.tokenSource()
 	if err != nil {
 		return nil, err
 	}
-	a := &setAuthHeaders{umaCli, t}
-	recv := c.CAEPRecv.New(a)
-	return &caeprecv{recv, setCtx, umaCli}, nil
+	// 起動時にクライアントの設定が正しいか確かめておく
+	// 認可サーバが落ちていても起動はして、必要になった時に取り直す
+	if _, err := ts.Token(); err != nil {
+		fmt.Printf("stream 管理のためのアクセストークンを起動時に取得できなかった %v\n", err)
+	}
+	a := &setAuthHeaders{umaCli, ts}
+	recv := c.CAEPRecv.New(a, jtiDB)
+	cr := &caeprecv{recv: recv, setCtx: setCtx, onAccount: onAccount, uma: umaCli, subs: make(map[string]addedSub)}
+	cr.registerHandlers()
+	if register != nil {
+		register(recv)
+	}
+	if c.CAEPRecv.Poll {
+		recv.StartPolling(context.Background())
+	}
+	go cr.watchStream(streamVerifyInterval, streamVerifyTimeout)
+	go cr.watchRPTs(rptWatchInterval)
+	return cr, nil
 }
 
+const (
+	// streamVerifyInterval は CAP との stream の疎通確認を行う間隔
+	streamVerifyInterval = 5 * time.Minute
+	// streamVerifyTimeout は Verification Event が届くまで待つ時間
+	streamVerifyTimeout = 10 * time.Second
+	// rptWatchInterval は追加したサブジェクトの RPT の有効期限を確認する間隔
+	rptWatchInterval = 30 * time.Second
+	// rptRefreshMargin は RPT の有効期限のどれだけ前に更新するか
+	rptRefreshMargin = time.Minute
+)
+
 type setAuthHeaders struct {
 	uma *umaClient
-	t   *oauth2.Token
+	ts  *refreshableTokenSource
 }
 
+// ForConfig は有効なアクセストークンを r に設定する
+// 取得できなければヘッダを付けずに送り、 401 になれば RefreshForConfig で取り直す
 func (s *setAuthHeaders) ForConfig(r *http.Request) {
-	s.t.SetAuthHeader(r)
+	t, err := s.ts.Token()
+	if err != nil {
+		fmt.Printf("stream 管理のためのアクセストークンの取得に失敗 %v\n", err)
+		return
+	}
+	t.SetAuthHeader(r)
 }
 
-func (s *setAuthHeaders) ForSubAdd(spagID string, r *http.Request) {
-	rpt, err := s.uma.RPT(spagID)
+func (s *setAuthHeaders) RefreshForConfig() error {
+	return s.ts.Refresh()
+}
+
+// ForSubAdd は sub の RPT を r に設定する
+// 有効な RPT がなければヘッダを付けずに送り、 CAP から許可チケットをもらう
+func (s *setAuthHeaders) ForSubAdd(sub *caep.Subject, r *http.Request) {
+	spagID, err := spagIDFrom(sub)
 	if err != nil {
+		fmt.Printf("subject(%s) の RPT を特定できないので RPT なしで add subject する %v\n", sub.Key(), err)
+		return
+	}
+	rpt, err := s.uma.RPT(r.Context(), spagID)
+	if err != nil {
+		fmt.Printf("spagID(%s) の有効な RPT がないので RPT なしで add subject する %v\n", spagID, err)
 		return
 	}
 	rpt.SetAuthHeader(r)
@@ -184,12 +284,90 @@ func (s *setAuthHeaders) ForSubAdd(spagID string, r *http.Request) {
 type caeprecv struct {
 	recv   caep.Recv
 	setCtx func(spagID string, c *ctx) error
-	uma    *umaClient
+	// onAccount はアカウント単位のイベントを subject に反映する
+	onAccount func(caep.Event) error
+	uma       *umaClient
+	// liveness は最後に行った stream の疎通確認の結果
+	m        sync.RWMutex
+	liveness error
+	// subs は stream に追加したサブジェクトで、 RPT の更新の対象になる
+	subsM sync.Mutex
+	subs  map[string]addedSub // spagID -> sub
+}
+
+// addedSub は stream に追加したサブジェクトとその時に求めたコンテキスト
+type addedSub struct {
+	sub *subForCtx
+	req []reqCtx
+}
+
+// watchRPTs は interval ごとに追加したサブジェクトの RPT を確認し、有効期限が近ければ更新して add subject し直す
+// CAP は RPT の有効期限が切れるとサブジェクトを disabled にするので、その前に新しい RPT を渡す
+func (cm *caeprecv) watchRPTs(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		cm.subsM.Lock()
+		var subs []addedSub
+		for _, a := range cm.subs {
+			subs = append(subs, a)
+		}
+		cm.subsM.Unlock()
+		for _, a := range subs {
+			rpt, err := cm.uma.db.LoadRPT(a.sub.SpagID)
+			if err != nil || !expiresSoon(rpt) {
+				continue
+			}
+			rctx, cancel := context.WithTimeout(context.Background(), interval)
+			err = cm.AddSub(rctx, a.sub, a.req)
+			cancel()
+			if err != nil {
+				fmt.Printf("spagID(%s) の RPT の更新に失敗 %v\n", a.sub.SpagID, err)
+				if e, ok := err.(acpip.Error); ok && e.Code() == acpip.SubjectForCtxConsentWithdrawn {
+					cm.forgetSub(a.sub.SpagID)
+				}
+			}
+		}
+	}
+}
+
+func (cm *caeprecv) rememberSub(sub *subForCtx, req []reqCtx) {
+	cm.subsM.Lock()
+	defer cm.subsM.Unlock()
+	cm.subs[sub.SpagID] = addedSub{sub, req}
+}
+
+func (cm *caeprecv) forgetSub(spagID string) {
+	cm.subsM.Lock()
+	defer cm.subsM.Unlock()
+	delete(cm.subs, spagID)
+}
+
+// watchStream は interval ごとに stream の疎通確認を行い、その結果を記録する
+func (cm *caeprecv) watchStream(interval, timeout time.Duration) {
+	for {
+		time.Sleep(interval)
+		rctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := cm.recv.VerifyRoundTrip(rctx, timeout)
+		cancel()
+		if err != nil {
+			fmt.Printf("CAP との stream の疎通確認に失敗 %v\n", err)
+		}
+		cm.m.Lock()
+		cm.liveness = err
+		cm.m.Unlock()
+	}
+}
+
+// Liveness は最後に行った stream の疎通確認の結果を返す
+func (cm *caeprecv) Liveness() error {
+	cm.m.RLock()
+	defer cm.m.RUnlock()
+	return cm.liveness
 }
 
 // stream の config が req を満たしているかチェック
 // 満たしているとは req に含まれる ctx.ID が全て config.EventRequested に含まれているか
-func (cm *caeprecv) SetupStream(req []reqCtx) error {
+func (cm *caeprecv) SetupStream(rctx context.Context, req []reqCtx) error {
 	var reqCtxID []string
 	for _, c := range req {
 		reqCtxID = append(reqCtxID, c.ID)
@@ -197,16 +375,16 @@ func (cm *caeprecv) SetupStream(req []reqCtx) error {
 	newConf := &caep.StreamConfig{
 		EventsRequested: reqCtxID,
 	}
-	if err := cm.recv.SetUpStream(newConf); err != nil {
+	if err := cm.recv.SetUpStream(rctx, newConf); err != nil {
 		// 更新に失敗したら、終わり
 		return err
 	}
 	return nil
 }
 
-func (cm *caeprecv) IsEnabledStatusFor(sub *subForCtx) error {
+func (cm *caeprecv) IsEnabledStatusFor(rctx context.Context, sub *subForCtx) error {
 	// subject の stream での status を得る
-	status, err := cm.recv.ReadStreamStatus(sub.toCAEP())
+	status, err := cm.recv.ReadStreamStatus(rctx, "", sub.toCAEP())
 	// status が得られなかった、もしくは status.Status が有効でないとき
 	if err != nil {
 		return err
@@ -217,49 +395,126 @@ func (cm *caeprecv) IsEnabledStatusFor(sub *subForCtx) error {
 	return nil
 }
 
-func (cm *caeprecv) AddSub(sub *subForCtx, req []reqCtx) error {
+func (cm *caeprecv) AddSub(rctx context.Context, sub *subForCtx, req []reqCtx) error {
 	reqscopes := make(map[string][]string)
 	for _, r := range req {
 		reqscopes[r.ID] = r.Scopes
 	}
 	reqadd := &caep.ReqAddSub{
-		Sub: struct {
-			SubType string "json:\"subject_type\""
-			SpagID  string "json:\"spag_id\""
-		}{"spag", sub.toCAEP()},
+		Sub:            *sub.toCAEP(),
 		ReqEventScopes: reqscopes,
 	}
-	err := cm.recv.AddSubject(reqadd)
-	if err == nil {
-		return nil
-	}
-	e, ok := err.(caep.RecvError)
-	if !ok {
-		return err
+	err := cm.recv.AddSubject(rctx, reqadd)
+	if e, ok := err.(caep.RecvError); ok && e.Code() == caep.RecvErrorCodeForbidden {
+		// 提示した RPT では認可されなかった (期限切れや認可の取り消し) ので捨てて、許可チケットをもらい直す
+		if err := cm.uma.Forget(sub.SpagID); err != nil {
+			return err
+		}
+		err = cm.recv.AddSubject(rctx, reqadd)
 	}
-	if e.Code() == caep.RecvErrorCodeUnAuthorized {
+	if e, ok := err.(caep.RecvError); ok && e.Code() == caep.RecvErrorCodeUnAuthorized {
 		resp := e.Option().(*http.Response)
-		if err := cm.uma.ExtractPermissionTicket(sub.toCAEP(), resp); err != nil {
+		if err := cm.uma.ExtractPermissionTicket(sub.SpagID, resp); err != nil {
 			return err
 		}
-		if err := cm.uma.ReqRPT(sub); err != nil {
+		if err := cm.uma.ReqRPT(rctx, sub); err != nil {
+			// err は pip.Error(ReqSubmitted, ConsentWithdrawn) を満たす場合あり
 			return err
 		}
-		return cm.recv.AddSubject(reqadd)
+		err = cm.recv.AddSubject(rctx, reqadd)
 	}
-	if e.Code() == caep.RecvErrorCodeNotFound {
-		// todo どうしようもないえらー
-		return e
+	if err != nil {
+		// RecvErrorCodeNotFound などはどうしようもないえらー
+		return err
 	}
-	return e
+	cm.rememberSub(sub, req)
+	return nil
 }
 
-func (cm *caeprecv) Recv(r *http.Request) error {
-	event, err := cm.recv.Recv(r)
+// Recv は Push で届いた SET を処理し、イベントの対象になったサブジェクトを返す
+func (cm *caeprecv) Recv(r *http.Request) (*affectedSubs, error) {
+	aff := &affectedSubs{spagIDs: make(map[string]bool)}
+	err := cm.recv.Recv(r.WithContext(context.WithValue(r.Context(), affectedKey{}, aff)))
+	if err != nil {
+		if e, ok := err.(caep.RecvError); ok && e.Code() == caep.RecvErrorCodeInvalidSET {
+			return nil, newEO(err, acpip.CtxInvalid, e.Option().(*caep.SetErr).Err)
+		}
+		return nil, err
+	}
+	return aff, nil
+}
+
+// affectedKey は Recv に渡す context.Context に affectedSubs を入れるキー
+type affectedKey struct{}
+
+// affectedSubs は一つの SET のイベントの対象になったサブジェクトを集める
+type affectedSubs struct {
+	m       sync.Mutex
+	spagIDs map[string]bool
+	// all は全てのサブジェクトが対象になったことを表す
+	all bool
+}
+
+// recordAffected は処理できたイベントの対象のサブジェクトを affectedSubs に記録する EventMiddleware
+// Poll で受け取った時は affectedSubs がないので何もしない
+func recordAffected(next caep.EventHandler) caep.EventHandler {
+	return caep.EventHandlerFunc(func(rctx context.Context, e caep.Event) error {
+		if err := next.HandleEvent(rctx, e); err != nil {
+			return err
+		}
+		aff, ok := rctx.Value(affectedKey{}).(*affectedSubs)
+		if !ok {
+			return nil
+		}
+		aff.m.Lock()
+		defer aff.m.Unlock()
+		switch e := e.(type) {
+		case *caep.SSEEventClaim:
+			if spagID, err := spagIDFrom(&e.Subject); err == nil {
+				aff.spagIDs[spagID] = true
+			}
+		case *caep.StreamUpdatedEvent:
+			// 認可が取り消されたサブジェクトは認可判断をやり直す
+			if e.Subject != nil && e.Status == caep.StatusDisabled {
+				if spagID, err := spagIDFrom(e.Subject); err == nil {
+					aff.spagIDs[spagID] = true
+				}
+			}
+		case *caep.AccountDisabledEvent, *caep.AccountPurgedEvent, *caep.CredentialCompromiseEvent, *caep.IdentifierChangedEvent:
+			// アカウント単位のイベントは CAP のサブジェクトとの対応が分からないので、全ての session の認可判断をやり直す
+			aff.all = true
+		}
+		return nil
+	})
+}
+
+// registerHandlers は PIP が受け取ったイベントに反応する handler を登録する
+// Push でも Poll でも一つの SET で受け取ったイベントを順に処理する
+func (cm *caeprecv) registerHandlers() {
+	cm.recv.Use(caep.LogEvents, recordAffected)
+	cm.recv.Handle(caep.ContextEventType, caep.EventHandlerFunc(cm.onContext))
+	// 疎通確認のためのイベントはコンテキストではない
+	cm.recv.Handle(caep.VerificationEventType, caep.EventHandlerFunc(func(context.Context, caep.Event) error { return nil }))
+	cm.recv.Handle(caep.StreamUpdatedEventType, caep.EventHandlerFunc(cm.onStreamUpdated))
+	for _, typ := range []string{
+		caep.AccountDisabledEventType,
+		caep.AccountPurgedEventType,
+		caep.CredentialCompromiseEventType,
+		caep.IdentifierChangedEventType,
+	} {
+		cm.recv.Handle(typ, caep.EventHandlerFunc(func(_ context.Context, e caep.Event) error {
+			return cm.onAccount(e)
+		}))
+	}
+}
+
+// onContext はコンテキストの変更を保存する
+func (cm *caeprecv) onContext(_ context.Context, e caep.Event) error {
+	event := e.(*caep.SSEEventClaim)
+	spagID, err := spagIDFrom(&event.Subject)
 	if err != nil {
 		return err
 	}
-	spagID := event.Subject.SpagID
 	c := &ctx{
 		ID:          event.ID,
 		ScopeValues: event.Property,
@@ -267,6 +522,28 @@ func (cm *caeprecv) Recv(r *http.Request) error {
 	return cm.setCtx(spagID, c)
 }
 
+// onStreamUpdated はサブジェクトが disabled になった時に RPT を捨てる
+func (cm *caeprecv) onStreamUpdated(_ context.Context, e caep.Event) error {
+	event, ok := e.(*caep.StreamUpdatedEvent)
+	if !ok {
+		return fmt.Errorf("event(%s) は Stream Updated Event ではない", e.Type())
+	}
+	// status は必要な時に Transmitter に問い合わせるので、ここでは記録だけする
+	subKey := "stream"
+	if event.Subject != nil {
+		subKey = event.Subject.Key()
+	}
+	fmt.Printf("subject(%s) の status が %s になった reason: %s\n", subKey, event.Status, event.Reason)
+	if event.Subject != nil && event.Status == caep.StatusDisabled {
+		// RPT が失効したか認可が取り消されたので、次の add subject では許可チケットからやり直す
+		if spagID, err := spagIDFrom(event.Subject); err == nil {
+			cm.forgetSub(spagID)
+			return cm.uma.Forget(spagID)
+		}
+	}
+	return nil
+}
+
 // UMAClientConf は CAP で UMAClint となるための設定情報
 type UMAClientConf struct {
 	// Requesting Party のクレデンシャル情報
@@ -281,6 +558,8 @@ type UMAClientConf struct {
 		ID       string
 		Secret   string
 	}
+	// HTTPClient は認可サーバと Requesting Party の IdP へのアクセスに使う。 nil の時は http.DefaultClient
+	HTTPClient *http.Client
 }
 
 func (conf *UMAClientConf) new(db umaClientDB) (*umaClient, error) {
@@ -290,12 +569,29 @@ func (conf *UMAClientConf) new(db umaClientDB) (*umaClient, error) {
 			ID     string
 			Secret string
 		}{conf.ClientCredential.ID, conf.ClientCredential.Secret},
+		HTTPClient: conf.HTTPClient,
 	}
 	cli := umaconf.New()
+	// Requesting Party の ID Token は最初に RPT を要求する時に取得する
+	return &umaClient{conf: conf, cli: cli, db: db}, nil
+}
 
-	op, err := ztfopenid.NewOPFetched(conf.ReqPartyCredential.Issuer)
+// idToken は Requesting Party の ID Token を返す
+// まだ取得していないか有効期限が近ければ Requesting Party の IdP から取得し直す
+func (u *umaClient) idToken(rctx context.Context) (string, error) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.rawidt != "" && (u.idtExp.IsZero() || time.Until(u.idtExp) > rptRefreshMargin) {
+		return u.rawidt, nil
+	}
+	conf := u.conf
+	client := conf.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	op, err := ztfopenid.NewOPFetched(rctx, client, conf.ReqPartyCredential.Issuer)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	rpConf := oauth2.Config{
 		ClientID:     conf.ClientCredential.ID,
@@ -308,36 +604,44 @@ func (conf *UMAClientConf) new(db umaClientDB) (*umaClient, error) {
 	}
 	rqpName := conf.ReqPartyCredential.Name
 	rqpPass := conf.ReqPartyCredential.Pass
-	tok, err := rpConf.PasswordCredentialsToken(context.Background(), rqpName, rqpPass)
+	tok, err := rpConf.PasswordCredentialsToken(context.WithValue(rctx, oauth2.HTTPClient, client), rqpName, rqpPass)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	rawIDToken, ok := tok.Extra("id_token").(string)
 	if !ok {
-		return nil, fmt.Errorf("Requesting Party のIDTokenの抽出に失敗 アクセストークン: %v", tok)
+		return "", fmt.Errorf("Requesting Party のIDTokenの抽出に失敗 アクセストークン: %v", tok)
 	}
-	jwkset, err := jwk.FetchHTTP(op.JwksURI)
+	jwkset, err := jwk.FetchHTTPWithContext(rctx, op.JwksURI, jwk.WithHTTPClient(client))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	if _, err = jwt.ParseString(rawIDToken, jwt.WithKeySet(jwkset), jwt.WithOpenIDClaims()); err != nil {
-		return nil, err
+	idt, err := jwt.ParseString(rawIDToken, jwt.WithKeySet(jwkset), jwt.WithOpenIDClaims())
+	if err != nil {
+		return "", err
 	}
-	return &umaClient{rawIDToken, cli, db}, nil
+	u.rawidt = rawIDToken
+	u.idtExp = idt.Expiration()
+	return rawIDToken, nil
 }
 
 type umaClientDB interface {
 	SetPermissionTicket(spagID string, ticket *uma.PermissionTicket) error
 	LoadPermissionTicket(sub *subForCtx) (*uma.PermissionTicket, error)
-	SetRPT(sub *subForCtx, tok *uma.RPT) error
+	SetRPT(spagID string, tok *uma.RPT) error
 	LoadRPT(spagID string) (*uma.RPT, error)
+	DeleteRPT(spagID string) error
 }
 
 // umaClient は caep.Receiver が add subject するときの RPT を管理する
 type umaClient struct {
+	conf *UMAClientConf
+	cli  uma.Client
+	db   umaClientDB
+	// rawidt は Requesting Party の ID Token で、 idtExp まで使い回す
+	m      sync.Mutex
 	rawidt string
-	cli    uma.Client
-	db     umaClientDB
+	idtExp time.Time
 }
 
 // ExtractPermissionTicket は uma Resource server からのレスポンスから PermissionTicket を抽出しサブジェクトと紐付ける
@@ -349,23 +653,58 @@ func (u *umaClient) ExtractPermissionTicket(spagID string, resp *http.Response)
 	return u.db.SetPermissionTicket(spagID, pt)
 }
 
-// RPT はサブジェクトと紐づいた Requesting Party Token を取得する
-func (u *umaClient) RPT(spagID string) (*uma.RPT, error) {
-	return u.db.LoadRPT(spagID)
+// RPT はサブジェクトと紐づいた有効な Requesting Party Token を取得する
+// 有効期限が近ければ refresh_token で更新し、更新できなければ捨ててエラーを返す
+func (u *umaClient) RPT(rctx context.Context, spagID string) (*uma.RPT, error) {
+	rpt, err := u.db.LoadRPT(spagID)
+	if err != nil {
+		return nil, err
+	}
+	if !expiresSoon(rpt) {
+		return rpt, nil
+	}
+	newRPT, err := u.cli.RefreshRPT(rctx, rpt)
+	if err != nil {
+		if err := u.db.DeleteRPT(spagID); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("spagID(%s) の RPT の更新に失敗 %v", spagID, err)
+	}
+	if err := u.db.SetRPT(spagID, newRPT); err != nil {
+		return nil, err
+	}
+	return newRPT, nil
+}
+
+// Forget はサブジェクトと紐づいた RPT を捨てる
+func (u *umaClient) Forget(spagID string) error {
+	return u.db.DeleteRPT(spagID)
+}
+
+// expiresSoon は rpt の有効期限が rptRefreshMargin 以内か判定する
+func expiresSoon(rpt *uma.RPT) bool {
+	return !rpt.Expiry.IsZero() && time.Until(rpt.Expiry) < rptRefreshMargin
 }
 
 // ReqRPT はサブジェクトと紐づいた PermissionTicket を使って UMA 認可プロセスを開始する
-func (u *umaClient) ReqRPT(sub *subForCtx) error {
+func (u *umaClient) ReqRPT(rctx context.Context, sub *subForCtx) error {
 	ticket, err := u.db.LoadPermissionTicket(sub)
 	if err != nil {
 		return err
 	}
-	tok, err := u.cli.ReqRPT(ticket, u.rawidt)
+	rawidt, err := u.idToken(rctx)
+	if err != nil {
+		return err
+	}
+	tok, err := u.cli.ReqRPT(rctx, ticket, rawidt)
 	if err != nil {
 		if err, ok := err.(*uma.ReqRPTError); ok {
+			if err.Err == uma.ReqRPTErrorRequestDenied {
+				return newE(err, acpip.SubjectForCtxConsentWithdrawn)
+			}
 			return newE(err, acpip.SubjectForCtxUnAuthorizeButReqSubmitted)
 		}
 		return err
 	}
-	return u.db.SetRPT(sub, tok)
+	return u.db.SetRPT(sub.SpagID, tok)
 }
@@ -1,10 +1,12 @@
 package pip
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/hatake5051/ztf-prototype/ac"
 	acpip "github.com/hatake5051/ztf-prototype/ac/pip"
+	"github.com/hatake5051/ztf-prototype/caep"
 )
 
 // ctx は ac.Context implementation
@@ -33,6 +35,8 @@ func fromACReqCtx(req ac.ReqContext) reqCtx {
 
 // subForCtx はある ctx の subject を表す
 type subForCtx struct {
+	// Iss は subject を認証した認可サーバ
+	Iss    string
 	SpagID string
 }
 
@@ -42,12 +46,26 @@ type CtxPIPConf struct {
 	CtxID2CAP map[string]string
 	// Cap2RPConf は CAP 名 -> その CAP に対する RP 設定情報
 	CAP2RP map[string]*CAPRPConf
+	// EventHandlers はイベントの種類 -> RP アプリケーションが CAP から受け取ったイベントに反応する handler
+	// 種類には caep.Recv.Handle と同じものを指定でき、 PIP がコンテキストの保存などを終えた後に呼ばれる
+	EventHandlers map[string]caep.EventHandler
+	// EventMiddlewares は全ての CAP から受け取ったイベントの handler を包む
+	EventMiddlewares []caep.EventMiddleware
+}
+
+// register は RP アプリケーションの handler と middleware を recv に登録する
+func (conf *CtxPIPConf) register(recv caep.Recv) {
+	recv.Use(conf.EventMiddlewares...)
+	for typ, h := range conf.EventHandlers {
+		recv.Handle(typ, h)
+	}
 }
 
-func (conf *CtxPIPConf) new(sm map[string]smForCtxManager, db map[string]ctxDB, umaClientDB map[string]umaClientDB) (*ctxPIP, error) {
+// onAccount は CAP から届いたアカウント単位のイベントを subPIP に伝える
+func (conf *CtxPIPConf) new(sm map[string]smForCtxManager, db map[string]ctxDB, umaClientDB map[string]umaClientDB, jtiDB map[string]caep.JTIStore, onAccount func(caep.Event) error) (*ctxPIP, error) {
 	ctxManagers := make(map[string]ctxManager)
-	for collector, conf := range conf.CAP2RP {
-		cm, err := conf.new(sm[collector], db[collector], umaClientDB[collector])
+	for collector, cpConf := range conf.CAP2RP {
+		cm, err := cpConf.new(sm[collector], db[collector], umaClientDB[collector], jtiDB[collector], onAccount, conf.register)
 		if err != nil {
 			return nil, err
 		}
@@ -63,13 +81,14 @@ type ctxPIP struct {
 	managers map[string]ctxManager
 }
 
-func (pip *ctxPIP) GetAll(session string, req []reqCtx) ([]ctx, error) {
+// GetAll は CAP ごとにコンテキストを集める。 CAP へのアクセスは rctx が終わると打ち切る
+func (pip *ctxPIP) GetAll(rctx context.Context, session string, req []reqCtx) ([]ctx, error) {
 	reqs := pip.categorize(req)
 	var ret []ctx
 	// TODO: concurrency
 	for cap, reqctxs := range reqs {
 		ctxManager := pip.manager(cap)
-		ctx, err := ctxManager.Get(session, reqctxs)
+		ctx, err := ctxManager.Get(rctx, session, reqctxs)
 		if err != nil {
 			return nil, err
 		}
@@ -78,6 +97,16 @@ func (pip *ctxPIP) GetAll(session string, req []reqCtx) ([]ctx, error) {
 	return ret, nil
 }
 
+// Forget は全ての CAP について session とサブジェクトの紐付けを破棄する
+func (pip *ctxPIP) Forget(session string) error {
+	for _, m := range pip.managers {
+		if err := m.Forget(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (pip *ctxPIP) Agent(collector string) (acpip.CtxAgent, error) {
 	cm := pip.manager(collector)
 	return cm.Agent()
@@ -100,24 +129,29 @@ func (pip *ctxPIP) manager(cap string) ctxManager {
 
 type ctxagent struct {
 	*authnagent
-	setCtx func(*http.Request) error
+	setCtx func(*http.Request) (func(session string) bool, error)
 }
 
-func (a *ctxagent) RecvCtx(r *http.Request) error {
+func (a *ctxagent) RecvCtx(r *http.Request) (func(session string) bool, error) {
 	return a.setCtx(r)
 }
 
 // ctxManager はコンテキストを管理する
 // コンテキストはある collector が集めているものをまとめて管理している
 type ctxManager interface {
-	Get(session string, req []reqCtx) ([]ctx, error)
+	// Get は session のユーザのコンテキストを CAP から集めたものを返す
+	// ctx という名前はコンテキストの型と紛らわしいので、 context.Context は rctx と呼ぶ
+	Get(rctx context.Context, session string, req []reqCtx) ([]ctx, error)
 	Agent() (acpip.CtxAgent, error)
+	// Forget は session とサブジェクトの紐付けを破棄する
+	Forget(session string) error
 }
 
 // smForCtxmanager は session と subject の紐付けを管理する
 type smForCtxManager interface {
 	Load(session string) (*subForCtx, error)
 	Set(session string, sub *subForCtx) error
+	Delete(session string) error
 }
 
 // ctxDB はコンテキストを保存する
@@ -1,8 +1,11 @@
 package pip
 
 import (
+	"context"
+
 	"github.com/hatake5051/ztf-prototype/ac"
 	acpip "github.com/hatake5051/ztf-prototype/ac/pip"
+	"github.com/hatake5051/ztf-prototype/caep"
 )
 
 // Conf は PIP を構成するのに必要な設定情報
@@ -20,12 +23,14 @@ func (conf *Conf) New(repo Repository) (acpip.PIP, error) {
 	sm := make(map[string]smForCtxManager)
 	db := make(map[string]ctxDB)
 	umaClientDB := make(map[string]umaClientDB)
+	jtiDB := make(map[string]caep.JTIStore)
 	for collector := range conf.CtxPIPConf.CAP2RP {
 		sm[collector] = &smForCtxManagerimple{repo, "ctxpip-sm:" + collector}
 		db[collector] = &ctxDBimple{repo, "ctxpip-db:" + collector}
 		umaClientDB[collector] = &umaClientDBimpl{repo, "ctxpip-umadb:" + collector}
+		jtiDB[collector] = &jtiDBimpl{r: repo, keyModifier: "ctxpip-jtidb:" + collector}
 	}
-	c, err := conf.CtxPIPConf.new(sm, db, umaClientDB)
+	c, err := conf.CtxPIPConf.new(sm, db, umaClientDB, jtiDB, s.handleAccountEvent)
 	if err != nil {
 		return nil, err
 	}
@@ -51,12 +56,12 @@ func (pip *pip) SubjectAuthNAgent(issuer string) (acpip.AuthNAgent, error) {
 	}
 	return a, nil
 }
-func (pip *pip) GetContexts(session string, reqctxs []ac.ReqContext) ([]ac.Context, error) {
+func (pip *pip) GetContexts(rctx context.Context, session string, reqctxs []ac.ReqContext) ([]ac.Context, error) {
 	var reqs []reqCtx
 	for _, c := range reqctxs {
 		reqs = append(reqs, fromACReqCtx(c))
 	}
-	ctxs, err := pip.ctx.GetAll(session, reqs)
+	ctxs, err := pip.ctx.GetAll(rctx, session, reqs)
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +79,12 @@ func (pip *pip) ContextAgent(collector string) (acpip.CtxAgent, error) {
 	}
 	return a, nil
 }
+func (pip *pip) ForgetSession(session string) error {
+	if err := pip.sub.Forget(session); err != nil {
+		return err
+	}
+	return pip.ctx.Forget(session)
+}
 
 // e implements pip.Error
 type e struct {
@@ -5,7 +5,9 @@ import (
 	"encoding/gob"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/hatake5051/ztf-prototype/caep"
 	"github.com/hatake5051/ztf-prototype/uma"
 	"github.com/lestrrat-go/jwx/jwt/openid"
 )
@@ -15,6 +17,7 @@ type Repository interface {
 	KeyPrefix() string
 	Save(key string, b []byte) error
 	Load(key string) (b []byte, err error)
+	Delete(key string) error
 }
 
 func NewRepo() Repository {
@@ -47,6 +50,13 @@ func (r *repo) Load(key string) (b []byte, err error) {
 	return b, nil
 }
 
+func (r *repo) Delete(key string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	delete(r.r, key)
+	return nil
+}
+
 type smForSubPIPimpl struct {
 	r           Repository
 	keyModifier string
@@ -58,27 +68,31 @@ func (sm *smForSubPIPimpl) key(session string) string {
 	return sm.r.KeyPrefix() + ":" + sm.keyModifier + ":" + session
 }
 
-func (sm *smForSubPIPimpl) Load(session string) (*subIdentifier, error) {
+func (sm *smForSubPIPimpl) Load(session string) (*subSession, error) {
 	b, err := sm.r.Load(sm.key(session))
 	if err != nil {
 		return nil, err
 	}
-	var subID subIdentifier
+	var ss subSession
 	buf := bytes.NewBuffer(b)
-	if err := gob.NewDecoder(buf).Decode(&subID); err != nil {
+	if err := gob.NewDecoder(buf).Decode(&ss); err != nil {
 		return nil, err
 	}
-	return &subID, nil
+	return &ss, nil
 }
 
-func (sm *smForSubPIPimpl) Set(session string, subID *subIdentifier) error {
+func (sm *smForSubPIPimpl) Set(session string, ss *subSession) error {
 	buf := bytes.NewBuffer(nil)
-	if err := gob.NewEncoder(buf).Encode(subID); err != nil {
+	if err := gob.NewEncoder(buf).Encode(ss); err != nil {
 		return nil
 	}
 	return sm.r.Save(sm.key(session), buf.Bytes())
 }
 
+func (sm *smForSubPIPimpl) Delete(session string) error {
+	return sm.r.Delete(sm.key(session))
+}
+
 type subDBimple struct {
 	r           Repository
 	keyModifier string
@@ -105,12 +119,19 @@ func (db *subDBimple) Load(key *subIdentifier) (*subject, error) {
 
 func (db *subDBimple) Set(idt openid.Token) error {
 	subID := newSubID(idt)
-	sub := &subject{subID}
+	sub, err := db.Load(subID)
+	if err != nil {
+		sub = &subject{ID: subID}
+	}
+	return db.Update(sub)
+}
+
+func (db *subDBimple) Update(sub *subject) error {
 	buf := bytes.NewBuffer(nil)
 	if err := gob.NewEncoder(buf).Encode(sub); err != nil {
-		return nil
+		return err
 	}
-	return db.r.Save(db.key(subID), buf.Bytes())
+	return db.r.Save(db.key(sub.ID), buf.Bytes())
 }
 
 type smForCtxManagerimple struct {
@@ -145,6 +166,10 @@ func (sm *smForCtxManagerimple) Set(session string, sub *subForCtx) error {
 	return sm.r.Save(sm.key(session), buf.Bytes())
 }
 
+func (sm *smForCtxManagerimple) Delete(session string) error {
+	return sm.r.Delete(sm.key(session))
+}
+
 type ctxDBimple struct {
 	r           Repository
 	keyModifier string
@@ -236,22 +261,68 @@ func (db *umaClientDBimpl) LoadPermissionTicket(sub *subForCtx) (*uma.Permission
 	return &pt, err
 
 }
-func (db *umaClientDBimpl) SetRPT(sub *subForCtx, tok *uma.RPT) error {
+func (db *umaClientDBimpl) SetRPT(spagID string, tok *uma.RPT) error {
 	buf := bytes.NewBuffer(nil)
 	if err := gob.NewEncoder(buf).Encode(tok); err != nil {
 		return nil
 	}
-	return db.r.Save(db.keyRPT(sub.SpagID), buf.Bytes())
+	return db.r.Save(db.keyRPT(spagID), buf.Bytes())
+}
+
+// DeleteRPT は Repository に削除がないので空にして上書きする
+func (db *umaClientDBimpl) DeleteRPT(spagID string) error {
+	return db.r.Save(db.keyRPT(spagID), nil)
 }
+
 func (db *umaClientDBimpl) LoadRPT(spagID string) (*uma.RPT, error) {
 	var rpt uma.RPT
 	b, err := db.r.Load(db.keyRPT(spagID))
 	if err != nil {
 		return nil, err
 	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("spagID(%s) の RPT はない", spagID)
+	}
 	buf := bytes.NewBuffer(b)
 	if err := gob.NewDecoder(buf).Decode(&rpt); err != nil {
 		return nil, err
 	}
 	return &rpt, nil
 }
+
+type jtiDBimpl struct {
+	m           sync.Mutex
+	r           Repository
+	keyModifier string
+}
+
+var _ caep.JTIStore = &jtiDBimpl{}
+
+func (db *jtiDBimpl) key(jti string) string {
+	return db.r.KeyPrefix() + ":" + db.keyModifier + ":" + jti
+}
+
+func (db *jtiDBimpl) Reserve(jti string, exp time.Time) (bool, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if b, err := db.r.Load(db.key(jti)); err == nil {
+		var prevExp time.Time
+		if err := prevExp.UnmarshalBinary(b); err == nil && time.Now().Before(prevExp) {
+			return false, nil
+		}
+	}
+	b, err := exp.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+	if err := db.r.Save(db.key(jti), b); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (db *jtiDBimpl) Release(jti string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	return db.r.Delete(db.key(jti))
+}
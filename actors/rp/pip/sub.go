@@ -3,9 +3,11 @@ package pip
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/hatake5051/ztf-prototype/ac"
 	acpip "github.com/hatake5051/ztf-prototype/ac/pip"
+	"github.com/hatake5051/ztf-prototype/caep"
 	ztfopenid "github.com/hatake5051/ztf-prototype/openid"
 	"github.com/lestrrat-go/jwx/jwt/openid"
 )
@@ -13,6 +15,10 @@ import (
 // subject は ac.Subject の実体
 type subject struct {
 	ID *subIdentifier
+	// Disabled はアカウントが無効化・削除されたことを表す。再び認証しても使えない
+	Disabled bool
+	// SessionsNotBefore より前に認証したセッションは使えない
+	SessionsNotBefore time.Time
 }
 
 func (sub *subject) ToACSub() ac.Subject {
@@ -25,6 +31,12 @@ type subIdentifier struct {
 	Sub string
 }
 
+// subSession は session に紐づく subject とその認証時刻
+type subSession struct {
+	ID      *subIdentifier
+	AuthnAt time.Time
+}
+
 // newSubID は oidc.IDToken を subIdnetifier に変換する
 func newSubID(idt openid.Token) *subIdentifier {
 	return &subIdentifier{idt.Issuer(), idt.Subject()}
@@ -57,30 +69,42 @@ type subPIP struct {
 
 // smForSubPIP は session と subIdentifier の紐付けを管理する
 type smForSubPIP interface {
-	Load(session string) (*subIdentifier, error)
-	Set(session string, subID *subIdentifier) error
+	Load(session string) (*subSession, error)
+	Set(session string, ss *subSession) error
+	Delete(session string) error
 }
 
 // subDB は 異なる OIDCRP 情報を保存し、 subject を保存する
 type subDB interface {
 	Load(key *subIdentifier) (*subject, error)
+	// Set は IDToken から subject を保存する。既にあれば無効化などの状態は引き継ぐ
 	Set(openid.Token) error
+	// Update は subject の状態を更新する
+	Update(*subject) error
 }
 
 // get は PIP から subject を取得する
 func (pip *subPIP) Get(session string) (*subject, error) {
 	// session に対応する Subject.identifier があるか確認
-	subID, err := pip.sm.Load(session)
+	ss, err := pip.sm.Load(session)
 	if err != nil {
 		// なければ subject が誰か識別できておらず、セッションをはれていない
 		return nil, newE(err, acpip.SubjectUnAuthenticated)
 	}
 	// subject.identifier をもとに subject の値をDBから取得
-	sub, err := pip.db.Load(subID)
+	sub, err := pip.db.Load(ss.ID)
 	if err != nil {
 		// 見つからなければ、認証からやり直す
 		return nil, newE(err, acpip.SubjectUnAuthenticated)
 	}
+	if sub.Disabled {
+		// 認証し直しても無効なままなので、認証へ誘導せずに拒否する
+		return nil, newE(fmt.Errorf("subject(%v) は無効化されている", sub.ID), acpip.SubjectDisabled)
+	}
+	if ss.AuthnAt.Before(sub.SessionsNotBefore) {
+		// セッションが取り消されているので、認証からやり直す
+		return nil, newE(fmt.Errorf("subject(%v) のセッションは取り消されている", sub.ID), acpip.SubjectUnAuthenticated)
+	}
 	return sub, nil
 }
 
@@ -96,7 +120,7 @@ func (pip *subPIP) Agent(issuer string) (acpip.AuthNAgent, error) {
 // set は AuthNAgent が取得した oidc.IDToken を PIP に保存する
 func (pip *subPIP) set(session string, sub openid.Token) error {
 	subID := newSubID(sub)
-	if err := pip.sm.Set(session, subID); err != nil {
+	if err := pip.sm.Set(session, &subSession{subID, time.Now()}); err != nil {
 		return err
 	}
 	if err := pip.db.Set(sub); err != nil {
@@ -105,6 +129,63 @@ func (pip *subPIP) set(session string, sub openid.Token) error {
 	return nil
 }
 
+// Forget は session と subject の紐付けを破棄する
+func (pip *subPIP) Forget(session string) error {
+	return pip.sm.Delete(session)
+}
+
+// handleAccountEvent は IdP や CAP から届いたアカウント単位のイベント (RISC) を subject に反映する
+// この RP が知らない subject のイベントは無視する
+func (pip *subPIP) handleAccountEvent(e caep.Event) error {
+	var es caep.Subject
+	switch e := e.(type) {
+	case *caep.AccountDisabledEvent:
+		es = e.Subject
+	case *caep.AccountPurgedEvent:
+		es = e.Subject
+	case *caep.CredentialCompromiseEvent:
+		es = e.Subject
+	case *caep.IdentifierChangedEvent:
+		es = e.Subject
+	default:
+		return fmt.Errorf("event(%s) はアカウント単位のイベントではない", e.Type())
+	}
+	id, err := subIdentifierFrom(&es)
+	if err != nil {
+		// この RP では識別できない subject なので無視する
+		fmt.Printf("event(%s) の %v\n", e.Type(), err)
+		return nil
+	}
+	sub, err := pip.db.Load(id)
+	if err != nil {
+		// この RP にまだ一度もログインしていない subject なので無視する
+		fmt.Printf("event(%s) の subject(%v) はこの RP では知らないので無視する %v\n", e.Type(), id, err)
+		return nil
+	}
+	switch e.(type) {
+	case *caep.AccountDisabledEvent, *caep.AccountPurgedEvent:
+		// 無効化して、全てのセッションも使えなくする
+		sub.Disabled = true
+		sub.SessionsNotBefore = time.Now()
+	case *caep.CredentialCompromiseEvent, *caep.IdentifierChangedEvent:
+		// 全てのセッションを使えなくして、認証し直してもらう
+		sub.SessionsNotBefore = time.Now()
+	}
+	fmt.Printf("event(%s) により subject(%v) を更新 disabled: %v\n", e.Type(), sub.ID, sub.Disabled)
+	return pip.db.Update(sub)
+}
+
+// subIdentifierFrom はイベントの subject を subIdentifier に変換する
+// iss_sub 形式の識別子を含まない subject は識別できない
+func subIdentifierFrom(s *caep.Subject) (*subIdentifier, error) {
+	if p := s.Principal(); p != nil {
+		if id, ok := p.Find(caep.SubjectFormatIssSub); ok {
+			return &subIdentifier{id.Iss, id.Sub}, nil
+		}
+	}
+	return nil, fmt.Errorf("subject(%s) は識別できない", s.Key())
+}
+
 // wrapS は subject を ac.Subject impl させるためのラッパー
 type wrapS struct {
 	s *subject
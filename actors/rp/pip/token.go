@@ -0,0 +1,180 @@
+package pip
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// token endpoint でのクライアント認証方式 (RFC 8414, RFC 8705)
+const (
+	// ClientAuthSecretBasic は client_secret を Basic 認証で送る
+	ClientAuthSecretBasic = "client_secret_basic"
+	// ClientAuthPrivateKeyJWT は秘密鍵で署名した client assertion を送る (RFC 7523)
+	ClientAuthPrivateKeyJWT = "private_key_jwt"
+	// ClientAuthTLS はクライアント証明書で認証する (RFC 8705)
+	ClientAuthTLS = "tls_client_auth"
+)
+
+// clientAssertionLifetime は client assertion の有効期間
+const clientAssertionLifetime = time.Minute
+
+// ClientCredConf は Client Credentials Grant でアクセストークンを取得するクライアントの設定情報
+type ClientCredConf struct {
+	ClientID     string
+	ClientSecret string
+	TokenURL     string
+	// AuthMethod は token endpoint でのクライアント認証方式。空の時は client_secret_basic
+	AuthMethod string
+	// SigAlg と SigKey は private_key_jwt の時に client assertion に署名する鍵
+	// SigKeyID が空でなければ kid として JWS ヘッダに含める
+	SigAlg   jwa.SignatureAlgorithm
+	SigKey   crypto.Signer
+	SigKeyID string
+	// TLSCert は tls_client_auth の時のクライアント証明書
+	TLSCert *tls.Certificate
+	// HTTPClient は token endpoint へのアクセスに使う。 nil の時は http.DefaultClient
+	// tls_client_auth の時は Timeout だけを引き継ぐ
+	HTTPClient *http.Client
+}
+
+// tokenTimeout は token endpoint の応答を待つ時間
+const tokenTimeout = 30 * time.Second
+
+// tokenSource は有効期限が切れると自動で取り直すアクセストークンの TokenSource を構築する
+func (c *ClientCredConf) tokenSource() (*refreshableTokenSource, error) {
+	switch c.AuthMethod {
+	case "", ClientAuthSecretBasic:
+	case ClientAuthPrivateKeyJWT:
+		if c.SigKey == nil {
+			return nil, fmt.Errorf("private_key_jwt には client assertion の署名鍵が必要")
+		}
+	case ClientAuthTLS:
+		if c.TLSCert == nil {
+			return nil, fmt.Errorf("tls_client_auth にはクライアント証明書が必要")
+		}
+	default:
+		return nil, fmt.Errorf("クライアント認証方式(%s) はサポートしていない", c.AuthMethod)
+	}
+	base := &clientCredTokenSource{c}
+	return &refreshableTokenSource{base: base, ts: oauth2.ReuseTokenSource(nil, base)}, nil
+}
+
+// clientCredTokenSource は token endpoint から毎回新しいアクセストークンを取得する
+type clientCredTokenSource struct {
+	conf *ClientCredConf
+}
+
+func (s *clientCredTokenSource) Token() (*oauth2.Token, error) {
+	c := s.conf
+	conf := &clientcredentials.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		TokenURL:     c.TokenURL,
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tokenTimeout)
+	defer cancel()
+	switch c.AuthMethod {
+	case ClientAuthPrivateKeyJWT:
+		// client assertion は使い回せないので、取得するたびに署名する
+		assertion, err := s.assertion()
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientSecret = ""
+		conf.AuthStyle = oauth2.AuthStyleInParams
+		conf.EndpointParams = url.Values{
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {assertion},
+		}
+	case ClientAuthTLS:
+		conf.ClientSecret = ""
+		conf.AuthStyle = oauth2.AuthStyleInParams
+		client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{*c.TLSCert}},
+			},
+			Timeout: client.Timeout,
+		}
+	}
+	return conf.Token(context.WithValue(ctx, oauth2.HTTPClient, client))
+}
+
+// assertion は token endpoint 宛の client assertion を作る (RFC 7523 Sec.3)
+func (s *clientCredTokenSource) assertion() (string, error) {
+	c := s.conf
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	t := jwt.New()
+	t.Set(jwt.IssuerKey, c.ClientID)
+	t.Set(jwt.SubjectKey, c.ClientID)
+	t.Set(jwt.AudienceKey, c.TokenURL)
+	t.Set(jwt.JwtIDKey, hex.EncodeToString(b))
+	t.Set(jwt.IssuedAtKey, now)
+	t.Set(jwt.ExpirationKey, now.Add(clientAssertionLifetime))
+	alg := c.SigAlg
+	if alg == "" {
+		alg = jwa.RS256
+	}
+	key, err := jwk.New(c.SigKey)
+	if err != nil {
+		return "", err
+	}
+	if c.SigKeyID != "" {
+		if err := key.Set(jwk.KeyIDKey, c.SigKeyID); err != nil {
+			return "", err
+		}
+	}
+	signed, err := jwt.Sign(t, alg, key)
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+// refreshableTokenSource は有効期限が切れるまでアクセストークンを使い回し、
+// 拒否された時は期限前でも取り直せる TokenSource
+type refreshableTokenSource struct {
+	base oauth2.TokenSource
+	m    sync.Mutex
+	ts   oauth2.TokenSource
+}
+
+func (s *refreshableTokenSource) Token() (*oauth2.Token, error) {
+	s.m.Lock()
+	ts := s.ts
+	s.m.Unlock()
+	return ts.Token()
+}
+
+// Refresh は使い回しているアクセストークンを捨てて新しく取得する
+func (s *refreshableTokenSource) Refresh() error {
+	t, err := s.base.Token()
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ts = oauth2.ReuseTokenSource(t, s.base)
+	return nil
+}
@@ -0,0 +1,170 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Conf は actor が使うセッションストアの設定情報を表す
+type Conf struct {
+	// Store はセッションの保存先を表す。 "cookie" (default) か "filesystem" を指定する
+	Store string `json:"store"`
+	// Path は Store が "filesystem" のときのセッション保存先ディレクトリ
+	// 空の場合は os.TempDir() を使う
+	Path string `json:"path"`
+	// Keys はセッションの署名鍵と暗号鍵の組のリスト
+	// 先頭の組で新しいセッションを保護し、残りの組は鍵のローテーション中に古いセッションを読むためだけに使う
+	// 空の場合は起動ごとにランダムな鍵を生成する
+	Keys []Key `json:"keys"`
+	// Cookie はセッションクッキーの属性を表す
+	Cookie Cookie `json:"cookie"`
+}
+
+// Key はセッションを保護する鍵の組を表す
+type Key struct {
+	// Hash は署名鍵で 32 or 64 バイトを推奨
+	Hash string `json:"hash"`
+	// Block は暗号鍵で 16, 24, 32 バイトのいずれか。空の場合は暗号化しない
+	Block string `json:"block"`
+}
+
+// Cookie はセッションクッキーの属性を表す
+type Cookie struct {
+	Path     string `json:"path"`
+	Domain   string `json:"domain"`
+	MaxAge   int    `json:"max_age"`
+	Secure   bool   `json:"secure"`
+	HTTPOnly *bool  `json:"http_only"`
+	// SameSite は "lax" (default), "strict", "none" のいずれか
+	SameSite string `json:"same_site"`
+}
+
+// New は設定情報からセッションストアを構築する
+// c が nil の場合はデフォルトの設定で構築する
+func (c *Conf) New() (sessions.Store, error) {
+	if c == nil {
+		c = &Conf{}
+	}
+	keyPairs, err := c.keyPairs()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := c.Cookie.options()
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(c.Store) {
+	case "", "cookie":
+		s := sessions.NewCookieStore(keyPairs...)
+		s.Options = opts
+		s.MaxAge(opts.MaxAge)
+		return s, nil
+	case "filesystem":
+		path := c.Path
+		if path == "" {
+			path = os.TempDir()
+		}
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return nil, err
+		}
+		s := sessions.NewFilesystemStore(path, keyPairs...)
+		s.Options = opts
+		s.MaxAge(opts.MaxAge)
+		return s, nil
+	default:
+		return nil, fmt.Errorf("session store(%s) はサポートしていない", c.Store)
+	}
+}
+
+func (c *Conf) keyPairs() ([][]byte, error) {
+	if len(c.Keys) == 0 {
+		log.Println("session: 鍵が設定されていないためランダムな鍵を生成する。再起動するとセッションは全て無効になる")
+		return [][]byte{securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)}, nil
+	}
+	var ret [][]byte
+	for i, k := range c.Keys {
+		if len(k.Hash) < 32 {
+			return nil, fmt.Errorf("session: keys[%d].hash は 32 バイト以上必要", i)
+		}
+		var block []byte
+		if k.Block != "" {
+			if l := len(k.Block); l != 16 && l != 24 && l != 32 {
+				return nil, fmt.Errorf("session: keys[%d].block は 16, 24, 32 バイトのいずれか", i)
+			}
+			block = []byte(k.Block)
+		}
+		ret = append(ret, []byte(k.Hash), block)
+	}
+	return ret, nil
+}
+
+func (c *Cookie) options() (*sessions.Options, error) {
+	opts := &sessions.Options{
+		Path:     c.Path,
+		Domain:   c.Domain,
+		MaxAge:   c.MaxAge,
+		Secure:   c.Secure,
+		HttpOnly: true,
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = 86400
+	}
+	if c.HTTPOnly != nil {
+		opts.HttpOnly = *c.HTTPOnly
+	}
+	switch strings.ToLower(c.SameSite) {
+	case "", "lax":
+		opts.SameSite = http.SameSiteLaxMode
+	case "strict":
+		opts.SameSite = http.SameSiteStrictMode
+	case "none":
+		if !opts.Secure {
+			return nil, fmt.Errorf("session: SameSite=None は Secure 属性が必要")
+		}
+		opts.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("session: same_site(%s) はサポートしていない", c.SameSite)
+	}
+	return opts, nil
+}
+
+// Get は store から name のセッションを取得する
+// 鍵のローテーションなどで既存のクッキーを復号できなかった場合は新しいセッションとして扱う
+func Get(store sessions.Store, r *http.Request, name string) (*sessions.Session, error) {
+	s, err := store.Get(r, name)
+	if err != nil {
+		if e, ok := err.(securecookie.Error); ok && e.IsDecode() && s != nil {
+			log.Printf("session: セッション(%s)を復号できなかったため新しく作り直す %v\n", name, err)
+			return s, nil
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// Renew はセッション固定攻撃を防ぐため、ログイン直後などにセッションを新しい識別子で保存し直す準備をする
+// 古い識別子のセッションはストアから消し、サーバサイドのストアでは次の Save で新しい識別子が払い出される
+func Renew(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	if !s.IsNew {
+		// MaxAge を負にして保存するとストアから消える。 s はこの後も使うので写しを保存する
+		stale := *s
+		opts := *s.Options
+		opts.MaxAge = -1
+		stale.Options = &opts
+		if err := stale.Save(r, w); err != nil {
+			return err
+		}
+	}
+	s.ID = ""
+	s.IsNew = true
+	return nil
+}
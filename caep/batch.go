@@ -0,0 +1,83 @@
+package caep
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batcher は同じ Stream の同じ subject に対するコンテキストの変更を window の間ためて、一つの SET にまとめて送る
+type batcher struct {
+	window time.Duration
+	send   func(aud []Receiver, events ...Event) error
+	m      sync.Mutex
+	// pending は Stream と subject をキーにした送信待ちのイベント
+	pending map[string]*batch
+}
+
+// batch は一つの SET にまとめて送るイベントの集まり
+type batch struct {
+	recv Receiver
+	// events はイベントの種類 (コンテキストの ID) ごとに最新のものだけを持つ
+	events map[string]Event
+	order  []string
+}
+
+func newBatcher(window time.Duration, send func(aud []Receiver, events ...Event) error) *batcher {
+	return &batcher{
+		window:  window,
+		send:    send,
+		pending: make(map[string]*batch),
+	}
+}
+
+// add は recv 宛の e を送信待ちに加える
+// 同じ subject 宛の最初のイベントから window 経つとまとめて送信する
+func (b *batcher) add(recv Receiver, e *SSEEventClaim) {
+	key := recv.ID + "|" + recv.StreamConf.StreamID + "|" + e.Subject.Key()
+	b.m.Lock()
+	defer b.m.Unlock()
+	p, ok := b.pending[key]
+	if !ok {
+		p = &batch{events: make(map[string]Event)}
+		b.pending[key] = p
+		time.AfterFunc(b.window, func() { b.flush(key) })
+	}
+	// 配送先の設定は最新のものを使う
+	p.recv = recv
+	if _, ok := p.events[e.Type()]; !ok {
+		p.order = append(p.order, e.Type())
+	}
+	p.events[e.Type()] = e
+}
+
+// drop は削除された Stream 宛の送信待ちのイベントを捨てる
+func (b *batcher) drop(recvID, streamID string) {
+	prefix := recvID + "|" + streamID + "|"
+	b.m.Lock()
+	defer b.m.Unlock()
+	for key := range b.pending {
+		if strings.HasPrefix(key, prefix) {
+			delete(b.pending, key)
+		}
+	}
+}
+
+// flush は key の送信待ちのイベントを一つの SET にして送信する
+func (b *batcher) flush(key string) {
+	b.m.Lock()
+	p, ok := b.pending[key]
+	delete(b.pending, key)
+	b.m.Unlock()
+	if !ok {
+		return
+	}
+	var events []Event
+	for _, typ := range p.order {
+		events = append(events, p.events[typ])
+	}
+	if err := b.send([]Receiver{p.recv}, events...); err != nil {
+		fmt.Printf("まとめた SET の送信に失敗 to RecvID(%s) %v\n", p.recv.ID, err)
+	}
+}
@@ -0,0 +1,51 @@
+package caep
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBatcher(t *testing.T) {
+	sent := make(chan []Event, 2)
+	b := newBatcher(50*time.Millisecond, func(aud []Receiver, events ...Event) error {
+		sent <- events
+		return nil
+	})
+	alice, bob := *NewIssSub("https://idp.example", "alice"), *NewIssSub("https://idp.example", "bob")
+	recv := Receiver{ID: "recv", StreamConf: &StreamConfig{StreamID: "s1"}}
+	deleted := Receiver{ID: "recv", StreamConf: &StreamConfig{StreamID: "s2"}}
+	b.add(recv, &SSEEventClaim{ID: "ctx1", Subject: alice, Property: map[string]string{"s": "old"}})
+	b.add(recv, &SSEEventClaim{ID: "ctx2", Subject: alice, Property: map[string]string{"s": "v2"}})
+	b.add(recv, &SSEEventClaim{ID: "ctx1", Subject: alice, Property: map[string]string{"s": "new"}})
+	b.add(recv, &SSEEventClaim{ID: "ctx1", Subject: bob, Property: map[string]string{"s": "bob"}})
+	// 削除された Stream 宛のイベントは送らない
+	b.add(deleted, &SSEEventClaim{ID: "ctx1", Subject: alice, Property: map[string]string{"s": "deleted"}})
+	b.drop("recv", "s2")
+
+	got := make(map[string][]Event)
+	for i := 0; i < 2; i++ {
+		select {
+		case events := <-sent:
+			got[events[0].(*SSEEventClaim).Subject.Sub] = events
+		case <-time.After(5 * time.Second):
+			t.Fatal("まとめたイベントが送信されない")
+		}
+	}
+	// 同じ subject のイベントは一つの SET にまとめ、同じコンテキストは最新のものだけを送る
+	want := []Event{
+		&SSEEventClaim{ID: "ctx1", Subject: alice, Property: map[string]string{"s": "new"}},
+		&SSEEventClaim{ID: "ctx2", Subject: alice, Property: map[string]string{"s": "v2"}},
+	}
+	if !reflect.DeepEqual(got["alice"], want) {
+		t.Errorf("alice 宛の SET = %+v, want %+v", got["alice"], want)
+	}
+	if len(got["bob"]) != 1 {
+		t.Errorf("bob 宛の SET = %+v", got["bob"])
+	}
+	select {
+	case events := <-sent:
+		t.Errorf("削除された Stream 宛に送信した %+v", events)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,231 @@
+package caep
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// keyEncryptionHashes は SET の暗号化に使える鍵暗号化アルゴリズムと、その OAEP で使うハッシュ関数
+var keyEncryptionHashes = map[jwa.KeyEncryptionAlgorithm]func() hash.Hash{
+	jwa.RSA_OAEP:     sha1.New,
+	jwa.RSA_OAEP_256: sha256.New,
+}
+
+// contentEncryptionKeySizes は SET の暗号化に使えるコンテンツ暗号化アルゴリズムと、その鍵長 (byte)
+var contentEncryptionKeySizes = map[jwa.ContentEncryptionAlgorithm]int{
+	jwa.A128GCM: 16,
+	jwa.A192GCM: 24,
+	jwa.A256GCM: 32,
+}
+
+// StreamEncryption は Receiver が SET の暗号化を求める時に StreamConfig で伝える設定を表す
+// Transmitter は署名した SET を JWKS の鍵で暗号化する (Nested JWT)
+type StreamEncryption struct {
+	// Alg は鍵暗号化アルゴリズム
+	Alg string `json:"alg"`
+	// Enc はコンテンツ暗号化アルゴリズム
+	Enc string `json:"enc"`
+	// JWKS は Receiver の暗号化用公開鍵
+	JWKS *jwk.Set `json:"jwks"`
+}
+
+// equal は e と o が同じ暗号化設定か判定する
+func (e *StreamEncryption) equal(o *StreamEncryption) bool {
+	if e == nil || o == nil {
+		return e == o
+	}
+	if e.Alg != o.Alg || e.Enc != o.Enc {
+		return false
+	}
+	return keyIDs(e.JWKS) == keyIDs(o.JWKS)
+}
+
+func keyIDs(set *jwk.Set) string {
+	if set == nil {
+		return ""
+	}
+	var ret string
+	for _, k := range set.Keys {
+		ret += k.KeyID() + " "
+	}
+	return ret
+}
+
+// validate は Transmitter がこの設定で SET を暗号化できるか確かめる
+// 配送する時に初めて失敗して SET が届かなくなるのを防ぐため、 StreamConfig を保存する前に呼ぶ
+func (e *StreamEncryption) validate() error {
+	if _, ok := keyEncryptionHashes[jwa.KeyEncryptionAlgorithm(e.Alg)]; !ok {
+		return fmt.Errorf("caep: 鍵暗号化アルゴリズム(%s) はサポートしていない", e.Alg)
+	}
+	if _, ok := contentEncryptionKeySizes[jwa.ContentEncryptionAlgorithm(e.Enc)]; !ok {
+		return fmt.Errorf("caep: コンテンツ暗号化アルゴリズム(%s) はサポートしていない", e.Enc)
+	}
+	_, _, err := e.key()
+	return err
+}
+
+// key は JWKS から暗号化に使う RSA 公開鍵とその kid を取り出す
+func (e *StreamEncryption) key() (*rsa.PublicKey, string, error) {
+	if e.JWKS == nil {
+		return nil, "", fmt.Errorf("caep: Receiver の暗号化鍵がない")
+	}
+	for _, k := range e.JWKS.Keys {
+		if k.KeyUsage() != "" && k.KeyUsage() != "enc" {
+			continue
+		}
+		var raw interface{}
+		if err := k.Raw(&raw); err != nil {
+			return nil, "", err
+		}
+		if pub, ok := raw.(*rsa.PublicKey); ok {
+			return pub, k.KeyID(), nil
+		}
+	}
+	return nil, "", fmt.Errorf("caep: Receiver の暗号化鍵に RSA 公開鍵がない")
+}
+
+// encrypt は署名済みの SET を暗号化して Nested JWT (RFC 7519 Sec.5.2) にする
+// 中身が JWT であることを保護ヘッダの cty で伝える
+func (e *StreamEncryption) encrypt(signed []byte) ([]byte, error) {
+	newHash, ok := keyEncryptionHashes[jwa.KeyEncryptionAlgorithm(e.Alg)]
+	if !ok {
+		return nil, fmt.Errorf("caep: 鍵暗号化アルゴリズム(%s) はサポートしていない", e.Alg)
+	}
+	keySize, ok := contentEncryptionKeySizes[jwa.ContentEncryptionAlgorithm(e.Enc)]
+	if !ok {
+		return nil, fmt.Errorf("caep: コンテンツ暗号化アルゴリズム(%s) はサポートしていない", e.Enc)
+	}
+	pub, kid, err := e.key()
+	if err != nil {
+		return nil, err
+	}
+	cek := make([]byte, keySize)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(newHash(), rand.Reader, pub, cek, nil)
+	if err != nil {
+		return nil, err
+	}
+	header := map[string]string{"alg": e.Alg, "enc": e.Enc, "cty": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(h)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	// 保護ヘッダを追加認証データにする (RFC 7516 Sec.5.1)
+	sealed := gcm.Seal(nil, iv, signed, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	return []byte(strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, ".")), nil
+}
+
+// RecvEncryptionConf は Receiver が SET の暗号化を求める時の設定情報を表す
+type RecvEncryptionConf struct {
+	// Alg は鍵暗号化アルゴリズム。空の時は RSA-OAEP-256
+	Alg jwa.KeyEncryptionAlgorithm
+	// Enc はコンテンツ暗号化アルゴリズム。空の時は A256GCM
+	Enc jwa.ContentEncryptionAlgorithm
+	// Key は復号鍵。 nil の時は起動時に RSA 鍵を生成する
+	Key *rsa.PrivateKey
+}
+
+// decrypter は Receiver が暗号化された SET を復号する
+type decrypter struct {
+	alg  jwa.KeyEncryptionAlgorithm
+	key  *rsa.PrivateKey
+	conf *StreamEncryption
+}
+
+func (c *RecvEncryptionConf) new() (*decrypter, error) {
+	alg := c.Alg
+	if alg == "" {
+		alg = jwa.RSA_OAEP_256
+	}
+	enc := c.Enc
+	if enc == "" {
+		enc = jwa.A256GCM
+	}
+	if _, ok := keyEncryptionHashes[alg]; !ok {
+		return nil, fmt.Errorf("caep: 鍵暗号化アルゴリズム(%s) はサポートしていない", alg)
+	}
+	if _, ok := contentEncryptionKeySizes[enc]; !ok {
+		return nil, fmt.Errorf("caep: コンテンツ暗号化アルゴリズム(%s) はサポートしていない", enc)
+	}
+	key := c.Key
+	if key == nil {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pub, err := jwk.New(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := jwk.AssignKeyID(pub); err != nil {
+		return nil, err
+	}
+	for k, v := range map[string]interface{}{
+		jwk.AlgorithmKey: alg.String(),
+		jwk.KeyUsageKey:  "enc",
+	} {
+		if err := pub.Set(k, v); err != nil {
+			return nil, err
+		}
+	}
+	return &decrypter{
+		alg: alg,
+		key: key,
+		conf: &StreamEncryption{
+			Alg:  alg.String(),
+			Enc:  enc.String(),
+			JWKS: &jwk.Set{Keys: []jwk.Key{pub}},
+		},
+	}, nil
+}
+
+// isJWE は compact serialization の SET が JWE か判定する
+func isJWE(set []byte) bool {
+	return bytes.Count(bytes.TrimSpace(set), []byte(".")) == 4
+}
+
+// decrypt は暗号化された SET を復号して署名済みの SET を返す
+func (d *decrypter) decrypt(set []byte) ([]byte, error) {
+	return jwe.Decrypt(set, d.alg, d.key)
+}
@@ -0,0 +1,63 @@
+package caep
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEncryptNestedJWT(t *testing.T) {
+	d, err := (&RecvEncryptionConf{}).new()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := []byte("eyJhbGciOiJFUzI1NiJ9.eyJqdGkiOiJqdGkxIn0.c2ln")
+	set, err := d.conf.encrypt(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isJWE(set) {
+		t.Fatalf("暗号化した SET が JWE の compact serialization でない %s", set)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.SplitN(string(set), ".", 2)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h map[string]string
+	if err := json.Unmarshal(b, &h); err != nil {
+		t.Fatal(err)
+	}
+	if h["cty"] != "JWT" {
+		t.Errorf("cty = %q, want JWT", h["cty"])
+	}
+	if kid := d.conf.JWKS.Keys[0].KeyID(); h["kid"] != kid {
+		t.Errorf("kid = %q, want %q", h["kid"], kid)
+	}
+	got, err := d.decrypt(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(signed) {
+		t.Errorf("decrypt() = %s, want %s", got, signed)
+	}
+}
+
+func TestStreamEncryptionValidate(t *testing.T) {
+	d, err := (&RecvEncryptionConf{}).new()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.conf.validate(); err != nil {
+		t.Errorf("Receiver が広告する暗号化設定を受け付けない %v", err)
+	}
+	for _, e := range []StreamEncryption{
+		{Alg: "RSA1_5", Enc: "A256GCM", JWKS: d.conf.JWKS},
+		{Alg: "RSA-OAEP-256", Enc: "A128CBC-HS256", JWKS: d.conf.JWKS},
+		{Alg: "RSA-OAEP-256", Enc: "A256GCM"},
+	} {
+		if err := e.validate(); err == nil {
+			t.Errorf("alg=%s enc=%s jwks=%v を受け付けた", e.Alg, e.Enc, e.JWKS != nil)
+		}
+	}
+}
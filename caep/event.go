@@ -0,0 +1,195 @@
+package caep
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Event は SET の events クレームに含まれる一つのイベントを表す
+// events クレームはイベントの種類 (Type) をキーにしたマップになる
+type Event interface {
+	// Type はイベントの種類を表す URI
+	Type() string
+}
+
+// CAEP の仕様で定められたイベントの種類
+const (
+	SessionRevokedEventType         = "https://schemas.openid.net/secevent/caep/event-type/session-revoked"
+	TokenClaimsChangeEventType      = "https://schemas.openid.net/secevent/caep/event-type/token-claims-change"
+	CredentialChangeEventType       = "https://schemas.openid.net/secevent/caep/event-type/credential-change"
+	AssuranceLevelChangeEventType   = "https://schemas.openid.net/secevent/caep/event-type/assurance-level-change"
+	DeviceComplianceChangeEventType = "https://schemas.openid.net/secevent/caep/event-type/device-compliance-change"
+)
+
+// CAEPEvent は CAEP のイベントに共通するフィールドを表す
+type CAEPEvent struct {
+	Subject Subject `json:"subject"`
+	// EventTimestamp はイベントが発生した時刻 (NumericDate)
+	EventTimestamp int64 `json:"event_timestamp,omitempty"`
+	// InitiatingEntity はイベントを引き起こしたもの (admin, user, policy, system)
+	InitiatingEntity string `json:"initiating_entity,omitempty"`
+	// ReasonAdmin は管理者向けのイベントの理由。言語タグをキーにする
+	ReasonAdmin map[string]string `json:"reason_admin,omitempty"`
+	// ReasonUser はユーザ向けのイベントの理由。言語タグをキーにする
+	ReasonUser map[string]string `json:"reason_user,omitempty"`
+}
+
+func (e *CAEPEvent) eventSubject() *Subject { return &e.Subject }
+
+// SessionRevokedEvent はユーザのセッションが取り消されたことを表す
+type SessionRevokedEvent struct {
+	CAEPEvent
+}
+
+func (e *SessionRevokedEvent) Type() string { return SessionRevokedEventType }
+
+// TokenClaimsChangeEvent はトークンのクレームが変わったことを表す
+type TokenClaimsChangeEvent struct {
+	CAEPEvent
+	// Claims は変わった後のクレーム
+	Claims map[string]interface{} `json:"claims"`
+}
+
+func (e *TokenClaimsChangeEvent) Type() string { return TokenClaimsChangeEventType }
+
+// CredentialChangeEvent はユーザのクレデンシャルが作成・変更・削除されたことを表す
+type CredentialChangeEvent struct {
+	CAEPEvent
+	// CredentialType は password, pin, x509, fido2-platform などのクレデンシャルの種類
+	CredentialType string `json:"credential_type"`
+	// ChangeType は create, revoke, update, delete のいずれか
+	ChangeType   string `json:"change_type"`
+	FriendlyName string `json:"friendly_name,omitempty"`
+	X509Issuer   string `json:"x509_issuer,omitempty"`
+	X509Serial   string `json:"x509_serial,omitempty"`
+	FIDO2AAGUID  string `json:"fido2_aaguid,omitempty"`
+}
+
+func (e *CredentialChangeEvent) Type() string { return CredentialChangeEventType }
+
+// AssuranceLevelChangeEvent はユーザの認証の保証レベルが変わったことを表す
+type AssuranceLevelChangeEvent struct {
+	CAEPEvent
+	// Namespace は保証レベルの体系 (RFC8176, nist-aal など)
+	Namespace     string `json:"namespace"`
+	CurrentLevel  string `json:"current_level"`
+	PreviousLevel string `json:"previous_level,omitempty"`
+	// ChangeDirection は increase か decrease
+	ChangeDirection string `json:"change_direction,omitempty"`
+}
+
+func (e *AssuranceLevelChangeEvent) Type() string { return AssuranceLevelChangeEventType }
+
+// DeviceComplianceChangeEvent はデバイスがポリシーに準拠しているかが変わったことを表す
+type DeviceComplianceChangeEvent struct {
+	CAEPEvent
+	// PreviousStatus と CurrentStatus は compliant か not-compliant
+	PreviousStatus string `json:"previous_status"`
+	CurrentStatus  string `json:"current_status"`
+}
+
+func (e *DeviceComplianceChangeEvent) Type() string { return DeviceComplianceChangeEventType }
+
+func (e *VerificationEvent) Type() string { return VerificationEventType }
+
+func (e *StreamUpdatedEvent) Type() string { return StreamUpdatedEventType }
+
+// Type は SSEEventClaim の種類としてコンテキストの ID を返す
+func (e *SSEEventClaim) Type() string { return e.ID }
+
+func (e *SSEEventClaim) eventSubject() *Subject { return &e.Subject }
+
+// RawEvent は登録されておらず、コンテキストの変更としても解釈できない種類のイベントを表す
+// 中身は解釈せずにそのまま保持し、 handler に渡す
+type RawEvent struct {
+	EventType string
+	// Raw はイベントの JSON そのもの
+	Raw json.RawMessage
+}
+
+func (e *RawEvent) Type() string { return e.EventType }
+
+func (e *RawEvent) MarshalJSON() ([]byte, error) { return e.Raw, nil }
+
+// eventTypes はイベントの種類からそのイベントを表す型を作る関数を引く
+var eventTypes = struct {
+	m  sync.RWMutex
+	db map[string]func() Event
+}{db: make(map[string]func() Event)}
+
+// RegisterEventType は typ のイベントを new が返す型にデコードするよう登録する
+// 登録されていない種類のイベントはコンテキストの変更を表す SSEEventClaim としてデコードし、
+// それもできなければ RawEvent として保持する
+func RegisterEventType(typ string, new func() Event) {
+	eventTypes.m.Lock()
+	defer eventTypes.m.Unlock()
+	eventTypes.db[typ] = new
+}
+
+func init() {
+	RegisterEventType(VerificationEventType, func() Event { return new(VerificationEvent) })
+	RegisterEventType(StreamUpdatedEventType, func() Event { return new(StreamUpdatedEvent) })
+	RegisterEventType(SessionRevokedEventType, func() Event { return new(SessionRevokedEvent) })
+	RegisterEventType(TokenClaimsChangeEventType, func() Event { return new(TokenClaimsChangeEvent) })
+	RegisterEventType(CredentialChangeEventType, func() Event { return new(CredentialChangeEvent) })
+	RegisterEventType(AssuranceLevelChangeEventType, func() Event { return new(AssuranceLevelChangeEvent) })
+	RegisterEventType(DeviceComplianceChangeEventType, func() Event { return new(DeviceComplianceChangeEvent) })
+}
+
+// newEvent は typ のイベントを表す空の値を返す
+func newEvent(typ string) Event {
+	eventTypes.m.RLock()
+	new, ok := eventTypes.db[typ]
+	eventTypes.m.RUnlock()
+	if ok {
+		return new()
+	}
+	return &SSEEventClaim{ID: typ}
+}
+
+// DecodeEvents は SET の events クレームをイベントの種類ごとの型にデコードする
+// イベントは種類の辞書順に並べて返す
+func DecodeEvents(v interface{}) ([]Event, error) {
+	claim, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("caep: events クレームが JSON Object ではない")
+	}
+	var types []string
+	for typ := range claim {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	var ret []Event
+	for _, typ := range types {
+		raw, err := json.Marshal(claim[typ])
+		if err != nil {
+			return nil, err
+		}
+		e := newEvent(typ)
+		err = json.Unmarshal(raw, e)
+		if c, ok := e.(*SSEEventClaim); ok && (err != nil || c.Property == nil) {
+			// 知らない種類のイベントが含まれていても SET ごと拒否はしない
+			ret = append(ret, &RawEvent{EventType: typ, Raw: raw})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("caep: event(%s) のパースに失敗 %v", typ, err)
+		}
+		ret = append(ret, e)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("caep: events クレームにイベントがない")
+	}
+	return ret, nil
+}
+
+// eventsClaim は events を SET の events クレームに当てはめる
+func eventsClaim(events ...Event) map[string]Event {
+	ret := make(map[string]Event)
+	for _, e := range events {
+		ret[e.Type()] = e
+	}
+	return ret
+}
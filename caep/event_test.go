@@ -0,0 +1,82 @@
+package caep
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// decode は SET の events クレームとして JSON を読んでからデコードする
+func decode(t *testing.T, claim string) ([]Event, error) {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(claim), &v); err != nil {
+		t.Fatal(err)
+	}
+	return DecodeEvents(v)
+}
+
+func TestDecodeEventsRoundTrip(t *testing.T) {
+	sub := *NewIssSub("https://idp.example", "alice")
+	for _, e := range []Event{
+		&SSEEventClaim{ID: "ctx1", Subject: sub, Property: map[string]string{"s1": "v1"}},
+		&VerificationEvent{State: "abc"},
+		&SessionRevokedEvent{CAEPEvent{Subject: sub, InitiatingEntity: "policy"}},
+		&CredentialChangeEvent{CAEPEvent: CAEPEvent{Subject: sub}, CredentialType: "fido2-platform", ChangeType: "revoke"},
+		&DeviceComplianceChangeEvent{CAEPEvent: CAEPEvent{Subject: sub}, PreviousStatus: "compliant", CurrentStatus: "not-compliant"},
+	} {
+		b, err := json.Marshal(eventsClaim(e))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decode(t, string(b))
+		if err != nil {
+			t.Errorf("%s をデコードできない %v", e.Type(), err)
+			continue
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], e) {
+			t.Errorf("DecodeEvents(%s) = %#v, want %#v", b, got, e)
+		}
+	}
+}
+
+func TestDecodeEventsUnknown(t *testing.T) {
+	const unknown = "https://example.com/event-type/unknown"
+	// 知らない種類のイベントがあっても SET ごと拒否せず、他のイベントと一緒に受け付ける
+	got, err := decode(t, `{"`+unknown+`":{"foo":1},"`+VerificationEventType+`":{"state":"abc"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		&RawEvent{EventType: unknown, Raw: json.RawMessage(`{"foo":1}`)},
+		&VerificationEvent{State: "abc"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeEvents() = %#v, want %#v", got, want)
+	}
+	// RawEvent は受け取ったままの JSON で送り直せる
+	b, err := json.Marshal(got[0])
+	if err != nil || string(b) != `{"foo":1}` {
+		t.Errorf("Marshal(RawEvent) = %s %v", b, err)
+	}
+	// property の形が違うものもコンテキストの変更とはみなさない
+	got, err = decode(t, `{"ctx1":{"property":"not an object"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got[0].(*RawEvent); !ok {
+		t.Errorf("property の形が違うイベント = %#v, want *RawEvent", got[0])
+	}
+}
+
+func TestDecodeEventsInvalid(t *testing.T) {
+	for _, claim := range []string{
+		`{"` + VerificationEventType + `":{"state":1}}`,
+		`{}`,
+		`["ctx1"]`,
+	} {
+		if got, err := decode(t, claim); err == nil {
+			t.Errorf("DecodeEvents(%s) = %v, want error", claim, got)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package caep
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventHandler は Receiver が受け取ったイベントを一つ処理する
+// エラーを返すと、そのイベントを含む SET は受け取りに失敗したことになる
+type EventHandler interface {
+	HandleEvent(ctx context.Context, e Event) error
+}
+
+// EventHandlerFunc は関数を EventHandler として使う
+type EventHandlerFunc func(ctx context.Context, e Event) error
+
+func (f EventHandlerFunc) HandleEvent(ctx context.Context, e Event) error {
+	return f(ctx, e)
+}
+
+// EventMiddleware は EventHandler を包んでログやメトリクスなどの処理を差し込む
+type EventMiddleware func(next EventHandler) EventHandler
+
+const (
+	// ContextEventType は Recv.Handle でコンテキストの変更 (*SSEEventClaim) を全て受け取る時に指定する
+	// コンテキストの識別子を指定した handler は、これに登録した handler の後に呼ぶ
+	ContextEventType = "context"
+	// DefaultEventType は Recv.Handle で他に handler が登録されていないイベントを受け取る時に指定する
+	// 解釈できない種類のイベント (*RawEvent) も、その種類に handler を登録していなければここに渡す
+	// 登録しなければそのようなイベントはログに出して無視する
+	DefaultEventType = "*"
+)
+
+// handlers はイベントの種類ごとに登録された EventHandler を保持する
+type handlers struct {
+	m sync.RWMutex
+	// byType はイベントの種類 -> 登録された順の handler
+	byType map[string][]EventHandler
+	mws    []EventMiddleware
+}
+
+func newHandlers() *handlers {
+	return &handlers{byType: make(map[string][]EventHandler)}
+}
+
+// handle は eventType のイベントを受け取った時に h を呼ぶよう登録する
+// 同じ種類に複数登録した時は登録した順に呼び、エラーを返したところで止める
+func (hs *handlers) handle(eventType string, h EventHandler) {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	hs.byType[eventType] = append(hs.byType[eventType], h)
+}
+
+// use は全ての handler を mws で包むよう登録する。先に登録したものほど外側になる
+func (hs *handlers) use(mws ...EventMiddleware) {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	hs.mws = append(hs.mws, mws...)
+}
+
+// lookup は e を渡す handler を探し、 middleware で包んで返す
+func (hs *handlers) lookup(e Event) EventHandler {
+	hs.m.RLock()
+	defer hs.m.RUnlock()
+	var hh []EventHandler
+	if _, isCtx := e.(*SSEEventClaim); isCtx {
+		hh = append(hh, hs.byType[ContextEventType]...)
+	}
+	hh = append(hh, hs.byType[e.Type()]...)
+	if len(hh) == 0 {
+		hh = hs.byType[DefaultEventType]
+	}
+	var h EventHandler = chain(hh)
+	if len(hh) == 0 {
+		h = EventHandlerFunc(ignoreEvent)
+	}
+	for i := len(hs.mws) - 1; i >= 0; i-- {
+		h = hs.mws[i](h)
+	}
+	return h
+}
+
+// dispatch は一つの SET で受け取ったイベントを順に handler に渡す
+func (hs *handlers) dispatch(ctx context.Context, events []Event) error {
+	for _, e := range events {
+		if err := hs.lookup(e).HandleEvent(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chain は同じ種類に登録された handler を順に呼ぶ
+type chain []EventHandler
+
+func (c chain) HandleEvent(ctx context.Context, e Event) error {
+	for _, h := range c {
+		if err := h.HandleEvent(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ignoreEvent(ctx context.Context, e Event) error {
+	fmt.Printf("event(%s) を扱う handler がないので無視する %v\n", e.Type(), e)
+	return nil
+}
+
+// LogEvents は受け取ったイベントの種類と処理にかかった時間、その結果をログに出す EventMiddleware
+func LogEvents(next EventHandler) EventHandler {
+	return EventHandlerFunc(func(ctx context.Context, e Event) error {
+		start := time.Now()
+		err := next.HandleEvent(ctx, e)
+		if err != nil {
+			fmt.Printf("event(%s) の処理に失敗 (%v) %v\n", e.Type(), time.Since(start), err)
+			return err
+		}
+		fmt.Printf("event(%s) を処理した (%v)\n", e.Type(), time.Since(start))
+		return nil
+	})
+}
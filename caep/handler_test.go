@@ -0,0 +1,62 @@
+package caep
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestHandlersDispatch(t *testing.T) {
+	hs := newHandlers()
+	var got []string
+	record := func(name string) EventHandler {
+		return EventHandlerFunc(func(_ context.Context, e Event) error {
+			got = append(got, name+":"+e.Type())
+			return nil
+		})
+	}
+	hs.handle(ContextEventType, record("context"))
+	hs.handle("ctx1", record("ctx1"))
+	hs.handle(VerificationEventType, record("verification"))
+	hs.handle(DefaultEventType, record("default"))
+	hs.use(func(next EventHandler) EventHandler {
+		return EventHandlerFunc(func(ctx context.Context, e Event) error {
+			got = append(got, "mw")
+			return next.HandleEvent(ctx, e)
+		})
+	})
+
+	err := hs.dispatch(context.Background(), []Event{
+		&SSEEventClaim{ID: "ctx1"},
+		&SSEEventClaim{ID: "ctx2"},
+		&VerificationEvent{State: "s"},
+		&RawEvent{EventType: "https://example.com/unknown"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// コンテキストは ContextEventType に登録したものの後に識別子ごとのものを呼び、どれにもなければ DefaultEventType に渡す
+	want := []string{
+		"mw", "context:ctx1", "ctx1:ctx1",
+		"mw", "context:ctx2",
+		"mw", "verification:" + VerificationEventType,
+		"mw", "default:https://example.com/unknown",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dispatch() で呼んだ handler = %v, want %v", got, want)
+	}
+
+	// handler が失敗したら残りのイベントは処理しない
+	got = nil
+	failed := errors.New("failed")
+	hs.handle("ctx3", EventHandlerFunc(func(context.Context, Event) error { return failed }))
+	if err := hs.dispatch(context.Background(), []Event{&SSEEventClaim{ID: "ctx3"}, &SSEEventClaim{ID: "ctx1"}}); err != failed {
+		t.Errorf("dispatch() = %v, want %v", err, failed)
+	}
+	for _, g := range got {
+		if g == "ctx1:ctx1" {
+			t.Error("失敗した後のイベントを処理した")
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package caep
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+)
+
+// signer は Transmitter が SET に署名する鍵を管理する
+type signer struct {
+	alg  jwa.SignatureAlgorithm
+	priv jwk.Key
+	pub  *jwk.Set
+}
+
+// newSigner は署名鍵から signer を構築する
+// key が nil の時は alg に合わせた鍵を生成する
+func newSigner(alg jwa.SignatureAlgorithm, key crypto.Signer, kid string) (*signer, error) {
+	if alg == "" {
+		alg = jwa.RS256
+	}
+	if key == nil {
+		var err error
+		switch alg {
+		case jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512:
+			key, err = rsa.GenerateKey(rand.Reader, 2048)
+		case jwa.ES256:
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case jwa.ES384:
+			key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case jwa.ES512:
+			key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		default:
+			return nil, fmt.Errorf("caep: 署名アルゴリズム(%s) はサポートしていない", alg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !isAsymmetric(alg) {
+		return nil, fmt.Errorf("caep: 署名アルゴリズム(%s) はサポートしていない", alg)
+	}
+	priv, err := jwk.New(key)
+	if err != nil {
+		return nil, err
+	}
+	if kid != "" {
+		if err := priv.Set(jwk.KeyIDKey, kid); err != nil {
+			return nil, err
+		}
+	} else if err := jwk.AssignKeyID(priv); err != nil {
+		return nil, err
+	}
+	keyID, _ := priv.Get(jwk.KeyIDKey)
+	rawpub, err := jwk.PublicKeyOf(key)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := jwk.New(rawpub)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range map[string]interface{}{
+		jwk.KeyIDKey:     keyID,
+		jwk.AlgorithmKey: alg.String(),
+		jwk.KeyUsageKey:  "sig",
+	} {
+		if err := pub.Set(k, v); err != nil {
+			return nil, err
+		}
+	}
+	return &signer{alg, priv, &jwk.Set{Keys: []jwk.Key{pub}}}, nil
+}
+
+// isAsymmetric は alg が公開鍵で検証できる署名アルゴリズムか判定する
+func isAsymmetric(alg jwa.SignatureAlgorithm) bool {
+	switch alg {
+	case jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512, jwa.ES256, jwa.ES384, jwa.ES512:
+		return true
+	}
+	return false
+}
+
+// JWKS は Transmitter の SET 検証用公開鍵を JWK Set として返す
+func (tr *tr) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	if err := json.NewEncoder(w).Encode(tr.signer.pub); err != nil {
+		http.Error(w, "失敗", http.StatusInternalServerError)
+		return
+	}
+}
+
+// jwksMinRefreshInterval は未知の kid によって JWK Set を取得し直す最短の間隔
+const jwksMinRefreshInterval = 10 * time.Second
+
+// keySet は Receiver が Transmitter の JWK Set をキャッシュする
+type keySet struct {
+	client    *http.Client
+	m         sync.Mutex
+	set       *jwk.Set
+	fetchedAt time.Time
+}
+
+// lookup は kid に対応する公開鍵を返す
+// キャッシュに kid がなければ uri から JWK Set を取得し直す
+func (ks *keySet) lookup(ctx context.Context, uri, kid string) (interface{}, error) {
+	ks.m.Lock()
+	defer ks.m.Unlock()
+	if key, ok := ks.find(kid); ok {
+		return key, nil
+	}
+	if time.Since(ks.fetchedAt) < jwksMinRefreshInterval {
+		return nil, fmt.Errorf("caep: kid(%s) に対応する鍵がない", kid)
+	}
+	set, err := jwk.FetchHTTPWithContext(ctx, uri, jwk.WithHTTPClient(ks.client))
+	ks.fetchedAt = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	ks.set = set
+	if key, ok := ks.find(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("caep: kid(%s) に対応する鍵がない", kid)
+}
+
+func (ks *keySet) find(kid string) (interface{}, bool) {
+	if ks.set == nil {
+		return nil, false
+	}
+	keys := ks.set.LookupKeyID(kid)
+	if len(keys) == 0 {
+		return nil, false
+	}
+	var raw interface{}
+	if err := keys[0].Raw(&raw); err != nil {
+		return nil, false
+	}
+	return raw, true
+}
+
+// keyFor は SET の署名を検証するためのアルゴリズムと、 uri で公開されている公開鍵を返す
+func (ks *keySet) keyFor(ctx context.Context, uri string, set []byte) (jwa.SignatureAlgorithm, interface{}, error) {
+	msg, err := jws.Parse(bytes.NewReader(set))
+	if err != nil {
+		return "", nil, err
+	}
+	sigs := msg.Signatures()
+	if len(sigs) != 1 {
+		return "", nil, fmt.Errorf("caep: SET の署名は一つでなければならない")
+	}
+	h := sigs[0].ProtectedHeaders()
+	if !isAsymmetric(h.Algorithm()) {
+		return "", nil, fmt.Errorf("caep: SET の署名アルゴリズム(%s) は受け付けない", h.Algorithm())
+	}
+	key, err := ks.lookup(ctx, uri, h.KeyID())
+	if err != nil {
+		return "", nil, err
+	}
+	return h.Algorithm(), key, nil
+}
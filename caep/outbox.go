@@ -0,0 +1,382 @@
+package caep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OutboxSET は Push で配送待ちの SET を表す
+type OutboxSET struct {
+	// RecvID は配送先の Receiver の識別子
+	RecvID string `json:"recv_id"`
+	// StreamID は配送先の Stream の識別子
+	StreamID string `json:"stream_id"`
+	// JTI は SET の jti
+	JTI string `json:"jti"`
+	// Events は SET の events クレーム。配送する度に今の時刻を iat にして署名し直す
+	Events json.RawMessage `json:"events"`
+	// URL は配送先の URL
+	URL string `json:"url"`
+	// CreatedAt は Outbox に入れた時刻。同じ Stream 宛の SET はこの順で配送する
+	CreatedAt time.Time `json:"created_at"`
+	// Attempts はこれまでに配送を試みた回数
+	Attempts int `json:"attempts"`
+	// NextAttempt は次に配送を試みる時刻
+	NextAttempt time.Time `json:"next_attempt"`
+	// LastError は最後に配送に失敗した理由
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Delivery は Receiver への一度の Push 配送の結果を表す
+type Delivery struct {
+	// JTI は配送を試みた SET の jti
+	JTI string `json:"jti"`
+	// At は配送を試みた時刻
+	At time.Time `json:"at"`
+	// Error は配送に失敗した理由。成功した時は空
+	Error string `json:"error,omitempty"`
+}
+
+// OutboxRepo は Push で配送待ちの SET と、配送を諦めたり Poll 待ちから溢れたりした SET (dead letter) を永続化する
+type OutboxRepo interface {
+	// Save は配送待ちの SET を保存する。同じ RecvID と JTI のものがあれば上書きする
+	Save(set *OutboxSET) error
+	// Delete は配送待ちの SET を削除する
+	Delete(recvID, jti string) error
+	// List は recvID 宛の配送待ちの SET を返す。 recvID が空文字の時は全ての Receiver のものを返す
+	List(recvID string) ([]OutboxSET, error)
+	// SaveDeadLetter は配送を諦めた SET を保存する
+	SaveDeadLetter(set *OutboxSET) error
+	// DeleteDeadLetter は配送を諦めた SET を削除する
+	DeleteDeadLetter(recvID, jti string) error
+	// ListDeadLetters は recvID 宛の配送を諦めた SET を返す。 recvID が空文字の時は全ての Receiver のものを返す
+	ListDeadLetters(recvID string) ([]OutboxSET, error)
+}
+
+const (
+	// defaultMaxDeliveryAttempts は TransConf.MaxDeliveryAttempts が 0 の時の配送を試みる最大回数
+	defaultMaxDeliveryAttempts = 8
+	// deliveryBaseBackoff は配送に失敗した時に最初に待つ時間。失敗するたびに倍にする
+	deliveryBaseBackoff = time.Second
+	// deliveryMaxBackoff は配送に失敗した時に待つ最大の時間
+	deliveryMaxBackoff = 5 * time.Minute
+	// deliveryIdleInterval は配送待ちの SET がない時に Outbox を見直す間隔
+	deliveryIdleInterval = time.Minute
+	// deliveryTimeout は一度の配送で Receiver の応答を待つ時間。超えると失敗として再送する
+	deliveryTimeout = 30 * time.Second
+)
+
+// enqueue は recv 宛の SET を Outbox に入れて配送を促す
+func (tr *tr) enqueue(recv *Receiver, jti string, events json.RawMessage) error {
+	now := time.Now()
+	if err := tr.outbox.Save(&OutboxSET{
+		RecvID:      recv.ID,
+		StreamID:    recv.StreamConf.StreamID,
+		JTI:         jti,
+		Events:      events,
+		URL:         recv.StreamConf.Delivery.URL,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}); err != nil {
+		return err
+	}
+	tr.kickDelivery()
+	return nil
+}
+
+// kickDelivery は配送ループに Outbox を見直すよう伝える
+func (tr *tr) kickDelivery() {
+	select {
+	case tr.kick <- struct{}{}:
+	default:
+	}
+}
+
+// deliverLoop は Outbox の SET を配送し続ける
+func (tr *tr) deliverLoop() {
+	for {
+		wait := deliveryIdleInterval
+		if next, ok := tr.deliverDue(); ok {
+			if d := time.Until(next); d < wait {
+				wait = d
+			}
+		}
+		select {
+		case <-tr.kick:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deliverDue は配送時刻を迎えた SET のある Stream ごとに、並行して配送を始める
+// 一つの Stream の配送先が応答しなくても、他の Stream への配送は遅れない
+// まだ配送時刻を迎えていない SET があれば、その中で最も早い配送時刻を返す
+func (tr *tr) deliverDue() (next time.Time, ok bool) {
+	sets, err := tr.outbox.List("")
+	if err != nil {
+		fmt.Printf("Outbox の読み込みに失敗 %v\n", err)
+		return time.Now().Add(deliveryIdleInterval), true
+	}
+	sort.SliceStable(sets, func(i, j int) bool { return sets[i].CreatedAt.Before(sets[j].CreatedAt) })
+	byStream := make(map[string][]OutboxSET)
+	for _, s := range sets {
+		stream := s.RecvID + "/" + s.StreamID
+		byStream[stream] = append(byStream[stream], s)
+	}
+	for stream, sets := range byStream {
+		if t := sets[0].NextAttempt; time.Now().Before(t) {
+			if !ok || t.Before(next) {
+				next, ok = t, true
+			}
+			continue
+		}
+		if !tr.startDelivering(stream) {
+			// 配送中の Stream は、その配送が終わった時に見直す
+			continue
+		}
+		go func(stream string, sets []OutboxSET) {
+			defer tr.kickDelivery()
+			defer tr.finishDelivering(stream)
+			tr.deliverInOrder(sets)
+		}(stream, sets)
+	}
+	return next, ok
+}
+
+// deliverInOrder は一つの Stream 宛の SET を古いものから順に配送する
+// 配送に失敗したら後続は次の機会に回す
+func (tr *tr) deliverInOrder(sets []OutboxSET) {
+	for i := range sets {
+		s := &sets[i]
+		if time.Now().Before(s.NextAttempt) || !tr.deliver(s) {
+			return
+		}
+	}
+}
+
+// startDelivering は stream 宛の配送を始めてよければ配送中にして true を返す
+// stream は recvID/streamID で表す
+func (tr *tr) startDelivering(stream string) bool {
+	tr.deliveringM.Lock()
+	defer tr.deliveringM.Unlock()
+	if tr.delivering[stream] {
+		return false
+	}
+	tr.delivering[stream] = true
+	return true
+}
+
+func (tr *tr) finishDelivering(stream string) {
+	tr.deliveringM.Lock()
+	defer tr.deliveringM.Unlock()
+	delete(tr.delivering, stream)
+}
+
+// deliver は s を一度配送してみて、結果を Outbox に反映する
+// 配送できた時は true を返す
+func (tr *tr) deliver(s *OutboxSET) bool {
+	retryAfter, permanent, err := tr.push(s)
+	tr.recordDelivery(s.RecvID, s.JTI, err)
+	if err == nil {
+		fmt.Printf("送信に成功 recvID: %s -> jti: %s\n", s.RecvID, s.JTI)
+		if err := tr.outbox.Delete(s.RecvID, s.JTI); err != nil {
+			fmt.Printf("Outbox からの削除に失敗 recvID: %s jti: %s %v\n", s.RecvID, s.JTI, err)
+		}
+		return true
+	}
+	s.Attempts++
+	s.LastError = err.Error()
+	fmt.Printf("送信に失敗 (%d 回目) recvID: %s jti: %s %v\n", s.Attempts, s.RecvID, s.JTI, err)
+	if permanent || s.Attempts >= tr.maxAttempts {
+		// 諦めて dead letter に移す
+		if err := tr.outbox.SaveDeadLetter(s); err != nil {
+			fmt.Printf("dead letter への保存に失敗 recvID: %s jti: %s %v\n", s.RecvID, s.JTI, err)
+			return false
+		}
+		if err := tr.outbox.Delete(s.RecvID, s.JTI); err != nil {
+			fmt.Printf("Outbox からの削除に失敗 recvID: %s jti: %s %v\n", s.RecvID, s.JTI, err)
+		}
+		// dead letter に移した SET は後続の配送を妨げない
+		return true
+	}
+	wait := backoff(s.Attempts)
+	if retryAfter > 0 {
+		wait = retryAfter
+	}
+	s.NextAttempt = time.Now().Add(wait)
+	if err := tr.outbox.Save(s); err != nil {
+		fmt.Printf("Outbox の更新に失敗 recvID: %s jti: %s %v\n", s.RecvID, s.JTI, err)
+	}
+	return false
+}
+
+// push は s を署名して配送先に POST する
+func (tr *tr) push(s *OutboxSET) (retryAfter time.Duration, permanent bool, err error) {
+	recv, err := tr.recvRepo.Load(s.RecvID, s.StreamID)
+	if err != nil {
+		// Stream が削除されていれば送り直しても無駄
+		return 0, true, fmt.Errorf("配送先の Stream がない %v", err)
+	}
+	set, err := tr.sign(recv, s.JTI, s.Events)
+	if err != nil {
+		return 0, true, err
+	}
+	return tr.post(s.URL, set)
+}
+
+// recordDelivery は recvID 宛の配送の結果を記録する
+func (tr *tr) recordDelivery(recvID, jti string, err error) {
+	d := Delivery{JTI: jti, At: time.Now()}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	tr.deliveriesM.Lock()
+	defer tr.deliveriesM.Unlock()
+	tr.deliveries[recvID] = d
+}
+
+func (tr *tr) LastDelivery(recvID string) (*Delivery, bool) {
+	tr.deliveriesM.RLock()
+	defer tr.deliveriesM.RUnlock()
+	d, ok := tr.deliveries[recvID]
+	if !ok {
+		return nil, false
+	}
+	return &d, true
+}
+
+// post は SET を url に POST する
+// Receiver が Retry-After を返した時はその待ち時間も返す
+// Receiver が SET を受け付けられないと応答した時 (RFC 8935 Sec.2.3) は送り直しても無駄なので permanent を true にする
+func (tr *tr) post(url string, set []byte) (retryAfter time.Duration, permanent bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(set))
+	if err != nil {
+		return 0, true, err
+	}
+	req.Header.Set("Content-Type", "application/secevent+jwt")
+	resp, err := tr.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted {
+		return 0, false, nil
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		se := new(SetErr)
+		if err := json.NewDecoder(resp.Body).Decode(se); err != nil || se.Err == "" {
+			return 0, true, fmt.Errorf("Receiver が SET を受け付けなかった : %v", resp.Status)
+		}
+		return 0, true, fmt.Errorf("Receiver が SET を受け付けなかった %s: %s", se.Err, se.Description)
+	}
+	return parseRetryAfter(resp.Header.Get("Retry-After")), false, fmt.Errorf("respons status code unmatched : %v", resp.Status)
+}
+
+// backoff は attempts 回失敗した後に待つ時間を返す
+// 指数的に伸ばし、同時に失敗した SET が一斉に再送されないよう揺らぎを加える
+func backoff(attempts int) time.Duration {
+	d := deliveryMaxBackoff
+	if attempts <= 16 {
+		if b := deliveryBaseBackoff << uint(attempts-1); b < d {
+			d = b
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter は Retry-After ヘッダの値 (秒数か HTTP-date) を待ち時間に変換する
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// dropOutbox は削除された Stream 宛の配送待ちの SET を捨てる
+// 配送中の SET は配送先の Stream がないので dead letter に移る
+func (tr *tr) dropOutbox(recvID, streamID string) error {
+	sets, err := tr.outbox.List(recvID)
+	if err != nil {
+		return err
+	}
+	for _, s := range sets {
+		if s.StreamID != streamID {
+			continue
+		}
+		if err := tr.outbox.Delete(recvID, s.JTI); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tr *tr) Outbox(recvID string) ([]OutboxSET, error) {
+	return tr.outbox.List(recvID)
+}
+
+func (tr *tr) DeadLetters(recvID string) ([]OutboxSET, error) {
+	return tr.outbox.ListDeadLetters(recvID)
+}
+
+func (tr *tr) Replay(recvID, jti string) error {
+	sets, err := tr.outbox.ListDeadLetters(recvID)
+	if err != nil {
+		return err
+	}
+	for _, s := range sets {
+		if s.JTI != jti {
+			continue
+		}
+		// 配送方法や配送先が変わっているかもしれないので最新の設定を使う
+		recv, err := tr.recvRepo.Load(recvID, s.StreamID)
+		if err != nil {
+			return err
+		}
+		// Receiver が既に受け取った SET と区別できるよう jti を振り直す。 iat は配送する時に付け直す
+		newjti, err := newJTI()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("dead letter を配送し直す recvID: %s jti: %s -> %s\n", recvID, jti, newjti)
+		if recv.StreamConf.Delivery.DeliveryMethod == DeliveryMethodPoll {
+			// Poll 待ちの SET がまだ溢れていれば dead letter に残したままエラーを返す
+			if err := tr.polls.push(s.StreamID, newjti, s.Events); err != nil {
+				return err
+			}
+			return tr.outbox.DeleteDeadLetter(recvID, jti)
+		}
+		if recv.StreamConf.Delivery.URL != "" {
+			s.URL = recv.StreamConf.Delivery.URL
+		}
+		s.JTI = newjti
+		s.Attempts = 0
+		s.LastError = ""
+		s.NextAttempt = time.Now()
+		if err := tr.outbox.Save(&s); err != nil {
+			return err
+		}
+		if err := tr.outbox.DeleteDeadLetter(recvID, jti); err != nil {
+			return err
+		}
+		tr.kickDelivery()
+		return nil
+	}
+	return fmt.Errorf("recvID(%s) 宛の jti(%s) の SET は dead letter にない", recvID, jti)
+}
@@ -0,0 +1,301 @@
+package caep
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempts := 1; attempts <= 20; attempts++ {
+		max := deliveryMaxBackoff
+		if b := deliveryBaseBackoff << uint(attempts-1); attempts <= 16 && b < max {
+			max = b
+		}
+		for i := 0; i < 10; i++ {
+			if d := backoff(attempts); d < max/2 || d > max {
+				t.Fatalf("backoff(%d) = %v, want [%v, %v]", attempts, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("120"); d != 120*time.Second {
+		t.Errorf("秒数の Retry-After = %v", d)
+	}
+	if d := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); d < 58*time.Minute || d > time.Hour {
+		t.Errorf("HTTP-date の Retry-After = %v", d)
+	}
+	for _, v := range []string{"", "0", "-5", "soon", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)} {
+		if d := parseRetryAfter(v); d != 0 {
+			t.Errorf("parseRetryAfter(%q) = %v, want 0", v, d)
+		}
+	}
+}
+
+func TestDeliverDue(t *testing.T) {
+	// slow は release されるまで応答しない
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	got := make(chan string, 2)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		tok, err := jwt.ParseBytes(b)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got <- tok.JwtID()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer fast.Close()
+
+	tr := newOutboxTr(t)
+	for _, id := range []string{"slow", "fast", "later"} {
+		tr.recvRepo.Save(&Receiver{ID: id, Host: id + ".example", StreamConf: &StreamConfig{StreamID: id}})
+	}
+	now := time.Now()
+	events := json.RawMessage(`{}`)
+	tr.outbox.Save(&OutboxSET{RecvID: "slow", StreamID: "slow", JTI: "s1", Events: events, URL: slow.URL, CreatedAt: now, NextAttempt: now})
+	tr.outbox.Save(&OutboxSET{RecvID: "fast", StreamID: "fast", JTI: "f2", Events: events, URL: fast.URL, CreatedAt: now.Add(time.Millisecond), NextAttempt: now})
+	tr.outbox.Save(&OutboxSET{RecvID: "fast", StreamID: "fast", JTI: "f1", Events: events, URL: fast.URL, CreatedAt: now, NextAttempt: now})
+	tr.outbox.Save(&OutboxSET{RecvID: "later", StreamID: "later", JTI: "l1", Events: events, URL: fast.URL, CreatedAt: now, NextAttempt: now.Add(time.Hour)})
+
+	next, ok := tr.deliverDue()
+	if !ok || !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("次の配送時刻 = %v %v, want %v", next, ok, now.Add(time.Hour))
+	}
+	// slow が応答しなくても fast 宛の SET は古いものから順に届く
+	for _, want := range []string{"f1", "f2"} {
+		select {
+		case jti := <-got:
+			if jti != want {
+				t.Errorf("配送された SET = %s, want %s", jti, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("slow の配送を待って %s が配送されない", want)
+		}
+	}
+	// 配送中の Stream の配送は重ねて始めない
+	if tr.startDelivering("slow/slow") {
+		t.Error("配送中の Stream の配送を始められた")
+	}
+}
+
+// 配送を待っている間に時間が経っても、 SET は配送する時の時刻で署名する
+func TestDeliverSignsOnDelivery(t *testing.T) {
+	var got jwt.Token
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got, _ = jwt.ParseBytes(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	tr := newOutboxTr(t)
+	tr.recvRepo.Save(&Receiver{ID: "recv", Host: "recv.example", StreamConf: &StreamConfig{StreamID: "recv"}})
+	s := &OutboxSET{RecvID: "recv", StreamID: "recv", JTI: "jti1", Events: json.RawMessage(`{}`), URL: srv.URL, CreatedAt: time.Now().Add(-3 * time.Hour)}
+	tr.outbox.Save(s)
+	if !tr.deliver(s) {
+		t.Fatal("配送に失敗")
+	}
+	if got == nil || got.JwtID() != "jti1" {
+		t.Fatalf("配送された SET = %v", got)
+	}
+	if age := time.Since(got.IssuedAt()); age > time.Minute {
+		t.Errorf("iat が配送時刻でない (%v 前)", age)
+	}
+	if sets, _ := tr.Outbox("recv"); len(sets) != 0 {
+		t.Errorf("配送した SET が Outbox に残っている %d", len(sets))
+	}
+}
+
+func TestReplay(t *testing.T) {
+	tr := newOutboxTr(t)
+	for id, method := range map[string]string{"push": DeliveryMethodPush, "poll": DeliveryMethodPoll} {
+		recv := &Receiver{ID: id, StreamConf: &StreamConfig{StreamID: id}}
+		recv.StreamConf.Delivery.DeliveryMethod = method
+		recv.StreamConf.Delivery.URL = "https://" + id + ".example/set"
+		tr.recvRepo.Save(recv)
+	}
+	tr.outbox.SaveDeadLetter(&OutboxSET{RecvID: "push", StreamID: "push", JTI: "jti1", Events: json.RawMessage(`{}`), URL: "https://old.example/set", Attempts: defaultMaxDeliveryAttempts, LastError: "503"})
+	tr.outbox.SaveDeadLetter(&OutboxSET{RecvID: "poll", StreamID: "poll", JTI: "jti2", Events: json.RawMessage(`{}`)})
+
+	if err := tr.Replay("push", "unknown"); err == nil {
+		t.Error("dead letter にない jti を Replay できた")
+	}
+	if err := tr.Replay("push", "jti1"); err != nil {
+		t.Fatal(err)
+	}
+	sets, _ := tr.Outbox("push")
+	if len(sets) != 1 {
+		t.Fatalf("Outbox = %d 件, want 1", len(sets))
+	}
+	if s := sets[0]; s.Attempts != 0 || s.LastError != "" || s.URL != "https://push.example/set" {
+		t.Errorf("Replay した SET = %+v", s)
+	}
+	// Receiver が前に受け取ったものと区別できるよう jti を振り直す
+	if sets[0].JTI == "jti1" {
+		t.Error("Replay した SET の jti が元のまま")
+	}
+
+	// Poll の Receiver 宛の SET は Poll 待ちに戻す
+	if err := tr.Replay("poll", "jti2"); err != nil {
+		t.Fatal(err)
+	}
+	if queued, _ := tr.polls.peek("poll", 10); len(queued) != 1 || queued[0].jti == "jti2" {
+		t.Errorf("Poll 待ちの SET = %+v", queued)
+	}
+	if dead, _ := tr.DeadLetters(""); len(dead) != 0 {
+		t.Errorf("dead letters = %d 件, want 0", len(dead))
+	}
+}
+
+func TestTransmitPollOverflow(t *testing.T) {
+	tr := newOutboxTr(t)
+	recv := Receiver{ID: "poll", StreamConf: &StreamConfig{StreamID: "stream1"}}
+	recv.StreamConf.Delivery.DeliveryMethod = DeliveryMethodPoll
+	tr.recvRepo.Save(&recv)
+	for i := 0; i < pollQueueLimit; i++ {
+		tr.polls.push(recv.StreamConf.StreamID, fmt.Sprintf("jti%d", i), json.RawMessage(`{}`))
+	}
+	if err := tr.transmit([]Receiver{recv}, &VerificationEvent{State: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	// 溢れた SET は捨てずに dead letter で確認できる
+	dead, _ := tr.DeadLetters(recv.ID)
+	if len(dead) != 1 || dead[0].StreamID != "stream1" || dead[0].LastError == "" {
+		t.Errorf("dead letters = %+v", dead)
+	}
+	// Receiver が追いつくまで Stream を paused にする
+	if cur, _ := tr.recvRepo.Load(recv.ID, "stream1"); cur.status() != StatusPaused || cur.StatusReason != pollOverflowReason {
+		t.Errorf("溢れた Stream の status = %s (%s)", cur.status(), cur.StatusReason)
+	}
+}
+
+func newOutboxTr(t *testing.T) *tr {
+	s, err := newSigner(jwa.ES256, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tr{
+		signer:      s,
+		conf:        &Transmitter{},
+		recvRepo:    &memRecvs{db: make(map[string]*Receiver)},
+		statusRepo:  &memStatuses{db: make(map[string]StreamStatus)},
+		polls:       newPollQueue(),
+		outbox:      &memOutbox{db: make(map[string]OutboxSET), dead: make(map[string]OutboxSET)},
+		maxAttempts: defaultMaxDeliveryAttempts,
+		kick:        make(chan struct{}, 1),
+		delivering:  make(map[string]bool),
+		held:        newHoldQueue(),
+		client:      http.DefaultClient,
+		deliveries:  make(map[string]Delivery),
+	}
+}
+
+// memRecvs は recvID/streamID で Stream を保持する
+type memRecvs struct {
+	db map[string]*Receiver
+}
+
+func (r *memRecvs) Registration(recvID string) (*Receiver, error) {
+	return nil, fmt.Errorf("recvID(%s) は登録されていない", recvID)
+}
+
+func (r *memRecvs) Load(recvID, streamID string) (*Receiver, error) {
+	recv, ok := r.db[recvID+"/"+streamID]
+	if !ok {
+		return nil, fmt.Errorf("recvID(%s) には stream(%s) がない", recvID, streamID)
+	}
+	return recv, nil
+}
+
+func (r *memRecvs) List(recvID string) ([]Receiver, error) {
+	var ret []Receiver
+	for _, recv := range r.db {
+		if recv.ID == recvID {
+			ret = append(ret, *recv)
+		}
+	}
+	return ret, nil
+}
+
+func (r *memRecvs) Save(recv *Receiver) error {
+	r.db[recv.ID+"/"+recv.StreamConf.StreamID] = recv
+	return nil
+}
+
+func (r *memRecvs) Delete(recvID, streamID string) error {
+	delete(r.db, recvID+"/"+streamID)
+	return nil
+}
+
+// memOutbox は配送ループから並行に使われる
+type memOutbox struct {
+	m    sync.Mutex
+	db   map[string]OutboxSET // recvID/jti -> SET
+	dead map[string]OutboxSET
+}
+
+func (o *memOutbox) Save(set *OutboxSET) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.db[set.RecvID+"/"+set.JTI] = *set
+	return nil
+}
+
+func (o *memOutbox) Delete(recvID, jti string) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	delete(o.db, recvID+"/"+jti)
+	return nil
+}
+
+func (o *memOutbox) List(recvID string) ([]OutboxSET, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return filterOutbox(o.db, recvID), nil
+}
+
+func (o *memOutbox) SaveDeadLetter(set *OutboxSET) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.dead[set.RecvID+"/"+set.JTI] = *set
+	return nil
+}
+
+func (o *memOutbox) DeleteDeadLetter(recvID, jti string) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	delete(o.dead, recvID+"/"+jti)
+	return nil
+}
+
+func (o *memOutbox) ListDeadLetters(recvID string) ([]OutboxSET, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return filterOutbox(o.dead, recvID), nil
+}
+
+func filterOutbox(db map[string]OutboxSET, recvID string) []OutboxSET {
+	var ret []OutboxSET
+	for _, s := range db {
+		if recvID == "" || s.RecvID == recvID {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
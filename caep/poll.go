@@ -0,0 +1,359 @@
+package caep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// DeliveryMethodPush は Transmitter が Receiver へ SET を POST する配送方法 (RFC 8935)
+	DeliveryMethodPush = "https://schemas.openid.net/secevent/risc/delivery-method/push"
+	// DeliveryMethodPoll は Receiver が Transmitter から SET を取りに行く配送方法 (RFC 8936)
+	DeliveryMethodPoll = "https://schemas.openid.net/secevent/risc/delivery-method/poll"
+)
+
+// ReqPoll は RFC 8936 の Poll 要求を表す
+type ReqPoll struct {
+	// MaxEvents は一度に受け取る SET の最大数。 nil の時は Transmitter が決める
+	MaxEvents *int `json:"maxEvents,omitempty"`
+	// ReturnImmediately が false の時、 Transmitter は SET が溜まるまで応答を待たせることができる
+	ReturnImmediately bool `json:"returnImmediately"`
+	// Acks は受け取りに成功した SET の jti
+	Acks []string `json:"ack,omitempty"`
+	// SetErrs は受け取りに失敗した SET の jti とその理由
+	SetErrs map[string]SetErr `json:"setErrs,omitempty"`
+}
+
+// SetErr は Receiver が SET を処理できなかった理由を表す
+// Push (RFC 8935) の 400 応答と Poll (RFC 8936) の setErrs で使う
+type SetErr struct {
+	Err         string `json:"err"`
+	Description string `json:"description"`
+}
+
+// RespPoll は RFC 8936 の Poll 応答を表す
+type RespPoll struct {
+	// Sets は jti をキーにした SET
+	Sets map[string]string `json:"sets"`
+	// MoreAvailable は Transmitter にまだ SET が残っているかを表す
+	MoreAvailable bool `json:"moreAvailable,omitempty"`
+}
+
+const (
+	// pollQueueLimit は Stream ごとに Transmitter が保持する SET の最大数
+	pollQueueLimit = 1000
+	// pollOverflowReason は Poll 待ちの SET が溢れて Transmitter が Stream を paused にした時の reason
+	// Receiver が pollQueueLimit の半分まで受け取ったら enabled に戻す
+	pollOverflowReason = "Poll 待ちの SET が上限に達した"
+	// pollDefaultMaxEvents は Receiver が maxEvents を指定しなかった時に返す SET の最大数
+	pollDefaultMaxEvents = 100
+	// pollLongPollingTimeout は returnImmediately が false の時に SET を待つ最大の時間
+	pollLongPollingTimeout = 30 * time.Second
+)
+
+// pollQueue は Poll で配送する SET を Stream ごとに保持する
+// ack されるまで SET は残り続ける
+type pollQueue struct {
+	m      sync.Mutex
+	q      map[string][]queuedSET // streamID -> SETs
+	notify map[string]chan struct{}
+}
+
+// queuedSET は Poll で配送待ちの SET 。 Receiver が取りに来た時に署名する
+type queuedSET struct {
+	jti    string
+	events json.RawMessage
+}
+
+func newPollQueue() *pollQueue {
+	return &pollQueue{
+		q:      make(map[string][]queuedSET),
+		notify: make(map[string]chan struct{}),
+	}
+}
+
+// push は streamID 宛の SET を保持する
+// 上限に達している時は保持している SET を捨てずに、新しい SET を受け付けずにエラーを返す
+func (q *pollQueue) push(streamID, jti string, events json.RawMessage) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if len(q.q[streamID]) >= pollQueueLimit {
+		return fmt.Errorf("stream(%s) の Poll 待ちの SET が上限(%d)に達している", streamID, pollQueueLimit)
+	}
+	q.q[streamID] = append(q.q[streamID], queuedSET{jti, events})
+	if ch, ok := q.notify[streamID]; ok {
+		close(ch)
+		delete(q.notify, streamID)
+	}
+	return nil
+}
+
+// peek は streamID 宛の SET を古いものから max 件返す
+func (q *pollQueue) peek(streamID string, max int) (sets []queuedSET, more bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for i, s := range q.q[streamID] {
+		if i >= max {
+			return sets, true
+		}
+		sets = append(sets, s)
+	}
+	return sets, false
+}
+
+// ack は streamID 宛の SET のうち jtis に含まれるものを取り除く
+func (q *pollQueue) ack(streamID string, jtis []string) {
+	if len(jtis) == 0 {
+		return
+	}
+	q.m.Lock()
+	defer q.m.Unlock()
+	var rest []queuedSET
+	for _, s := range q.q[streamID] {
+		if !contains(jtis, s.jti) {
+			rest = append(rest, s)
+		}
+	}
+	q.q[streamID] = rest
+}
+
+// wait は streamID 宛の SET がない時に、新しく push されると閉じられるチャネルを返す
+// 既に SET があれば nil を返す。 SET の有無の確認とチャネルの登録は同じロックの中で行い、その間の push を取りこぼさない
+func (q *pollQueue) wait(streamID string) <-chan struct{} {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if len(q.q[streamID]) > 0 {
+		return nil
+	}
+	ch, ok := q.notify[streamID]
+	if !ok {
+		ch = make(chan struct{})
+		q.notify[streamID] = ch
+	}
+	return ch
+}
+
+// len は streamID 宛に保持している SET の数を返す
+func (q *pollQueue) len(streamID string) int {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return len(q.q[streamID])
+}
+
+// drop は削除された Stream 宛の SET を捨てる
+func (q *pollQueue) drop(streamID string) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	delete(q.q, streamID)
+	if ch, ok := q.notify[streamID]; ok {
+		close(ch)
+		delete(q.notify, streamID)
+	}
+}
+
+// pollURLFor は streamID の Stream の Poll エンドポイントを返す
+func (tr *tr) pollURLFor(streamID string) string {
+	u, err := url.Parse(tr.pollURL)
+	if err != nil {
+		return tr.pollURL
+	}
+	q := u.Query()
+	q.Set("stream_id", streamID)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Poll は RFC 8936 の Poll エンドポイントとして Receiver に SET を返す
+func (tr *tr) Poll(w http.ResponseWriter, r *http.Request) {
+	// 要求をパースする
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if contentType != "application/json" {
+		http.Error(w, "unmached content-type", http.StatusBadRequest)
+		return
+	}
+	req := new(ReqPoll)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("フォーマットに失敗 %v", err), http.StatusBadRequest)
+		return
+	}
+	// Token の検証をして、対応する Receiver を識別する (Sec.9)
+	recvID, err := tr.verifier.Stream(r.Context(), r.Header.Get("Authorization"))
+	if err != nil {
+		if err, ok := err.(TransError); ok {
+			if err.Code() == TransErrorUnAuthorized {
+				headers := err.Option().(map[string]string)
+				for k, v := range headers {
+					w.Header().Set(k, v)
+				}
+			}
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	recv, err := tr.stream(recvID, r.URL.Query().Get("stream_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	streamID := recv.StreamConf.StreamID
+
+	// 受け取りの成否が報告された SET は取り除く
+	tr.polls.ack(streamID, req.Acks)
+	var errjtis []string
+	for jti, e := range req.SetErrs {
+		fmt.Printf("recvID(%s) は SET(jti: %s) の受け取りに失敗 %s: %s\n", recvID, jti, e.Err, e.Description)
+		errjtis = append(errjtis, jti)
+	}
+	tr.polls.ack(streamID, errjtis)
+	// 溢れたので Transmitter が paused にした Stream は、 Receiver が追いついたら enabled に戻す
+	if recv.status() == StatusPaused && recv.StatusReason == pollOverflowReason && tr.polls.len(streamID) <= pollQueueLimit/2 {
+		if _, err := tr.changeStatus(recv, nil, StatusEnabled, "Poll 待ちの SET が減った", StatusChangedByTransmitter); err != nil {
+			fmt.Printf("stream(%s) を enabled に戻せない %v\n", streamID, err)
+		}
+	}
+
+	max := pollDefaultMaxEvents
+	if req.MaxEvents != nil {
+		max = *req.MaxEvents
+	}
+	resp := &RespPoll{Sets: make(map[string]string)}
+	if max > 0 {
+		if !req.ReturnImmediately {
+			// SET が届くまで待つ (Long Polling)
+			if ch := tr.polls.wait(streamID); ch != nil {
+				select {
+				case <-ch:
+				case <-time.After(pollLongPollingTimeout):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		var sets []queuedSET
+		sets, resp.MoreAvailable = tr.polls.peek(streamID, max)
+		for _, s := range sets {
+			set, err := tr.sign(recv, s.jti, s.events)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.Sets[s.jti] = string(set)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// StartPolling は Transmitter から SET を取りに行くループを開始する
+// 受け取った SET のイベントは登録された handler に渡し、その成否を次の Poll で Transmitter に伝える
+// handler が失敗した SET は ack も setErrs も返さずに残しておき、次の Poll で受け取り直す
+// ctx が終わるとループを止める
+func (recv *recv) StartPolling(ctx context.Context) {
+	go func() {
+		var acks []string
+		errs := make(map[string]SetErr)
+		for ctx.Err() == nil {
+			resp, err := recv.poll(ctx, &ReqPoll{Acks: acks, SetErrs: errs})
+			if err != nil {
+				fmt.Printf("SET の Poll に失敗 %v\n", err)
+				select {
+				case <-time.After(pollRetryInterval):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			acks = nil
+			errs = make(map[string]SetErr)
+			retry := false
+			for jti, set := range resp.Sets {
+				recv.m.RLock()
+				rs, err := recv.parse(ctx, []byte(set))
+				recv.m.RUnlock()
+				if err != nil {
+					// 受け取り直しても受け付けられないので Transmitter に捨ててもらう
+					errs[jti] = *setErrOf(err)
+					continue
+				}
+				if err := recv.accept(ctx, rs); err != nil {
+					fmt.Printf("SET(jti: %s) の処理に失敗したので後で受け取り直す %v\n", jti, err)
+					retry = true
+					continue
+				}
+				acks = append(acks, jti)
+			}
+			if retry {
+				// 残した SET はすぐに返ってくるので、少し待ってから受け取り直す
+				time.Sleep(pollRetryInterval)
+			}
+		}
+	}()
+}
+
+// pollRetryInterval は Poll をやり直すまで待つ時間
+const pollRetryInterval = 10 * time.Second
+
+// pollTimeout は一度の Poll で応答を待つ時間
+// Transmitter は SET が溜まるまで pollLongPollingTimeout だけ応答を待たせることがある
+const pollTimeout = pollLongPollingTimeout + 10*time.Second
+
+// poll は Transmitter の Poll エンドポイントに req を送る
+// stream の配送方法が Poll に設定されるまではエラーを返す
+func (recv *recv) poll(ctx context.Context, reqpoll *ReqPoll) (*RespPoll, error) {
+	recv.m.RLock()
+	delivery := recv.recv.StreamConf.Delivery
+	recv.m.RUnlock()
+	if delivery.DeliveryMethod != DeliveryMethodPoll || delivery.URL == "" {
+		return nil, fmt.Errorf("stream の配送方法がまだ Poll に設定されていない")
+	}
+	ctx, cancel := context.WithTimeout(ctx, pollTimeout)
+	defer cancel()
+	bodyJSON, err := json.Marshal(reqpoll)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", delivery.URL, bytes.NewBuffer(bodyJSON))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := recv.doConfigWith(recv.pollClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, newEO(fmt.Errorf("401"), RecvErrorCodeUnAuthorized, resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("poll failed statuscode: %v", resp.StatusCode)
+	}
+	ret := new(RespPoll)
+	if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// setErrOf は err を Transmitter に伝える SET を受け付けられない理由に変換する
+func setErrOf(err error) *SetErr {
+	if e, ok := err.(RecvError); ok && e.Code() == RecvErrorCodeInvalidSET {
+		if se, ok := e.Option().(*SetErr); ok {
+			return se
+		}
+	}
+	return &SetErr{SetErrInvalidRequest, err.Error()}
+}
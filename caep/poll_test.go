@@ -0,0 +1,51 @@
+package caep
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestPollQueueOverflow(t *testing.T) {
+	q := newPollQueue()
+	for i := 0; i < pollQueueLimit; i++ {
+		if err := q.push("recv", fmt.Sprintf("jti%d", i), json.RawMessage(`{}`)); err != nil {
+			t.Fatalf("上限に達する前に push() = %v", err)
+		}
+	}
+	if err := q.push("recv", "overflow", json.RawMessage(`{}`)); err == nil {
+		t.Fatal("上限を超えた SET を受け付けた")
+	}
+	// 溢れても保持している SET は捨てない
+	sets, more := q.peek("recv", pollQueueLimit+1)
+	if len(sets) != pollQueueLimit || more {
+		t.Errorf("保持している SET = %d 件, more = %v", len(sets), more)
+	}
+	if sets[0].jti != "jti0" || sets[len(sets)-1].jti == "overflow" {
+		t.Errorf("保持している SET の範囲 %s..%s", sets[0].jti, sets[len(sets)-1].jti)
+	}
+	// ack で空きができれば再び受け付ける
+	q.ack("recv", []string{"jti0"})
+	if err := q.push("recv", "overflow", json.RawMessage(`{}`)); err != nil {
+		t.Errorf("ack した後の push() = %v", err)
+	}
+}
+
+func TestPollQueueWait(t *testing.T) {
+	q := newPollQueue()
+	ch := q.wait("recv")
+	if ch == nil {
+		t.Fatal("SET がないのに待たない")
+	}
+	if err := q.push("recv", "jti", json.RawMessage(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ch:
+	default:
+		t.Fatal("push されても待ちが解けない")
+	}
+	if q.wait("recv") != nil {
+		t.Error("SET があるのに待つ")
+	}
+}
@@ -2,15 +2,19 @@ package caep
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"mime"
 	"net/http"
 	"net/url"
-	"path"
 	"sync"
+	"time"
 
-	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/hatake5051/ztf-prototype/internal/wellknown"
 	"github.com/lestrrat-go/jwx/jwt"
 )
 
@@ -22,51 +26,153 @@ type RecvConf struct {
 	RecvEndpoint string
 	// Issuer は Transmitter のホスト名
 	Issuer string
+	// Encryption が nil でなければ Transmitter に SET の暗号化を求める
+	Encryption *RecvEncryptionConf
+	// Poll が true の時は Push ではなく Poll で SET を受け取る (RFC 8936)
+	// その時 RecvEndpoint は使わず、 StartPolling で受け取る
+	Poll bool
+	// MaxClockSkew は SET の iat や toe が未来を指していても許容する時間。 0 の時は 5 分
+	MaxClockSkew time.Duration
+	// MaxAge は SET の iat からどれだけ経つまで受け付けるか。 0 の時は 1 時間
+	MaxAge time.Duration
+	// HTTPClient は Transmitter へのアクセスに使う。 nil の時は http.DefaultClient
+	HTTPClient *http.Client
+}
+
+const (
+	defaultMaxClockSkew = 5 * time.Minute
+	defaultMaxAge       = time.Hour
+)
+
+// JTIStore は Receiver が処理した SET の jti を記録し、同じ SET が再送 (リプレイ) されていないか確かめる
+type JTIStore interface {
+	// Reserve は jti が記録されていなければ exp まで記録して true を返す。記録済みであれば false を返す
+	// 確かめることと記録することは不可分に行い、同じ SET が同時に届いても一方だけが true を受け取る
+	Reserve(jti string, exp time.Time) (bool, error)
+	// Release は Reserve した jti の記録を取り消す。 SET の処理に失敗して再送を受け付ける時に呼ぶ
+	Release(jti string) error
 }
 
 // New は Recv を返す
 // t は stream config/status endpoit の保護に使う OAuth-AccessToken を保持
 // uc は sub add endpoint の保護に使う UMA-RPT を保持
 // set は receive event を context に変換して保存する
-func (conf *RecvConf) New(authHeadersetter AuthHeaderSetter) Recv {
-	tr, err := NewTransmitterFetced(conf.Issuer)
+// jtis は受け取った SET の jti を記録する
+// Transmitter の設定情報は最初に必要になった時に取得するので、 Transmitter が落ちていても構築できる
+func (conf *RecvConf) New(authHeadersetter AuthHeaderSetter, jtis JTIStore) Recv {
+	client := httpClientOr(conf.HTTPClient)
+	disc, err := transmitterDoc(client, conf.Issuer)
 	if err != nil {
-		panic(fmt.Sprintf("Transmitterの設定情報の取得に失敗 %v", err))
+		panic(fmt.Sprintf("Transmitterの issuer(%s) が正しくない %v", conf.Issuer, err))
 	}
 	r := &Receiver{
-		Host: conf.Host,
-		StreamConf: &StreamConfig{
-			Delivery: struct {
-				DeliveryMethod string `json:"delivery_method"`
-				URL            string `json:"url"`
-			}{"https://schemas.openid.net/secevent/risc/delivery-method/push", conf.RecvEndpoint},
-		},
+		Host:       conf.Host,
+		StreamConf: &StreamConfig{},
+	}
+	if conf.Poll {
+		// Poll の時の配送先は Transmitter が決める
+		r.StreamConf.Delivery.DeliveryMethod = DeliveryMethodPoll
+	} else {
+		r.StreamConf.Delivery.DeliveryMethod = DeliveryMethodPush
+		r.StreamConf.Delivery.URL = conf.RecvEndpoint
+	}
+	var dec *decrypter
+	if conf.Encryption != nil {
+		dec, err = conf.Encryption.new()
+		if err != nil {
+			panic(fmt.Sprintf("SET の復号鍵の構成に失敗 %v", err))
+		}
+		r.StreamConf.Encryption = dec.conf
+	}
+	skew := conf.MaxClockSkew
+	if skew <= 0 {
+		skew = defaultMaxClockSkew
+	}
+	maxAge := conf.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultMaxAge
 	}
 	return &recv{
-		tr:           tr,
+		issuer:       conf.Issuer,
+		disc:         disc,
 		recv:         r,
 		setAuthHeder: authHeadersetter,
+		client:       client,
+		pollClient:   longPollClient(client),
+		keys:         &keySet{client: client},
+		dec:          dec,
+		jtis:         jtis,
+		skew:         skew,
+		maxAge:       maxAge,
+		handlers:     newHandlers(),
 	}
 }
 
 // Recv は caep.Receiver の働きをする
+// Stream を指定する引数や要求の stream_id が空の時は SetUpStream で用意した Stream を使う
+// Transmitter へのアクセスは ctx が終わると打ち切る
 type Recv interface {
-	// SetUpStream は StreamConfig を最新のものにして、更新も行う
-	SetUpStream(conf *StreamConfig) error
-	// ReadStreamStatus は Get /set/status/{spag_id} する
-	ReadStreamStatus(spagID string) (*StreamStatus, error)
-	// UpdateStreamStatus(status *StreamStatus) error
+	// SetUpStream はこの Receiver の配送方法に合う Stream を探し、なければ作る
+	// conf の events_requested はこれまでのものに加え、変更があれば Transmitter の設定も更新する
+	SetUpStream(ctx context.Context, conf *StreamConfig) error
+	// StreamID は SetUpStream で用意した Stream の stream_id を返す
+	StreamID() string
+	// CreateStream は POST /set/stream して新しい Stream を作る
+	CreateStream(ctx context.Context, conf *StreamConfig) (*StreamConfig, error)
+	// ReadStream は GET /set/stream?stream_id= して Stream の設定を得る
+	ReadStream(ctx context.Context, streamID string) (*StreamConfig, error)
+	// ListStreams は GET /set/stream して Receiver の全ての Stream の設定を得る
+	ListStreams(ctx context.Context) ([]StreamConfig, error)
+	// UpdateStream は PATCH /set/stream して conf.StreamID の Stream の設定のうち conf で値のあるものだけを更新する
+	// スライスは丸ごと置き換わるので、 events_requested から取り除くこともできる
+	UpdateStream(ctx context.Context, conf *StreamConfig) (*StreamConfig, error)
+	// ReplaceStream は PUT /set/stream して conf.StreamID の Stream の設定を conf で置き換える
+	ReplaceStream(ctx context.Context, conf *StreamConfig) (*StreamConfig, error)
+	// DeleteStream は DELETE /set/stream?stream_id= して Stream を削除する
+	DeleteStream(ctx context.Context, streamID string) error
+	// ReadStreamStatus は Get /set/status?stream_id=&subject= して sub の status を得る
+	// sub が nil の時は Stream 全体の status を得る
+	ReadStreamStatus(ctx context.Context, streamID string, sub *Subject) (*StreamStatus, error)
+	// UpdateStreamStatus は POST /set/status してサブジェクトの status を変更する
+	// subject が空の時は Stream 全体の status を変更する
+	UpdateStreamStatus(ctx context.Context, req *ReqChangeOfStreamStatus) (*StreamStatus, error)
 	// AddSubject は POST /set/subjects:add する
-	AddSubject(*ReqAddSub) error
-	// Recv は コンテキストを受け取る
-	Recv(*http.Request) (*SSEEventClaim, error)
+	AddSubject(ctx context.Context, req *ReqAddSub) error
+	// RemoveSubject は POST /set/subjects:remove する
+	RemoveSubject(ctx context.Context, req *ReqRemoveSub) error
+	// Verify は POST /set/verify して Transmitter に Verification Event を送るよう要求する
+	Verify(ctx context.Context, req *ReqVerification) error
+	// VerifyRoundTrip は Verification Event を要求し、 timeout 以内にそれを受け取れたかを返す
+	// 受け取れなかった時は RecvErrorCodeVerificationTimeout のエラーを返す
+	VerifyRoundTrip(ctx context.Context, timeout time.Duration) error
+	// Handle は eventType のイベントを受け取った時に handler を呼ぶよう登録する
+	// eventType にはイベントの種類の URI 、コンテキストの識別子、 ContextEventType 、 DefaultEventType を指定できる
+	// イベントはコンテキストの変更は *SSEEventClaim 、 Verification Event は *VerificationEvent など種類ごとの型で渡す
+	// 解釈できない種類のイベントは *RawEvent で渡す
+	Handle(eventType string, handler EventHandler)
+	// Use は全ての handler を mws で包む。先に登録したものほど外側になる
+	Use(mws ...EventMiddleware)
+	// Recv は SET を受け取り、それに含まれる全てのイベントを順に登録された handler に渡す
+	// SET を受け付けられない時は RecvErrorCodeInvalidSET のエラーを、 handler が失敗した時はそのエラーを返す
+	// handler が失敗した SET は Transmitter が再送すれば改めて受け取る
+	Recv(*http.Request) error
+	// StartPolling は Poll で SET を受け取るループを開始し、 SET ごとにそのイベントを登録された handler に渡す
+	// handler がエラーを返した SET は受け取りに失敗したと Transmitter に伝える
+	// ループは ctx が終わると止まる
+	StartPolling(ctx context.Context)
 }
 
 // AuthHeaderSetter は Receiver が Stream Mgmt API にアクセスする時のトークンを付与する
 // 付与することができない時はそのまま
 type AuthHeaderSetter interface {
 	ForConfig(r *http.Request)
-	ForSubAdd(spagID string, r *http.Request)
+	ForSubAdd(sub *Subject, r *http.Request)
+}
+
+// AuthHeaderRefresher は ForConfig で設定したトークンを取り直せる AuthHeaderSetter を表す
+// AuthHeaderSetter がこれを満たしていると、 Stream Management API が 401 を返した時にトークンを取り直して一度だけ再送する
+type AuthHeaderRefresher interface {
+	RefreshForConfig() error
 }
 
 // RecvError は error を表す
@@ -85,33 +191,156 @@ const (
 	// option として *http.Response が含まれるが、Body は読めない
 	RecvErrorCodeUnAuthorized
 	_
-	_
+	// RecvErrorCodeForbidden は 403 error
+	// add subject の時は提示した RPT で認可されなかったことを表す
+	RecvErrorCodeForbidden
 	// RecvErrorCodeNotFound は 404 error
 	RecvErrorCodeNotFound
+	// RecvErrorCodeVerificationTimeout は Verification Event が期限内に届かなかったことを表す
+	// 408 Request Timeout に対応させる
+	RecvErrorCodeVerificationTimeout RecvErrorCode = http.StatusRequestTimeout
+	// RecvErrorCodeInvalidSET は受け取った SET を受け付けられないことを表す
+	// option として RFC 8935 Sec.2.3 のエラー応答 *SetErr が含まれる
+	RecvErrorCodeInvalidSET RecvErrorCode = http.StatusBadRequest
+	// RecvErrorCodeUnavailable は Transmitter の設定情報を取得できず、 Transmitter にアクセスできないことを表す
+	// option として Transmitter の issuer string が含まれる
+	RecvErrorCodeUnavailable RecvErrorCode = http.StatusServiceUnavailable
 )
 
+// RFC 8935 Sec.2.4 で定められた SET を受け付けられない理由
+const (
+	// SetErrInvalidRequest は SET のフォーマットや内容が不正であることを表す
+	SetErrInvalidRequest = "invalid_request"
+	// SetErrInvalidKey は SET の復号や署名検証に使う鍵が不明か不正であることを表す
+	SetErrInvalidKey = "invalid_key"
+	// SetErrInvalidIssuer は SET の iss が不正であることを表す
+	SetErrInvalidIssuer = "invalid_issuer"
+	// SetErrInvalidAudience は SET の aud が不正であることを表す
+	SetErrInvalidAudience = "invalid_audience"
+	// SetErrAuthenticationFailed は SET の署名検証に失敗したことを表す
+	SetErrAuthenticationFailed = "authentication_failed"
+)
+
+// newSetErr は SET を受け付けられない理由 code を含んだ RecvError を返す
+func newSetErr(code string, err error) RecvError {
+	return newEO(err, RecvErrorCodeInvalidSET, &SetErr{Err: code, Description: err.Error()})
+}
+
 type recv struct {
-	// tr は caep.Transmitter の設定情報を含む
-	tr *Transmitter
+	// issuer は Transmitter の issuer
+	issuer string
+	// disc は Transmitter の設定情報を必要になった時に取得してキャッシュする
+	disc *wellknown.Doc
 	// recv は Receiver の設定情報を持つ。Read-Write able
 	recv *Receiver
 	m    sync.RWMutex
 	// recvOauth は stream config/status endpoit の保護に使う OAuth-AccessToken を保持
 	setAuthHeder AuthHeaderSetter
+	// client は Transmitter へのアクセスに使う
+	client *http.Client
+	// pollClient は Poll に使う。 Transmitter が応答を待たせる間に client の Timeout で打ち切らない
+	pollClient *http.Client
+	// keys は Transmitter の SET 検証用公開鍵をキャッシュする
+	keys *keySet
+	// dec は暗号化された SET を復号する。 nil の時は暗号化を求めていない
+	dec *decrypter
+	// jtis は受け取った SET の jti を記録し、リプレイを防ぐ
+	jtis JTIStore
+	// skew と maxAge は SET の iat が受け付けられる範囲を決める
+	skew   time.Duration
+	maxAge time.Duration
+	// verifications は Verification Event を待っている state とその到着を知らせるチャネル
+	vm            sync.Mutex
+	verifications map[string]chan struct{}
+	// handlers は受け取ったイベントを種類ごとに処理する
+	handlers *handlers
+}
+
+// transmitter は Transmitter の設定情報を返す。まだ取得できていなければ取得する
+// 取得できない時は RecvErrorCodeUnavailable のエラーを返す
+func (recv *recv) transmitter(ctx context.Context) (*Transmitter, error) {
+	v, err := recv.disc.Get(ctx)
+	if err != nil {
+		return nil, newEO(err, RecvErrorCodeUnavailable, recv.issuer)
+	}
+	return v.(*Transmitter), nil
+}
+
+// StreamID は SetUpStream で用意した Stream の stream_id を返す
+func (recv *recv) StreamID() string {
+	recv.m.RLock()
+	defer recv.m.RUnlock()
+	return recv.recv.StreamConf.StreamID
+}
+
+// streamIDOr は streamID が空の時に SetUpStream で用意した Stream の stream_id を返す
+func (recv *recv) streamIDOr(streamID string) string {
+	if streamID != "" {
+		return streamID
+	}
+	return recv.StreamID()
+}
+
+// doConfig は req に ForConfig で認可情報を設定して Stream Management API を叩く
+// 401 が返ってきた時に AuthHeaderSetter がトークンを取り直せるなら一度だけ再送する
+func (recv *recv) doConfig(req *http.Request) (*http.Response, error) {
+	return recv.doConfigWith(recv.client, req)
+}
+
+func (recv *recv) doConfigWith(client *http.Client, req *http.Request) (*http.Response, error) {
+	recv.setAuthHeder.ForConfig(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	refresher, ok := recv.setAuthHeder.(AuthHeaderRefresher)
+	if resp.StatusCode != http.StatusUnauthorized || !ok {
+		return resp, nil
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// body を読み直せないので再送できない
+		return resp, nil
+	}
+	resp.Body.Close()
+	if err := refresher.RefreshForConfig(); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	recv.setAuthHeder.ForConfig(retry)
+	return client.Do(retry)
 }
 
-func (recv *recv) ReadStreamStatus(spagID string) (*StreamStatus, error) {
-	url, err := url.Parse(recv.tr.StatusEndpoint)
+func (recv *recv) ReadStreamStatus(ctx context.Context, streamID string, sub *Subject) (*StreamStatus, error) {
+	tr, err := recv.transmitter(ctx)
 	if err != nil {
 		return nil, err
 	}
-	url.Path = path.Join(url.Path, spagID)
-	req, err := http.NewRequest("GET", url.String(), nil)
+	url, err := url.Parse(tr.StatusEndpoint)
 	if err != nil {
 		return nil, err
 	}
-	recv.setAuthHeder.ForConfig(req)
-	resp, err := http.DefaultClient.Do(req)
+	q := url.Query()
+	if streamID := recv.streamIDOr(streamID); streamID != "" {
+		q.Set("stream_id", streamID)
+	}
+	if sub != nil {
+		subJSON, err := json.Marshal(sub)
+		if err != nil {
+			return nil, err
+		}
+		q.Set("subject", string(subJSON))
+	}
+	url.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := recv.doConfig(req)
 	if err != nil {
 		return nil, err
 	}
@@ -129,33 +358,107 @@ func (recv *recv) ReadStreamStatus(spagID string) (*StreamStatus, error) {
 	return s, nil
 }
 
-func (recv *recv) SetUpStream(conf *StreamConfig) error {
+func (recv *recv) SetUpStream(ctx context.Context, conf *StreamConfig) error {
 	recv.m.Lock()
 	defer recv.m.Unlock()
-	srvSavedConf, err := recv.ReadStream()
+	srvSavedConf, err := recv.findStream(ctx)
 	if err != nil {
 		return err
 	}
-	_ = recv.recv.StreamConf.Update(srvSavedConf)
-	_ = recv.recv.StreamConf.Update(conf)
-	ismodified := srvSavedConf.Update(recv.recv.StreamConf)
-	if ismodified {
-		newSrvSavedConf, err := recv.UpdateStream(recv.recv.StreamConf)
+	local := recv.recv.StreamConf
+	if srvSavedConf != nil {
+		_ = local.Merge(srvSavedConf)
+	}
+	// 要求されたイベントはこれまでのものに加える
+	c := *conf
+	if c.EventsRequested != nil {
+		c.EventsRequested = union(local.EventsRequested, c.EventsRequested)
+	}
+	_ = local.Merge(&c)
+	if recv.dec != nil {
+		// 暗号化鍵は Receiver が持っているものが正
+		local.Encryption = recv.dec.conf
+	}
+	if srvSavedConf == nil {
+		// まだ Stream がないので作る
+		created, err := recv.CreateStream(ctx, local)
+		if err != nil {
+			return err
+		}
+		_ = local.Merge(created)
+		return nil
+	}
+	patch := local.receiverSettable()
+	if ismodified := srvSavedConf.Merge(patch); ismodified {
+		newSrvSavedConf, err := recv.UpdateStream(ctx, patch)
 		if err != nil {
 			return err
 		}
-		_ = recv.recv.StreamConf.Update(newSrvSavedConf)
+		_ = local.Merge(newSrvSavedConf)
 	}
 	return nil
 }
 
-func (recv *recv) ReadStream() (*StreamConfig, error) {
-	req, err := http.NewRequest("GET", recv.tr.ConfigurationEndpoint, nil)
+// union は a に b のうち a にないものを加えたものを返す
+func union(a, b []string) []string {
+	ret := append([]string{}, a...)
+	for _, x := range b {
+		if !contains(ret, x) {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+// findStream はこの Receiver が使っている Stream を Transmitter から探す
+// 既に stream_id が分かっていればその Stream を、分からなければ配送方法が同じ Stream を返す
+// 見つからなければ nil を返す
+// 呼び出し側で recv.m のロックを取っておくこと
+func (recv *recv) findStream(ctx context.Context) (*StreamConfig, error) {
+	local := recv.recv.StreamConf
+	if local.StreamID != "" {
+		c, err := recv.ReadStream(ctx, local.StreamID)
+		if e, ok := err.(RecvError); ok && e.Code() == RecvErrorCodeNotFound {
+			// Transmitter 側で削除されたので作り直す
+			local.StreamID = ""
+			return nil, nil
+		}
+		return c, err
+	}
+	confs, err := recv.ListStreams(ctx)
 	if err != nil {
 		return nil, err
 	}
-	recv.setAuthHeder.ForConfig(req)
-	resp, err := http.DefaultClient.Do(req)
+	for i, c := range confs {
+		if c.Delivery.DeliveryMethod != local.Delivery.DeliveryMethod {
+			continue
+		}
+		// Push の時は配送先も同じものを探す。 Poll の時の配送先は Transmitter が決める
+		if local.Delivery.DeliveryMethod == DeliveryMethodPush && c.Delivery.URL != local.Delivery.URL {
+			continue
+		}
+		return &confs[i], nil
+	}
+	return nil, nil
+}
+
+func (recv *recv) CreateStream(ctx context.Context, conf *StreamConfig) (*StreamConfig, error) {
+	c := conf.receiverSettable()
+	// stream_id は Transmitter が割り当てる
+	c.StreamID = ""
+	return recv.sendStream(ctx, "POST", c, http.StatusCreated)
+}
+
+func (recv *recv) ListStreams(ctx context.Context) ([]StreamConfig, error) {
+	tr, err := recv.transmitter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", tr.ConfigurationEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := recv.doConfig(req)
 	if err != nil {
 		return nil, err
 	}
@@ -164,7 +467,79 @@ func (recv *recv) ReadStream() (*StreamConfig, error) {
 		return nil, newEO(fmt.Errorf("401"), RecvErrorCodeUnAuthorized, resp)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("read ctx stream status failed statuscode: %v", resp.StatusCode)
+		return nil, fmt.Errorf("list streams failed statuscode: %v", resp.StatusCode)
+	}
+	var confs []StreamConfig
+	if err := json.NewDecoder(resp.Body).Decode(&confs); err != nil {
+		return nil, err
+	}
+	return confs, nil
+}
+
+func (recv *recv) DeleteStream(ctx context.Context, streamID string) error {
+	url, err := recv.streamURL(ctx, streamID)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := recv.doConfig(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return newEO(fmt.Errorf("401"), RecvErrorCodeUnAuthorized, resp)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return newE(fmt.Errorf("CAEP 404"), RecvErrorCodeNotFound)
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delete stream failed statuscode: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// streamURL は streamID の Stream を指す Configuration Endpoint の URL を返す
+func (recv *recv) streamURL(ctx context.Context, streamID string) (string, error) {
+	tr, err := recv.transmitter(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(tr.ConfigurationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("stream_id", streamID)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (recv *recv) ReadStream(ctx context.Context, streamID string) (*StreamConfig, error) {
+	url, err := recv.streamURL(ctx, streamID)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := recv.doConfig(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, newEO(fmt.Errorf("401"), RecvErrorCodeUnAuthorized, resp)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, newE(fmt.Errorf("CAEP 404"), RecvErrorCodeNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("read stream config failed statuscode: %v", resp.StatusCode)
 	}
 	c := new(StreamConfig)
 	if err := json.NewDecoder(resp.Body).Decode(c); err != nil {
@@ -173,18 +548,37 @@ func (recv *recv) ReadStream() (*StreamConfig, error) {
 	return c, nil
 }
 
-func (recv *recv) UpdateStream(conf *StreamConfig) (*StreamConfig, error) {
+func (recv *recv) UpdateStream(ctx context.Context, conf *StreamConfig) (*StreamConfig, error) {
+	if conf.StreamID == "" {
+		return nil, fmt.Errorf("caep: 更新する Stream の stream_id がない")
+	}
+	return recv.sendStream(ctx, "PATCH", conf.receiverSettable(), http.StatusOK)
+}
+
+func (recv *recv) ReplaceStream(ctx context.Context, conf *StreamConfig) (*StreamConfig, error) {
+	if conf.StreamID == "" {
+		return nil, fmt.Errorf("caep: 置き換える Stream の stream_id がない")
+	}
+	return recv.sendStream(ctx, "PUT", conf.receiverSettable(), http.StatusOK)
+}
+
+// sendStream は conf を Configuration Endpoint に method で送って、 Transmitter が保存した設定を返す
+// Transmitter が設定を受け付けなかった時はその理由をエラーにする
+func (recv *recv) sendStream(ctx context.Context, method string, conf *StreamConfig, expected int) (*StreamConfig, error) {
+	tr, err := recv.transmitter(ctx)
+	if err != nil {
+		return nil, err
+	}
 	bodyJSON, err := json.Marshal(conf)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", recv.tr.ConfigurationEndpoint, bytes.NewBuffer(bodyJSON))
+	req, err := http.NewRequestWithContext(ctx, method, tr.ConfigurationEndpoint, bytes.NewBuffer(bodyJSON))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
-	recv.setAuthHeder.ForConfig(req)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := recv.doConfig(req)
 	if err != nil {
 		return nil, err
 	}
@@ -192,8 +586,15 @@ func (recv *recv) UpdateStream(conf *StreamConfig) (*StreamConfig, error) {
 	if resp.StatusCode == http.StatusUnauthorized {
 		return nil, newEO(fmt.Errorf("401"), RecvErrorCodeUnAuthorized, resp)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("config post failed statuscode: %d", resp.StatusCode)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, newE(fmt.Errorf("CAEP 404"), RecvErrorCodeNotFound)
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Transmitter が stream config を受け付けなかった: %s", bytes.TrimSpace(msg))
+	}
+	if resp.StatusCode != expected {
+		return nil, fmt.Errorf("config %s failed statuscode: %d", method, resp.StatusCode)
 	}
 	var c StreamConfig
 	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
@@ -202,24 +603,34 @@ func (recv *recv) UpdateStream(conf *StreamConfig) (*StreamConfig, error) {
 	return &c, nil
 }
 
-func (recv *recv) AddSubject(reqadd *ReqAddSub) error {
-	bodyJSON, err := json.Marshal(reqadd)
+func (recv *recv) AddSubject(ctx context.Context, reqadd *ReqAddSub) error {
+	tr, err := recv.transmitter(ctx)
+	if err != nil {
+		return err
+	}
+	r := *reqadd
+	r.StreamID = recv.streamIDOr(r.StreamID)
+	bodyJSON, err := json.Marshal(&r)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", recv.tr.AddSubjectEndpoint, bytes.NewBuffer(bodyJSON))
+	req, err := http.NewRequestWithContext(ctx, "POST", tr.AddSubjectEndpoint, bytes.NewBuffer(bodyJSON))
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Content-Type", "application/json")
-	recv.setAuthHeder.ForSubAdd(reqadd.Sub.SpagID, req)
-	resp, err := http.DefaultClient.Do(req)
+	recv.setAuthHeder.ForSubAdd(&reqadd.Sub, req)
+	resp, err := recv.client.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusUnauthorized {
 		return newEO(fmt.Errorf("UMA 401"), RecvErrorCodeUnAuthorized, resp)
 	}
+	if resp.StatusCode == http.StatusForbidden {
+		return newE(fmt.Errorf("UMA 403"), RecvErrorCodeForbidden)
+	}
 	if resp.StatusCode == http.StatusNotFound {
 		return newE(fmt.Errorf("CAEP 404"), RecvErrorCodeNotFound)
 	}
@@ -229,33 +640,309 @@ func (recv *recv) AddSubject(reqadd *ReqAddSub) error {
 	return nil
 }
 
-func (recv *recv) Recv(r *http.Request) (*SSEEventClaim, error) {
-	recv.m.RLock()
-	defer recv.m.RUnlock()
-	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+func (recv *recv) UpdateStreamStatus(ctx context.Context, reqstatus *ReqChangeOfStreamStatus) (*StreamStatus, error) {
+	tr, err := recv.transmitter(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if contentType != "application/secevent+jwt" {
+	r := *reqstatus
+	r.StreamID = recv.streamIDOr(r.StreamID)
+	bodyJSON, err := json.Marshal(&r)
+	if err != nil {
 		return nil, err
 	}
-
-	tok, err := jwt.Parse(r.Body, jwt.WithVerify(jwa.HS256, []byte("secret-hs-256-key")))
+	req, err := http.NewRequestWithContext(ctx, "POST", tr.StatusEndpoint, bytes.NewBuffer(bodyJSON))
 	if err != nil {
 		return nil, err
 	}
-	if err := jwt.Verify(tok, jwt.WithAudience(recv.recv.Host), jwt.WithIssuer(recv.tr.Issuer)); err != nil {
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := recv.doConfig(req)
+	if err != nil {
 		return nil, err
 	}
-	v, ok := tok.Get("events")
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, newEO(fmt.Errorf("401"), RecvErrorCodeUnAuthorized, resp)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, newE(fmt.Errorf("CAEP 404"), RecvErrorCodeNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("update stream status failed statuscode: %v", resp.StatusCode)
+	}
+	s := new(StreamStatus)
+	if err := json.NewDecoder(resp.Body).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (recv *recv) RemoveSubject(ctx context.Context, reqremove *ReqRemoveSub) error {
+	tr, err := recv.transmitter(ctx)
+	if err != nil {
+		return err
+	}
+	r := *reqremove
+	r.StreamID = recv.streamIDOr(r.StreamID)
+	bodyJSON, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", tr.RemoveSubjectEndpoint, bytes.NewBuffer(bodyJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := recv.doConfig(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return newEO(fmt.Errorf("401"), RecvErrorCodeUnAuthorized, resp)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return newE(fmt.Errorf("CAEP 404"), RecvErrorCodeNotFound)
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remove subject failed statuscode: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func (recv *recv) Verify(ctx context.Context, reqverify *ReqVerification) error {
+	tr, err := recv.transmitter(ctx)
+	if err != nil {
+		return err
+	}
+	r := *reqverify
+	r.StreamID = recv.streamIDOr(r.StreamID)
+	bodyJSON, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", tr.VerificationEndpoint, bytes.NewBuffer(bodyJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := recv.doConfig(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return newEO(fmt.Errorf("401"), RecvErrorCodeUnAuthorized, resp)
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("verification failed statuscode: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func (recv *recv) VerifyRoundTrip(ctx context.Context, timeout time.Duration) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+	done := make(chan struct{})
+	recv.vm.Lock()
+	if recv.verifications == nil {
+		recv.verifications = make(map[string]chan struct{})
+	}
+	recv.verifications[state] = done
+	recv.vm.Unlock()
+	defer func() {
+		recv.vm.Lock()
+		delete(recv.verifications, state)
+		recv.vm.Unlock()
+	}()
+
+	if err := recv.Verify(ctx, &ReqVerification{State: state}); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return newE(fmt.Errorf("Verification Event(state: %s) が %v 以内に届かなかった", state, timeout), RecvErrorCodeVerificationTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// verified は Verification Event を受け取ったことを待っている VerifyRoundTrip に知らせる
+func (recv *recv) verified(state string) {
+	recv.vm.Lock()
+	defer recv.vm.Unlock()
+	if done, ok := recv.verifications[state]; ok {
+		close(done)
+		delete(recv.verifications, state)
+	}
+}
+
+func (recv *recv) Handle(eventType string, handler EventHandler) {
+	recv.handlers.handle(eventType, handler)
+}
+
+func (recv *recv) Use(mws ...EventMiddleware) {
+	recv.handlers.use(mws...)
+}
+
+func (recv *recv) Recv(r *http.Request) error {
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return newSetErr(SetErrInvalidRequest, err)
+	}
+	if contentType != "application/secevent+jwt" {
+		return newSetErr(SetErrInvalidRequest, fmt.Errorf("content-type(%s) は application/secevent+jwt ではない", contentType))
+	}
+
+	set, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return newSetErr(SetErrInvalidRequest, err)
+	}
+	recv.m.RLock()
+	rs, err := recv.parse(r.Context(), set)
+	recv.m.RUnlock()
+	if err != nil {
+		return err
+	}
+	// handler は recv の他のメソッドを呼ぶかもしれないのでロックを外してから渡す
+	return recv.accept(r.Context(), rs)
+}
+
+// receivedSET は検証済みの SET から取り出したイベントと、リプレイ検知のための jti
+type receivedSET struct {
+	jti string
+	// exp は jti を覚えておく期限
+	exp    time.Time
+	events []Event
+}
+
+// accept は SET の jti を記録してからイベントを登録された handler に渡す
+// 処理し終えた (あるいは処理している) SET が再送されてきた時は、何もせず受け取ったことにする
+// handler が失敗した時は jti の記録を取り消すので、 Transmitter が再送すれば改めて処理する
+func (recv *recv) accept(ctx context.Context, rs *receivedSET) error {
+	key := recv.issuer + ":" + rs.jti
+	ok, err := recv.jtis.Reserve(key, rs.exp)
+	if err != nil {
+		return err
+	}
 	if !ok {
-		return nil, fmt.Errorf("送られてきたSETに events property がない")
+		fmt.Printf("SET(jti: %s) は既に受け取っているので無視する\n", rs.jti)
+		return nil
+	}
+	if err := recv.handlers.dispatch(ctx, rs.events); err != nil {
+		if rerr := recv.jtis.Release(key); rerr != nil {
+			fmt.Printf("SET(jti: %s) の jti の記録の取り消しに失敗 %v\n", rs.jti, rerr)
+		}
+		return err
 	}
-	e, ok := NewSETEventsClaimFromJson(v)
+	return nil
+}
+
+// parse は SET を復号・検証して events クレームに含まれるイベントを全て取り出す
+// SET を受け付けられない時は RecvErrorCodeInvalidSET のエラーを返す
+// 呼び出し側で recv.m のロックを取っておくこと
+func (recv *recv) parse(ctx context.Context, set []byte) (*receivedSET, error) {
+	tr, err := recv.transmitter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if recv.dec != nil {
+		// 暗号化を求めているのに平文で送られてきた SET は受け付けない
+		if !isJWE(set) {
+			return nil, newSetErr(SetErrInvalidRequest, fmt.Errorf("暗号化されていない SET が送られてきた"))
+		}
+		set, err = recv.dec.decrypt(set)
+		if err != nil {
+			return nil, newSetErr(SetErrInvalidKey, err)
+		}
+	}
+	alg, key, err := recv.keys.keyFor(ctx, tr.JwksURI, set)
+	if err != nil {
+		return nil, newSetErr(SetErrInvalidKey, err)
+	}
+	tok, err := jwt.ParseBytes(set, jwt.WithVerify(alg, key))
+	if err != nil {
+		return nil, newSetErr(SetErrAuthenticationFailed, err)
+	}
+	if err := jwt.Verify(tok, jwt.WithIssuer(tr.Issuer)); err != nil {
+		return nil, newSetErr(SetErrInvalidIssuer, err)
+	}
+	if err := jwt.Verify(tok, jwt.WithAudience(recv.recv.Host)); err != nil {
+		return nil, newSetErr(SetErrInvalidAudience, err)
+	}
+	rs, err := recv.checkReplay(tok)
+	if err != nil {
+		return nil, newSetErr(SetErrInvalidRequest, err)
+	}
+	v, ok := tok.Get("events")
 	if !ok {
-		return nil, fmt.Errorf("送られてきたSET events property のパースに失敗")
+		return nil, newSetErr(SetErrInvalidRequest, fmt.Errorf("送られてきたSETに events property がない"))
+	}
+	events, err := DecodeEvents(v)
+	if err != nil {
+		return nil, newSetErr(SetErrInvalidRequest, err)
 	}
-	return e, nil
+	for _, e := range events {
+		if ve, ok := e.(*VerificationEvent); ok {
+			recv.verified(ve.State)
+		}
+	}
+	rs.events = events
+	return rs, nil
+}
+
+// checkReplay は SET の iat や toe が受け付けられる範囲にあるか確かめる
+// 同じ jti の SET を既に受け取っているかは accept で確かめる
+func (recv *recv) checkReplay(tok jwt.Token) (*receivedSET, error) {
+	now := time.Now()
+	iat := tok.IssuedAt()
+	if iat.IsZero() {
+		return nil, fmt.Errorf("SET に iat がない")
+	}
+	if iat.After(now.Add(recv.skew)) {
+		return nil, fmt.Errorf("SET の iat(%v) が未来を指している", iat)
+	}
+	// Transmitter は配送し直す度に iat を新しくして署名し直すので、古い iat はリプレイとみなせる
+	if iat.Before(now.Add(-recv.maxAge)) {
+		return nil, fmt.Errorf("SET の iat(%v) が古すぎる", iat)
+	}
+	if v, ok := tok.Get("toe"); ok {
+		toe, ok := numericDate(v)
+		if !ok {
+			return nil, fmt.Errorf("SET の toe のフォーマットがおかしい")
+		}
+		if toe.After(now.Add(recv.skew)) {
+			return nil, fmt.Errorf("SET の toe(%v) が未来を指している", toe)
+		}
+	}
+	jti := tok.JwtID()
+	if jti == "" {
+		return nil, fmt.Errorf("SET に jti がない")
+	}
+	// iat の検査で弾かれるようになるまで jti を覚えておけば良い
+	return &receivedSET{jti: jti, exp: iat.Add(recv.maxAge + recv.skew)}, nil
+}
+
+// numericDate は JSON の NumericDate を time.Time に変換する
+func numericDate(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(n, 0), true
+	case time.Time:
+		return v, true
+	}
+	return time.Time{}, false
 }
 
 func newE(err error, code RecvErrorCode) RecvError {
@@ -281,6 +968,24 @@ func (e *cscerr) Option() interface{} {
 	return e.option
 }
 
+// longPollClient は Timeout が pollTimeout より短い c を、 Timeout だけ延ばして返す
+func longPollClient(c *http.Client) *http.Client {
+	if c.Timeout == 0 || c.Timeout >= pollTimeout {
+		return c
+	}
+	ret := *c
+	ret.Timeout = pollTimeout
+	return &ret
+}
+
+// httpClientOr は c が nil の時に http.DefaultClient を返す
+func httpClientOr(c *http.Client) *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+	return c
+}
+
 func contains(src []string, x string) bool {
 	for _, name := range src {
 		if name == x {
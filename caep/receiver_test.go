@@ -0,0 +1,135 @@
+package caep
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+func TestCheckReplay(t *testing.T) {
+	recv := &recv{skew: 5 * time.Minute, maxAge: time.Hour}
+	now := time.Now()
+	token := func(jti string, iat time.Time, toe interface{}) jwt.Token {
+		tok := jwt.New()
+		if jti != "" {
+			tok.Set(jwt.JwtIDKey, jti)
+		}
+		if !iat.IsZero() {
+			tok.Set(jwt.IssuedAtKey, iat)
+		}
+		if toe != nil {
+			tok.Set("toe", toe)
+		}
+		return tok
+	}
+
+	for name, tok := range map[string]jwt.Token{
+		"新しい SET":           token("jti1", now, nil),
+		"skew の範囲内の未来の iat": token("jti1", now.Add(time.Minute), nil),
+		"過去の toe":           token("jti1", now, float64(now.Add(-time.Hour).Unix())),
+	} {
+		rs, err := recv.checkReplay(tok)
+		if err != nil {
+			t.Errorf("%s を受け付けない %v", name, err)
+			continue
+		}
+		// iat の検査で弾かれるようになるまでは jti を覚えておく
+		if min := tok.IssuedAt().Add(recv.maxAge); rs.jti != "jti1" || rs.exp.Before(min) {
+			t.Errorf("%s: jti = %s exp = %v, want exp after %v", name, rs.jti, rs.exp, min)
+		}
+	}
+	for name, tok := range map[string]jwt.Token{
+		"iat がない":  token("jti1", time.Time{}, nil),
+		"未来の iat":  token("jti1", now.Add(time.Hour), nil),
+		"古すぎる iat": token("jti1", now.Add(-2*time.Hour), nil),
+		"未来の toe":  token("jti1", now, float64(now.Add(time.Hour).Unix())),
+		"toe のフォーマットがおかしい": token("jti1", now, "yesterday"),
+		"jti がない": token("", now, nil),
+	} {
+		if _, err := recv.checkReplay(tok); err == nil {
+			t.Errorf("%s SET を受け付けた", name)
+		}
+	}
+}
+
+func TestAccept(t *testing.T) {
+	jtis := &memJTIStore{db: make(map[string]time.Time)}
+	recv := &recv{issuer: "https://cap.example", jtis: jtis, handlers: newHandlers()}
+	rs := &receivedSET{jti: "jti1", exp: time.Now().Add(time.Hour), events: []Event{&SSEEventClaim{ID: "ctx"}}}
+	var (
+		called     int
+		handlerErr error
+	)
+	recv.Handle(ContextEventType, EventHandlerFunc(func(context.Context, Event) error {
+		called++
+		return handlerErr
+	}))
+
+	// 処理に失敗した SET は記録を取り消し、再送されたら改めて処理する
+	handlerErr = errors.New("handler failed")
+	if err := recv.accept(context.Background(), rs); err != handlerErr {
+		t.Fatalf("accept() = %v, want %v", err, handlerErr)
+	}
+	handlerErr = nil
+	if err := recv.accept(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	// 処理し終えた SET の再送はイベントを処理せずに受け付ける
+	if err := recv.accept(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if called != 2 {
+		t.Errorf("handler called %d times, want 2", called)
+	}
+}
+
+func TestAcceptConcurrentDuplicates(t *testing.T) {
+	recv := &recv{issuer: "https://cap.example", jtis: &memJTIStore{db: make(map[string]time.Time)}, handlers: newHandlers()}
+	rs := &receivedSET{jti: "jti1", exp: time.Now().Add(time.Hour), events: []Event{&SSEEventClaim{ID: "ctx"}}}
+	var m sync.Mutex
+	called := 0
+	recv.Handle(ContextEventType, EventHandlerFunc(func(context.Context, Event) error {
+		m.Lock()
+		defer m.Unlock()
+		called++
+		return nil
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recv.accept(context.Background(), rs)
+		}()
+	}
+	wg.Wait()
+	if called != 1 {
+		t.Errorf("同時に届いた同じ SET を %d 回処理した", called)
+	}
+}
+
+type memJTIStore struct {
+	m  sync.Mutex
+	db map[string]time.Time
+}
+
+func (s *memJTIStore) Reserve(jti string, exp time.Time) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if prev, ok := s.db[jti]; ok && time.Now().Before(prev) {
+		return false, nil
+	}
+	s.db[jti] = exp
+	return true, nil
+}
+
+func (s *memJTIStore) Release(jti string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.db, jti)
+	return nil
+}
@@ -0,0 +1,62 @@
+package caep
+
+// RISC の仕様で定められたアカウント単位のイベントの種類
+const (
+	AccountDisabledEventType      = "https://schemas.openid.net/secevent/risc/event-type/account-disabled"
+	AccountPurgedEventType        = "https://schemas.openid.net/secevent/risc/event-type/account-purged"
+	CredentialCompromiseEventType = "https://schemas.openid.net/secevent/risc/event-type/credential-compromise"
+	IdentifierChangedEventType    = "https://schemas.openid.net/secevent/risc/event-type/identifier-changed"
+)
+
+// RISCEvent は RISC のイベントに共通するフィールドを表す
+type RISCEvent struct {
+	Subject Subject `json:"subject"`
+}
+
+func (e *RISCEvent) eventSubject() *Subject { return &e.Subject }
+
+// AccountDisabledEvent はアカウントが無効化されたことを表す
+type AccountDisabledEvent struct {
+	RISCEvent
+	// Reason は無効化の理由 (hijacking, bulk-account)
+	Reason string `json:"reason,omitempty"`
+}
+
+func (e *AccountDisabledEvent) Type() string { return AccountDisabledEventType }
+
+// AccountPurgedEvent はアカウントが削除されたことを表す
+type AccountPurgedEvent struct {
+	RISCEvent
+}
+
+func (e *AccountPurgedEvent) Type() string { return AccountPurgedEventType }
+
+// CredentialCompromiseEvent はアカウントのクレデンシャルが漏洩したことを表す
+type CredentialCompromiseEvent struct {
+	RISCEvent
+	// CredentialType は漏洩したクレデンシャルの種類 (password, pin, x509 など)
+	CredentialType string `json:"credential_type"`
+	// EventTimestamp は漏洩が分かった時刻 (NumericDate)
+	EventTimestamp int64             `json:"event_timestamp,omitempty"`
+	ReasonAdmin    map[string]string `json:"reason_admin,omitempty"`
+	ReasonUser     map[string]string `json:"reason_user,omitempty"`
+}
+
+func (e *CredentialCompromiseEvent) Type() string { return CredentialCompromiseEventType }
+
+// IdentifierChangedEvent はアカウントの識別子 (メールアドレスなど) が変わったことを表す
+// Subject は変わる前の識別子を指す
+type IdentifierChangedEvent struct {
+	RISCEvent
+	// NewValue は変わった後の識別子
+	NewValue string `json:"new-value,omitempty"`
+}
+
+func (e *IdentifierChangedEvent) Type() string { return IdentifierChangedEventType }
+
+func init() {
+	RegisterEventType(AccountDisabledEventType, func() Event { return new(AccountDisabledEvent) })
+	RegisterEventType(AccountPurgedEventType, func() Event { return new(AccountPurgedEvent) })
+	RegisterEventType(CredentialCompromiseEventType, func() Event { return new(CredentialCompromiseEvent) })
+	RegisterEventType(IdentifierChangedEventType, func() Event { return new(IdentifierChangedEvent) })
+}
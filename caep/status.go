@@ -0,0 +1,315 @@
+package caep
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Stream とサブジェクトの status
+const (
+	// StatusEnabled はイベントをそのまま配送する
+	StatusEnabled = "enabled"
+	// StatusPaused はイベントを保留し、 enabled に戻った時にまとめて配送する
+	StatusPaused = "paused"
+	// StatusDisabled はイベントを配送せずに捨てる
+	StatusDisabled = "disabled"
+)
+
+// status を変更した主体
+const (
+	// StatusChangedByTransmitter は Transmitter が認可の失効などで status を変更したことを表す
+	StatusChangedByTransmitter = "transmitter"
+	// StatusChangedByReceiver は Receiver が POST /set/status で status を変更したことを表す
+	StatusChangedByReceiver = "receiver"
+)
+
+// errDisabledByTransmitter は Transmitter が disabled にしたものを Receiver が enabled に戻そうとしたことを表す
+// サブジェクトの場合は新しい認可で add subject し直す必要がある
+var errDisabledByTransmitter = errors.New("Transmitter が disabled にしたので Receiver からは enabled に戻せない")
+
+// statusTransitions は status ごとに遷移できる先の status を表す
+// disabled から paused へは一度 enabled に戻してから遷移する
+var statusTransitions = map[string][]string{
+	StatusEnabled:  {StatusPaused, StatusDisabled},
+	StatusPaused:   {StatusEnabled, StatusDisabled},
+	StatusDisabled: {StatusEnabled},
+}
+
+// canTransit は from から to へ status を遷移できるか確かめる
+func canTransit(from, to string) error {
+	if _, ok := statusTransitions[to]; !ok {
+		return fmt.Errorf("status(%s) は %s, %s, %s のいずれか", to, StatusEnabled, StatusPaused, StatusDisabled)
+	}
+	if !contains(statusTransitions[from], to) {
+		return fmt.Errorf("status を %s から %s へは変更できない", from, to)
+	}
+	return nil
+}
+
+// canTransitBy は by が from から to へ status を遷移できるか確かめる
+// changedBy は from に変更した主体
+func canTransitBy(from, to, changedBy, by string) error {
+	if err := canTransit(from, to); err != nil {
+		return err
+	}
+	if from == StatusDisabled && changedBy == StatusChangedByTransmitter && by == StatusChangedByReceiver {
+		return errDisabledByTransmitter
+	}
+	return nil
+}
+
+// maxHeldEvents は paused の間に Stream ごとに保留しておけるイベントの数
+// 超えた時は古いものから捨てる
+const maxHeldEvents = 1000
+
+// subjectEvent はサブジェクトについてのイベントを表す
+// Verification Event や Stream Updated Event のような Stream の制御のためのイベントは含まない
+type subjectEvent interface {
+	Event
+	eventSubject() *Subject
+}
+
+// heldEvent は paused の間に保留しているイベント
+type heldEvent struct {
+	subKey string
+	event  Event
+}
+
+// holdQueue は paused の Stream やサブジェクト宛のイベントを Stream ごとに保留する
+type holdQueue struct {
+	m sync.Mutex
+	q map[string][]heldEvent // streamID -> events
+}
+
+func newHoldQueue() *holdQueue {
+	return &holdQueue{q: make(map[string][]heldEvent)}
+}
+
+// push は streamID の Stream 宛のイベントを保留する
+func (h *holdQueue) push(streamID, subKey string, e Event) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	q := append(h.q[streamID], heldEvent{subKey: subKey, event: e})
+	if over := len(q) - maxHeldEvents; over > 0 {
+		fmt.Printf("stream(%s) で保留しているイベントが上限を超えたので古いものを %d 個捨てる\n", streamID, over)
+		q = q[over:]
+	}
+	h.q[streamID] = q
+}
+
+// take は streamID の Stream 宛に保留しているイベントのうち subKey のものを取り出す
+// subKey が空の時は全てを取り出す
+func (h *holdQueue) take(streamID, subKey string) []heldEvent {
+	h.m.Lock()
+	defer h.m.Unlock()
+	var ret, rest []heldEvent
+	for _, e := range h.q[streamID] {
+		if subKey == "" || e.subKey == subKey {
+			ret = append(ret, e)
+		} else {
+			rest = append(rest, e)
+		}
+	}
+	if len(rest) == 0 {
+		delete(h.q, streamID)
+	} else {
+		h.q[streamID] = rest
+	}
+	return ret
+}
+
+func (tr *tr) UpdateStatus(recvID, streamID string, sub *Subject, status, reason string) error {
+	recv, err := tr.stream(recvID, streamID)
+	if err != nil {
+		return err
+	}
+	_, err = tr.changeStatus(recv, sub, status, reason, StatusChangedByTransmitter)
+	return err
+}
+
+func (tr *tr) UpdateScopes(recvID, streamID string, sub *Subject, update func(status *StreamStatus) (map[string][]string, bool), reason string) error {
+	recv, err := tr.stream(recvID, streamID)
+	if err != nil {
+		return err
+	}
+	tr.statusM.Lock()
+	status, err := tr.statusRepo.Load(recvID, recv.StreamConf.StreamID, sub.Key())
+	if err != nil {
+		tr.statusM.Unlock()
+		return err
+	}
+	if status.Status == StatusDisabled {
+		tr.statusM.Unlock()
+		return nil
+	}
+	scopes, changed := update(status)
+	if !changed {
+		tr.statusM.Unlock()
+		return nil
+	}
+	if len(scopes) == 0 {
+		tr.statusM.Unlock()
+		_, err := tr.changeStatus(recv, sub, StatusDisabled, reason, StatusChangedByTransmitter)
+		return err
+	}
+	status.EventScopes = scopes
+	if err := tr.statusRepo.Save(recvID, status); err != nil {
+		tr.statusM.Unlock()
+		return err
+	}
+	tr.statusM.Unlock()
+
+	ev := &StreamUpdatedEvent{Status: status.Status, Reason: reason, Subject: sub}
+	raw, err := json.Marshal(eventsClaim(ev))
+	if err != nil {
+		return err
+	}
+	return tr.transmitTo(recv, raw)
+}
+
+// changeStatus は recv の Stream の status を to に遷移させる。 sub が nil でなければサブジェクトの status を遷移させる
+// 遷移すると Receiver に Stream Updated Event を送り、 enabled になれば保留していたイベントを配送し、 disabled になれば捨てる
+// by は変更する主体で、 Transmitter が disabled にしたものは Receiver からは戻せない
+// Transmitter がサブジェクトを disabled にした時は認可されていたスコープも取り消す
+func (tr *tr) changeStatus(recv *Receiver, sub *Subject, to, reason, by string) (*StreamStatus, error) {
+	streamID := recv.StreamConf.StreamID
+	tr.statusM.Lock()
+	var (
+		ret    *StreamStatus
+		from   string
+		subKey string
+	)
+	if sub == nil {
+		cur, err := tr.recvRepo.Load(recv.ID, streamID)
+		if err != nil {
+			tr.statusM.Unlock()
+			return nil, err
+		}
+		from = cur.status()
+		ret = &StreamStatus{StreamID: streamID, Status: to}
+		if from != to {
+			if err := canTransitBy(from, to, cur.StatusChangedBy, by); err != nil {
+				tr.statusM.Unlock()
+				return nil, err
+			}
+			cur.Status = to
+			cur.StatusReason = reason
+			cur.StatusChangedBy = by
+			if err := tr.recvRepo.Save(cur); err != nil {
+				tr.statusM.Unlock()
+				return nil, err
+			}
+		}
+	} else {
+		subKey = sub.Key()
+		status, err := tr.statusRepo.Load(recv.ID, streamID, subKey)
+		if err != nil {
+			tr.statusM.Unlock()
+			return nil, err
+		}
+		from = status.Status
+		if from == "" {
+			from = StatusEnabled
+		}
+		ret = status
+		if from != to {
+			if err := canTransitBy(from, to, status.ChangedBy, by); err != nil {
+				tr.statusM.Unlock()
+				return nil, err
+			}
+			status.Status = to
+			status.ChangedBy = by
+			if to == StatusDisabled && by == StatusChangedByTransmitter {
+				// 認可が失効したので、 Receiver が何をしても前の認可ではコンテキストを送らない
+				status.EventScopes = nil
+			}
+			if err := tr.statusRepo.Save(recv.ID, status); err != nil {
+				tr.statusM.Unlock()
+				return nil, err
+			}
+		}
+	}
+	tr.statusM.Unlock()
+	if from == to {
+		return ret, nil
+	}
+	fmt.Printf("recvID(%s) の stream(%s) の subject(%s) の status を %s から %s に変更 reason: %s\n", recv.ID, streamID, subKey, from, to, reason)
+
+	// status の変更は Stream 全体が paused や disabled でも Receiver に伝える
+	// ただし Poll 待ちの SET が溢れて paused にした時は送っても溢れるので、 Receiver には status を読んで知ってもらう
+	if reason != pollOverflowReason {
+		ev := &StreamUpdatedEvent{Status: to, Reason: reason, Subject: sub}
+		if raw, err := json.Marshal(eventsClaim(ev)); err != nil {
+			fmt.Printf("Stream Updated Event のエンコードに失敗 %v\n", err)
+		} else if err := tr.transmitTo(recv, raw); err != nil {
+			fmt.Printf("Stream Updated Event の送信に失敗 to RecvID(%s) %v\n", recv.ID, err)
+		}
+	}
+	switch to {
+	case StatusEnabled:
+		tr.resume(recv, subKey)
+	case StatusDisabled:
+		if n := len(tr.held.take(streamID, subKey)); n > 0 {
+			fmt.Printf("stream(%s) が disabled になったので保留していたイベントを %d 個捨てる\n", streamID, n)
+		}
+	}
+	return ret, nil
+}
+
+// resume は recv の Stream 宛に保留していたイベントのうち subKey のものを配送し直す
+// subKey が空の時は全てを配送し直す。まだ paused のものは再び保留される
+func (tr *tr) resume(recv *Receiver, subKey string) {
+	streamID := recv.StreamConf.StreamID
+	held := tr.held.take(streamID, subKey)
+	if len(held) == 0 {
+		return
+	}
+	if cur, err := tr.recvRepo.Load(recv.ID, streamID); err == nil {
+		recv = cur
+	}
+	// 一つの SET に同じ種類のイベントは含められないので、保留した順に一つずつ送る
+	for _, h := range held {
+		if err := tr.transmit([]Receiver{*recv}, h.event); err != nil {
+			fmt.Printf("保留していたイベントの送信に失敗 to RecvID(%s) %v\n", recv.ID, err)
+		}
+	}
+}
+
+// gate は recv の Stream とサブジェクトの status に従って events を振り分ける
+// enabled のものは返し、 paused のものは保留し、 disabled のものは捨てる
+func (tr *tr) gate(recv *Receiver, events []Event) []Event {
+	streamID := recv.StreamConf.StreamID
+	streamStatus := recv.status()
+	// batch でためている間に status が変わっていることもあるので、保存されている最新のものを使う
+	if cur, err := tr.recvRepo.Load(recv.ID, streamID); err == nil {
+		streamStatus = cur.status()
+	}
+	var ret []Event
+	for _, e := range events {
+		se, ok := e.(subjectEvent)
+		if !ok {
+			// Stream の制御のためのイベントは status に関わらず送る
+			ret = append(ret, e)
+			continue
+		}
+		subKey := se.eventSubject().Key()
+		status := streamStatus
+		if status == StatusEnabled {
+			// Stream に登録されていないサブジェクトは Stream 全体の status に従う
+			if s, err := tr.statusRepo.Load(recv.ID, streamID, subKey); err == nil && s.Status != "" {
+				status = s.Status
+			}
+		}
+		switch status {
+		case StatusEnabled:
+			ret = append(ret, e)
+		case StatusPaused:
+			tr.held.push(streamID, subKey, e)
+		default:
+			fmt.Printf("recvID(%s) の stream(%s) の subject(%s) は %s なので event(%s) を捨てる\n", recv.ID, streamID, subKey, status, e.Type())
+		}
+	}
+	return ret
+}
@@ -0,0 +1,202 @@
+package caep
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCanTransit(t *testing.T) {
+	for _, ok := range [][2]string{
+		{StatusEnabled, StatusPaused},
+		{StatusEnabled, StatusDisabled},
+		{StatusPaused, StatusEnabled},
+		{StatusPaused, StatusDisabled},
+		{StatusDisabled, StatusEnabled},
+	} {
+		if err := canTransit(ok[0], ok[1]); err != nil {
+			t.Errorf("%s から %s へ遷移できない %v", ok[0], ok[1], err)
+		}
+	}
+	for _, ng := range [][2]string{
+		{StatusDisabled, StatusPaused},
+		{StatusEnabled, "unknown"},
+	} {
+		if err := canTransit(ng[0], ng[1]); err == nil {
+			t.Errorf("%s から %s へ遷移できた", ng[0], ng[1])
+		}
+	}
+}
+
+func TestCanTransitBy(t *testing.T) {
+	// Transmitter が disabled にしたものは Transmitter しか戻せない
+	if err := canTransitBy(StatusDisabled, StatusEnabled, StatusChangedByTransmitter, StatusChangedByReceiver); !errors.Is(err, errDisabledByTransmitter) {
+		t.Errorf("Receiver が Transmitter の disabled を戻せた %v", err)
+	}
+	for _, by := range [][2]string{
+		{StatusChangedByTransmitter, StatusChangedByTransmitter},
+		{StatusChangedByReceiver, StatusChangedByReceiver},
+		{StatusChangedByReceiver, StatusChangedByTransmitter},
+	} {
+		if err := canTransitBy(StatusDisabled, StatusEnabled, by[0], by[1]); err != nil {
+			t.Errorf("%s が disabled にしたものを %s が戻せない %v", by[0], by[1], err)
+		}
+	}
+	if err := canTransitBy(StatusDisabled, StatusPaused, StatusChangedByReceiver, StatusChangedByTransmitter); err == nil {
+		t.Error("disabled から paused に遷移できた")
+	}
+}
+
+func TestChangeStatusRevoked(t *testing.T) {
+	tr, recv := newStatusTr(t)
+	alice := NewIssSub("https://idp.example", "alice")
+	tr.statusRepo.Save(recv.ID, &StreamStatus{StreamID: "stream1", Status: StatusEnabled, Subject: *alice, EventScopes: map[string][]string{"ctx1": {"s1"}}})
+	tr.changeStatus(recv, alice, StatusPaused, "test", StatusChangedByReceiver)
+	if _, err := tr.changeStatus(recv, alice, StatusDisabled, "RPT が失効した", StatusChangedByTransmitter); err != nil {
+		t.Fatal(err)
+	}
+	// 認可が取り消されたサブジェクトは Receiver からは戻せず、前の認可のスコープも残らない
+	if _, err := tr.changeStatus(recv, alice, StatusEnabled, "test", StatusChangedByReceiver); !errors.Is(err, errDisabledByTransmitter) {
+		t.Errorf("Receiver が取り消されたサブジェクトを enabled に戻せた %v", err)
+	}
+	got, _ := tr.statusRepo.Load(recv.ID, "stream1", alice.Key())
+	if got.Status != StatusDisabled || got.EventScopes != nil {
+		t.Errorf("取り消された後の status = %+v", got)
+	}
+}
+
+func TestChangeStatusHeldEvents(t *testing.T) {
+	tr, recv := newStatusTr(t)
+	alice, bob := NewIssSub("https://idp.example", "alice"), NewIssSub("https://idp.example", "bob")
+	for _, sub := range []*Subject{alice, bob} {
+		tr.statusRepo.Save(recv.ID, &StreamStatus{StreamID: "stream1", Status: StatusEnabled, Subject: *sub})
+	}
+	if _, err := tr.changeStatus(recv, alice, StatusPaused, "test", StatusChangedByReceiver); err != nil {
+		t.Fatal(err)
+	}
+	queued := func() []string {
+		sets, _ := tr.polls.peek("stream1", pollQueueLimit)
+		var ret []string
+		for _, s := range sets {
+			ret = append(ret, string(s.events))
+		}
+		tr.polls.ack("stream1", jtisOf(sets))
+		return ret
+	}
+	// paused に変えたことは Receiver に伝える
+	if got := queued(); len(got) != 1 || !strings.Contains(got[0], StreamUpdatedEventType) {
+		t.Fatalf("status 変更時に配送した SET = %v", got)
+	}
+
+	// paused のサブジェクト宛のイベントだけ保留する
+	tr.transmit([]Receiver{*recv}, &SSEEventClaim{ID: "ctx1", Subject: *alice})
+	tr.transmit([]Receiver{*recv}, &SSEEventClaim{ID: "ctx1", Subject: *bob})
+	if got := queued(); len(got) != 1 || !strings.Contains(got[0], `"sub":"bob"`) {
+		t.Fatalf("paused でない subject 宛の SET = %v", got)
+	}
+
+	// enabled に戻すと保留していたイベントを配送する
+	if _, err := tr.changeStatus(recv, alice, StatusEnabled, "test", StatusChangedByReceiver); err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(); len(got) != 2 || !strings.Contains(got[1], `"sub":"alice"`) {
+		t.Fatalf("enabled に戻した後の SET = %v", got)
+	}
+
+	// disabled にすると保留していたイベントは捨てる
+	tr.changeStatus(recv, alice, StatusPaused, "test", StatusChangedByReceiver)
+	tr.transmit([]Receiver{*recv}, &SSEEventClaim{ID: "ctx1", Subject: *alice})
+	tr.changeStatus(recv, alice, StatusDisabled, "test", StatusChangedByReceiver)
+	tr.changeStatus(recv, alice, StatusEnabled, "test", StatusChangedByReceiver)
+	for _, set := range queued() {
+		if strings.Contains(set, "ctx1") {
+			t.Errorf("disabled の間に捨てたはずのイベントを配送した %s", set)
+		}
+	}
+}
+
+func TestRemoveSubDropsHeldEvents(t *testing.T) {
+	tr, recv := newStatusTr(t)
+	tr.verifier = &stubVerifier{recvID: recv.ID}
+	alice := NewIssSub("https://idp.example", "alice")
+	tr.statusRepo.Save(recv.ID, &StreamStatus{StreamID: "stream1", Status: StatusPaused, Subject: *alice})
+	tr.transmit([]Receiver{*recv}, &SSEEventClaim{ID: "ctx1", Subject: *alice})
+
+	body, _ := json.Marshal(&ReqRemoveSub{StreamID: "stream1", Sub: *alice})
+	r := httptest.NewRequest(http.MethodPost, "/remove", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	tr.RemoveSub(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("remove = %d %s", w.Code, w.Body)
+	}
+	// 追加し直しても、削除する前に保留していたイベントは配送しない
+	if held := tr.held.take("stream1", alice.Key()); len(held) != 0 {
+		t.Errorf("削除したサブジェクト宛のイベントが保留されたまま %+v", held)
+	}
+}
+
+func TestPollOverflowResumes(t *testing.T) {
+	tr, recv := newStatusTr(t)
+	tr.verifier = &stubVerifier{recvID: recv.ID}
+	var jtis []string
+	for i := 0; i < pollQueueLimit; i++ {
+		jti := fmt.Sprintf("jti%d", i)
+		tr.polls.push("stream1", jti, json.RawMessage(`{}`))
+		jtis = append(jtis, jti)
+	}
+	tr.transmit([]Receiver{*recv}, &VerificationEvent{State: "overflow"})
+	if cur, _ := tr.recvRepo.Load(recv.ID, "stream1"); cur.status() != StatusPaused {
+		t.Fatalf("溢れた Stream の status = %s", cur.status())
+	}
+	// paused の間のイベントは保留する
+	alice := NewIssSub("https://idp.example", "alice")
+	tr.transmit([]Receiver{*recv}, &SSEEventClaim{ID: "ctx1", Subject: *alice})
+
+	poll := func(acks []string) {
+		body, _ := json.Marshal(&ReqPoll{ReturnImmediately: true, Acks: acks})
+		r := httptest.NewRequest(http.MethodPost, "/poll?stream_id=stream1", strings.NewReader(string(body)))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		tr.Poll(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("poll = %d %s", w.Code, w.Body)
+		}
+	}
+	// 少し受け取っただけではまだ再開しない
+	poll(jtis[:10])
+	if cur, _ := tr.recvRepo.Load(recv.ID, "stream1"); cur.status() != StatusPaused {
+		t.Fatalf("少し受け取っただけで status = %s", cur.status())
+	}
+	// 半分まで受け取ったら再開し、保留していたイベントを配送する
+	poll(jtis[10 : pollQueueLimit/2])
+	if cur, _ := tr.recvRepo.Load(recv.ID, "stream1"); cur.status() != StatusEnabled {
+		t.Fatalf("追いついた後の status = %s", cur.status())
+	}
+	sets, _ := tr.polls.peek("stream1", pollQueueLimit)
+	if last := string(sets[len(sets)-1].events); !strings.Contains(last, "ctx1") {
+		t.Errorf("保留していたイベントが配送されない %s", last)
+	}
+}
+
+// newStatusTr は Poll で配送する Stream を一つ持つ Transmitter を返す
+func newStatusTr(t *testing.T) (*tr, *Receiver) {
+	tr := newOutboxTr(t)
+	tr.pollURL = "https://cap.example/poll"
+	recv := &Receiver{ID: "rp1", Host: "https://rp1.example", StreamConf: &StreamConfig{StreamID: "stream1"}}
+	recv.StreamConf.Delivery.DeliveryMethod = DeliveryMethodPoll
+	tr.recvRepo.Save(recv)
+	return tr, recv
+}
+
+func jtisOf(sets []queuedSET) []string {
+	var ret []string
+	for _, s := range sets {
+		ret = append(ret, s.jti)
+	}
+	return ret
+}
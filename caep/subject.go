@@ -0,0 +1,255 @@
+package caep
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RFC 9493 で定められた Subject Identifier の形式
+const (
+	SubjectFormatIssSub      = "iss_sub"
+	SubjectFormatEmail       = "email"
+	SubjectFormatPhoneNumber = "phone_number"
+	SubjectFormatOpaque      = "opaque"
+	SubjectFormatAccount     = "account"
+	SubjectFormatDID         = "did"
+	SubjectFormatURI         = "uri"
+	SubjectFormatAliases     = "aliases"
+)
+
+// SubjectIdentifier は RFC 9493 の Subject Identifier を表す
+// Format によって使うフィールドが決まる
+type SubjectIdentifier struct {
+	Format string `json:"format"`
+	// Iss と Sub は iss_sub 形式で使う
+	Iss string `json:"iss,omitempty"`
+	Sub string `json:"sub,omitempty"`
+	// Email は email 形式で使う
+	Email string `json:"email,omitempty"`
+	// PhoneNumber は phone_number 形式で使う (E.164)
+	PhoneNumber string `json:"phone_number,omitempty"`
+	// ID は opaque 形式で使う
+	ID string `json:"id,omitempty"`
+	// URI は account 形式 (acct: URI) と uri 形式で使う
+	URI string `json:"uri,omitempty"`
+	// URL は did 形式で使う
+	URL string `json:"url,omitempty"`
+	// Identifiers は aliases 形式で使う。どれも同じ subject を指す
+	Identifiers []SubjectIdentifier `json:"identifiers,omitempty"`
+}
+
+// NewIssSub は iss_sub 形式の Subject を返す
+func NewIssSub(iss, sub string) *Subject {
+	return &Subject{SubjectIdentifier: SubjectIdentifier{Format: SubjectFormatIssSub, Iss: iss, Sub: sub}}
+}
+
+// validate は Format に必要なフィールドが揃っているか確かめる
+func (id *SubjectIdentifier) validate() error {
+	var ok bool
+	switch id.Format {
+	case SubjectFormatIssSub:
+		ok = id.Iss != "" && id.Sub != ""
+	case SubjectFormatEmail:
+		ok = id.Email != ""
+	case SubjectFormatPhoneNumber:
+		ok = id.PhoneNumber != ""
+	case SubjectFormatOpaque:
+		ok = id.ID != ""
+	case SubjectFormatAccount, SubjectFormatURI:
+		ok = id.URI != ""
+	case SubjectFormatDID:
+		ok = id.URL != ""
+	case SubjectFormatAliases:
+		ok = len(id.Identifiers) > 0
+		for _, i := range id.Identifiers {
+			if i.Format == SubjectFormatAliases {
+				return fmt.Errorf("caep: aliases の中に aliases は含められない")
+			}
+			if err := i.validate(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("caep: subject の format(%s) はサポートしていない", id.Format)
+	}
+	if !ok {
+		return fmt.Errorf("caep: format(%s) の subject に必要なフィールドがない", id.Format)
+	}
+	return nil
+}
+
+// Key は Subject Identifier を一意に表す文字列を返す
+// aliases の時は並び順によらず同じ値になるよう、 iss_sub の識別子を優先して、その中で辞書順で最初のものを返す
+// そのため iss_sub を含む aliases は、その iss_sub 単体の Subject Identifier と同じ Key になる
+func (id *SubjectIdentifier) Key() string {
+	switch id.Format {
+	case SubjectFormatIssSub:
+		return id.Format + ":" + id.Iss + ":" + id.Sub
+	case SubjectFormatEmail:
+		return id.Format + ":" + id.Email
+	case SubjectFormatPhoneNumber:
+		return id.Format + ":" + id.PhoneNumber
+	case SubjectFormatOpaque:
+		return id.Format + ":" + id.ID
+	case SubjectFormatAccount, SubjectFormatURI:
+		return id.Format + ":" + id.URI
+	case SubjectFormatDID:
+		return id.Format + ":" + id.URL
+	case SubjectFormatAliases:
+		var key string
+		issSub := false
+		for i := range id.Identifiers {
+			alias := &id.Identifiers[i]
+			k := alias.Key()
+			isIssSub := alias.Format == SubjectFormatIssSub
+			if key == "" || (isIssSub && !issSub) || (isIssSub == issSub && k < key) {
+				key, issSub = k, isIssSub
+			}
+		}
+		if key != "" {
+			return key
+		}
+	}
+	return id.Format
+}
+
+// Find は format の識別子を返す。 aliases の時はその中から探す
+func (id *SubjectIdentifier) Find(format string) (*SubjectIdentifier, bool) {
+	if id.Format == format {
+		return id, true
+	}
+	if id.Format == SubjectFormatAliases {
+		for i := range id.Identifiers {
+			if id.Identifiers[i].Format == format {
+				return &id.Identifiers[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Matches は id と o が同じ subject を指すか判定する
+// aliases の時はどれか一つの識別子が一致すれば良い
+func (id *SubjectIdentifier) Matches(o *SubjectIdentifier) bool {
+	for _, a := range id.flatten() {
+		for _, b := range o.flatten() {
+			if a.Key() == b.Key() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (id *SubjectIdentifier) flatten() []SubjectIdentifier {
+	if id.Format == SubjectFormatAliases {
+		return id.Identifiers
+	}
+	return []SubjectIdentifier{*id}
+}
+
+// Subject はイベントや Stream Management API で扱う subject を表す
+// 単純な Subject Identifier か、ユーザ・デバイス・セッションなどを組み合わせた複合的な subject のどちらか
+type Subject struct {
+	// SubjectIdentifier は単純な subject の時に使う
+	SubjectIdentifier
+	// 以降は複合的な subject の時に使う
+	User        *SubjectIdentifier `json:"user,omitempty"`
+	Device      *SubjectIdentifier `json:"device,omitempty"`
+	Session     *SubjectIdentifier `json:"session,omitempty"`
+	Application *SubjectIdentifier `json:"application,omitempty"`
+	Tenant      *SubjectIdentifier `json:"tenant,omitempty"`
+	OrgUnit     *SubjectIdentifier `json:"org_unit,omitempty"`
+	Group       *SubjectIdentifier `json:"group,omitempty"`
+}
+
+// complexSubject は複合的な subject の JSON 表現
+type complexSubject struct {
+	User        *SubjectIdentifier `json:"user,omitempty"`
+	Device      *SubjectIdentifier `json:"device,omitempty"`
+	Session     *SubjectIdentifier `json:"session,omitempty"`
+	Application *SubjectIdentifier `json:"application,omitempty"`
+	Tenant      *SubjectIdentifier `json:"tenant,omitempty"`
+	OrgUnit     *SubjectIdentifier `json:"org_unit,omitempty"`
+	Group       *SubjectIdentifier `json:"group,omitempty"`
+}
+
+// IsComplex は複合的な subject か判定する
+func (s *Subject) IsComplex() bool {
+	return s.Format == ""
+}
+
+// IsZero は subject が何も指定されていないか判定する
+func (s *Subject) IsZero() bool {
+	return s.IsComplex() && *s.complex() == complexSubject{}
+}
+
+// Principal は subject の主体となるユーザの識別子を返す
+// 複合的な subject の時は user を返し、なければ nil を返す
+func (s *Subject) Principal() *SubjectIdentifier {
+	if s.IsComplex() {
+		return s.User
+	}
+	return &s.SubjectIdentifier
+}
+
+// Key は subject の主体を一意に表す文字列を返す
+func (s *Subject) Key() string {
+	if p := s.Principal(); p != nil {
+		return p.Key()
+	}
+	return ""
+}
+
+// Validate は subject のフォーマットが正しいか確かめる
+func (s *Subject) Validate() error {
+	if !s.IsComplex() {
+		return s.SubjectIdentifier.validate()
+	}
+	c := s.complex()
+	ids := []*SubjectIdentifier{c.User, c.Device, c.Session, c.Application, c.Tenant, c.OrgUnit, c.Group}
+	n := 0
+	for _, id := range ids {
+		if id == nil {
+			continue
+		}
+		n++
+		if err := id.validate(); err != nil {
+			return err
+		}
+	}
+	if n == 0 {
+		return fmt.Errorf("caep: subject が空")
+	}
+	return nil
+}
+
+func (s *Subject) complex() *complexSubject {
+	return &complexSubject{s.User, s.Device, s.Session, s.Application, s.Tenant, s.OrgUnit, s.Group}
+}
+
+func (s Subject) MarshalJSON() ([]byte, error) {
+	if s.IsComplex() {
+		return json.Marshal(s.complex())
+	}
+	return json.Marshal(s.SubjectIdentifier)
+}
+
+func (s *Subject) UnmarshalJSON(b []byte) error {
+	var probe struct {
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return err
+	}
+	*s = Subject{}
+	if probe.Format != "" {
+		return json.Unmarshal(b, &s.SubjectIdentifier)
+	}
+	c := new(complexSubject)
+	if err := json.Unmarshal(b, c); err != nil {
+		return err
+	}
+	s.User, s.Device, s.Session, s.Application, s.Tenant, s.OrgUnit, s.Group = c.User, c.Device, c.Session, c.Application, c.Tenant, c.OrgUnit, c.Group
+	return nil
+}
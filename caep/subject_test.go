@@ -0,0 +1,91 @@
+package caep
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSubjectUnmarshal(t *testing.T) {
+	var simple Subject
+	if err := json.Unmarshal([]byte(`{"format":"iss_sub","iss":"https://idp.example","sub":"alice"}`), &simple); err != nil {
+		t.Fatal(err)
+	}
+	if want := NewIssSub("https://idp.example", "alice"); !reflect.DeepEqual(&simple, want) {
+		t.Errorf("iss_sub = %+v, want %+v", simple, want)
+	}
+
+	// format がないものは複合的な subject として読む
+	var complex Subject
+	if err := json.Unmarshal([]byte(`{"user":{"format":"iss_sub","iss":"https://idp.example","sub":"alice"},"device":{"format":"opaque","id":"dev1"}}`), &complex); err != nil {
+		t.Fatal(err)
+	}
+	if !complex.IsComplex() || complex.Device == nil || complex.Device.ID != "dev1" {
+		t.Fatalf("複合的な subject = %+v", complex)
+	}
+	if p := complex.Principal(); p == nil || p.Sub != "alice" {
+		t.Errorf("Principal() = %+v", p)
+	}
+	b, err := json.Marshal(complex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again Subject
+	if err := json.Unmarshal(b, &again); err != nil || !reflect.DeepEqual(again, complex) {
+		t.Errorf("%s を読み直すと %+v %v", b, again, err)
+	}
+}
+
+func TestSubjectValidate(t *testing.T) {
+	email := SubjectIdentifier{Format: SubjectFormatEmail, Email: "alice@example.com"}
+	for name, s := range map[string]Subject{
+		"iss_sub":      *NewIssSub("https://idp.example", "alice"),
+		"aliases":      {SubjectIdentifier: SubjectIdentifier{Format: SubjectFormatAliases, Identifiers: []SubjectIdentifier{email}}},
+		"複合的な subject": {User: &email},
+	} {
+		if err := s.Validate(); err != nil {
+			t.Errorf("%s を受け付けない %v", name, err)
+		}
+	}
+	for name, s := range map[string]Subject{
+		"sub がない iss_sub": *NewIssSub("https://idp.example", ""),
+		"知らない format":     {SubjectIdentifier: SubjectIdentifier{Format: "unknown", ID: "x"}},
+		"空の aliases":      {SubjectIdentifier: SubjectIdentifier{Format: SubjectFormatAliases}},
+		"入れ子の aliases": {SubjectIdentifier: SubjectIdentifier{Format: SubjectFormatAliases, Identifiers: []SubjectIdentifier{
+			{Format: SubjectFormatAliases, Identifiers: []SubjectIdentifier{email}},
+		}}},
+		"空の複合的な subject": {},
+		"device が不完全":    {User: &email, Device: &SubjectIdentifier{Format: SubjectFormatOpaque}},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("%s を受け付けた", name)
+		}
+	}
+}
+
+func TestSubjectKey(t *testing.T) {
+	issSub := SubjectIdentifier{Format: SubjectFormatIssSub, Iss: "https://idp.example", Sub: "alice"}
+	email := SubjectIdentifier{Format: SubjectFormatEmail, Email: "alice@example.com"}
+	phone := SubjectIdentifier{Format: SubjectFormatPhoneNumber, PhoneNumber: "+81900000000"}
+	aliases := func(ids ...SubjectIdentifier) *Subject {
+		return &Subject{SubjectIdentifier: SubjectIdentifier{Format: SubjectFormatAliases, Identifiers: ids}}
+	}
+
+	// aliases は並び順によらず、 iss_sub を含めばその iss_sub 単体と同じ Key になる
+	want := issSub.Key()
+	for _, s := range []*Subject{aliases(email, issSub), aliases(issSub, email), aliases(phone, issSub, email), {User: &issSub, Device: &phone}} {
+		if got := s.Key(); got != want {
+			t.Errorf("%+v の Key() = %s, want %s", s, got, want)
+		}
+	}
+	if a, b := aliases(phone, email).Key(), aliases(email, phone).Key(); a != b {
+		t.Errorf("iss_sub のない aliases の Key() が並び順で変わる %s %s", a, b)
+	}
+	if a, b := aliases(email).Key(), aliases(phone).Key(); a == b {
+		t.Errorf("異なる subject の Key() が同じ %s", a)
+	}
+	// 一つでも識別子が一致すれば同じ subject とみなす
+	if !aliases(email, phone).Matches(&phone) || aliases(email).Matches(&phone) {
+		t.Error("aliases の Matches() が正しくない")
+	}
+}
@@ -1,12 +1,18 @@
 package caep
 
 import (
-	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"mime"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -17,46 +23,121 @@ import (
 // TransConf は caep の Transmitter を構築するための設定情報を表す
 type TransConf struct {
 	Tr *Transmitter
+	// SigAlg は SET の署名アルゴリズム。空の時は RS256
+	SigAlg jwa.SignatureAlgorithm
+	// SigKey は SET の署名鍵 (*rsa.PrivateKey か *ecdsa.PrivateKey)
+	// nil の時は起動時に生成する
+	SigKey crypto.Signer
+	// SigKeyID は署名鍵の kid 。空の時は JWK Thumbprint を使う
+	SigKeyID string
+	// PollEndpoint は Poll で SET を配送する時の Poll エンドポイント (RFC 8936)
+	// 空の時は Poll での配送を受け付けない
+	PollEndpoint string
+	// MaxDeliveryAttempts は Push で配送を試みる最大回数。超えると dead letter に移す
+	// 0 の時は 8 回
+	MaxDeliveryAttempts int
+	// BatchWindow が 0 より大きい時は、同じ Receiver の同じ subject に対するコンテキストの変更を
+	// BatchWindow の間ためて一つの SET にまとめて送る
+	BatchWindow time.Duration
+	// HTTPClient は Push で SET を配送する時に使う。 nil の時は http.DefaultClient
+	HTTPClient *http.Client
 }
 
 // New は設定情報から caep の transmitter を構築する
-func (c *TransConf) New(recvRepo RecvRepo, subStatusRepo SubStatusRepo, verifier Verifier) Tr {
-	return &tr{
-		conf:       c.Tr,
-		recvRepo:   recvRepo,
-		statusRepo: subStatusRepo,
-		verifier:   verifier,
+// 署名鍵の構成に失敗するとパニック
+func (c *TransConf) New(recvRepo RecvRepo, subStatusRepo SubStatusRepo, outbox OutboxRepo, verifier Verifier) Tr {
+	signer, err := newSigner(c.SigAlg, c.SigKey, c.SigKeyID)
+	if err != nil {
+		panic(fmt.Sprintf("SET の署名鍵の構成に失敗 %v", err))
+	}
+	maxAttempts := c.MaxDeliveryAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxDeliveryAttempts
+	}
+	tr := &tr{
+		conf:        c.Tr,
+		recvRepo:    recvRepo,
+		statusRepo:  subStatusRepo,
+		verifier:    verifier,
+		client:      httpClientOr(c.HTTPClient),
+		signer:      signer,
+		pollURL:     c.PollEndpoint,
+		polls:       newPollQueue(),
+		outbox:      outbox,
+		maxAttempts: maxAttempts,
+		kick:        make(chan struct{}, 1),
+		delivering:  make(map[string]bool),
+		held:        newHoldQueue(),
+		deliveries:  make(map[string]Delivery),
 	}
+	if c.BatchWindow > 0 {
+		tr.batch = newBatcher(c.BatchWindow, tr.transmitNow)
+	}
+	go tr.deliverLoop()
+	return tr
 }
 
 // Tr は CAEP の Transmitter を表す
 type Tr interface {
 	// Router は CAEP Transmitter Endpoint を mux.Router に構築する
 	Router(r *mux.Router)
-	// Transmit は aud に event を送信する
-	Transmit(aud []Receiver, event *SSEEventClaim) error
+	// Transmit は aud に events を一つの SET にまとめて送信する。同じ種類のイベントは一つしか含められない
+	// Push で配送する SET は Outbox に入れ、配送できるまで再送する
+	// BatchWindow を設定している時、コンテキストの変更 (*SSEEventClaim) は後でまとめて送るので送信の失敗はログに出るだけ
+	Transmit(aud []Receiver, events ...Event) error
+	// Outbox は recvID 宛の配送待ちの SET を返す。 recvID が空文字の時は全てを返す
+	Outbox(recvID string) ([]OutboxSET, error)
+	// DeadLetters は recvID 宛の配送を諦めた SET を返す。 recvID が空文字の時は全てを返す
+	DeadLetters(recvID string) ([]OutboxSET, error)
+	// Replay は dead letter にある SET を Outbox (Poll の時は Poll 待ちの SET) に戻して再び配送する
+	Replay(recvID, jti string) error
+	// LastDelivery は recvID 宛の最後の Push 配送の結果を返す。まだ配送を試みていなければ false
+	LastDelivery(recvID string) (*Delivery, bool)
+	// UpdateStatus は recvID の streamID の Stream の status を変更する。 sub が nil でなければサブジェクトの status を変更する
+	// 変更すると Receiver に Stream Updated Event で reason と共に伝える
+	UpdateStatus(recvID, streamID string, sub *Subject, status, reason string) error
+	// UpdateScopes は recvID の streamID の Stream でサブジェクトに認可しているスコープを update で変更する
+	// update は status の変更と同じロックの中で呼ばれ、変更後のスコープと変更したかを返す
+	// 変更すると Stream Updated Event で reason と共に伝え、スコープがなくなればサブジェクトを disabled にする
+	UpdateScopes(recvID, streamID string, sub *Subject, update func(status *StreamStatus) (map[string][]string, bool), reason string) error
 }
 
-// RecvRepo は Transmitter が管轄している Receiver を永続化する
+// RecvRepo は Transmitter が管轄している Receiver とその Stream を永続化する
 type RecvRepo interface {
-	Load(recvID string) (*Receiver, error)
+	// Registration は recvID の Receiver の登録情報を返す
+	// StreamConf は Stream を作る時の雛形 (iss, aud, events_supported) になる
+	Registration(recvID string) (*Receiver, error)
+	// Load は recvID の streamID の Stream を返す
+	Load(recvID, streamID string) (*Receiver, error)
+	// List は recvID の全ての Stream を返す
+	List(recvID string) ([]Receiver, error)
+	// Save は Stream を StreamConf.StreamID で保存する
 	Save(*Receiver) error
+	// Delete は recvID の streamID の Stream を削除する
+	Delete(recvID, streamID string) error
 }
 
-// SubStatusRepo は Transmitter が管轄している Receiver のサブジェクトごとの status を永続化する
+// SubStatusRepo は Transmitter が管轄している Receiver の Stream のサブジェクトごとの status を永続化する
+// サブジェクトは Subject.Key() で識別する
 type SubStatusRepo interface {
-	Load(recvID, spagID string) (*StreamStatus, error)
+	Load(recvID, streamID, subKey string) (*StreamStatus, error)
+	// Save は status.StreamID の Stream での status を保存する
 	Save(recvID string, status *StreamStatus) error
+	// Delete は Receiver の Stream からサブジェクトを削除する
+	Delete(recvID, streamID, subKey string) error
+	// DeleteStream は削除された Stream の全てのサブジェクトの status を削除する
+	DeleteStream(recvID, streamID string) error
 }
 
 // Verifier は Receiver が Event Stream Management API を叩く時の認可情報を検証する
 // また、認可情報から recveiver を識別する
 // Status のときは ReqChangeOfStreamStatus の認可情報を見てそれに基づいて更新した status を返す
 // AddSub のときは ReqAddSub を authHeader の認可情報を見てそれに基づいて更新した status を返す
+// ctx は Receiver からの要求のもので、検証のために外部にアクセスする時に使う
 type Verifier interface {
-	Stream(authHeader string) (recvID string, err error)
-	Status(authHeader string, req *ReqChangeOfStreamStatus) (recvID string, status *StreamStatus, err error)
-	AddSub(authHeader string, req *ReqAddSub) (recvID string, status *StreamStatus, err error)
+	Stream(ctx context.Context, authHeader string) (recvID string, err error)
+	Status(ctx context.Context, authHeader string, req *ReqChangeOfStreamStatus) (recvID string, status *StreamStatus, err error)
+	AddSub(ctx context.Context, authHeader string, req *ReqAddSub) (recvID string, status *StreamStatus, err error)
 }
 
 type TransError interface {
@@ -73,7 +154,8 @@ const (
 	// option として *http.Response が含まれるが、Body は読めない
 	TransErrorUnAuthorized
 	_
-	_
+	// TransErrorForbidden は 403 error
+	TransErrorForbidden
 	// TransErrorNotFound は 404 error
 	TransErrorNotFound
 )
@@ -83,30 +165,84 @@ type tr struct {
 	recvRepo   RecvRepo
 	statusRepo SubStatusRepo
 	verifier   Verifier
+	client     *http.Client
+	signer     *signer
+	pollURL    string
+	polls      *pollQueue
+	// outbox は Push で配送待ちの SET を保持する
+	outbox      OutboxRepo
+	maxAttempts int
+	// kick は配送ループに Outbox を見直させる
+	kick chan struct{}
+	// delivering は配送中の Stream を表す。一つの Stream 宛の SET は一度に一つずつ配送する
+	deliveringM sync.Mutex
+	delivering  map[string]bool
+	// batch が nil でなければコンテキストの変更をまとめて送る
+	batch *batcher
+	// held は paused の Stream やサブジェクト宛のイベントを保留する
+	held *holdQueue
+	// statusM は status の遷移を直列にする
+	statusM sync.Mutex
+	// deliveries は Receiver ごとの最後の Push 配送の結果
+	deliveriesM sync.RWMutex
+	deliveries  map[string]Delivery // recvID -> delivery
 }
 
 func (tr *tr) Router(r *mux.Router) {
 	r.HandleFunc("/.well-known/sse-configuration", tr.WellKnown)
+	if tr.conf.JwksURI != "" {
+		u, err := url.Parse(tr.conf.JwksURI)
+		if err != nil {
+			panic("設定をミスってるよ" + err.Error())
+		}
+		r.Path(u.Path).Methods("GET").HandlerFunc(tr.JWKS)
+	}
 	u, err := url.Parse(tr.conf.ConfigurationEndpoint)
 	if err != nil {
 		panic("設定をミスってるよ" + err.Error())
 	}
 	r.PathPrefix(u.Path).Methods("GET").HandlerFunc(tr.ReadStreamConfig)
-	r.PathPrefix(u.Path).Methods("POST").HandlerFunc(tr.UpdateStreamConfig)
+	r.PathPrefix(u.Path).Methods("POST").HandlerFunc(tr.CreateStreamConfig)
+	r.PathPrefix(u.Path).Methods("PUT").HandlerFunc(tr.ReplaceStreamConfig)
+	r.PathPrefix(u.Path).Methods("PATCH").HandlerFunc(tr.PatchStreamConfig)
+	r.PathPrefix(u.Path).Methods("DELETE").HandlerFunc(tr.DeleteStreamConfig)
 	u, err = url.Parse(tr.conf.StatusEndpoint)
 	if err != nil {
 		panic("設定をミスってるよ" + err.Error())
 	}
-	r.PathPrefix(u.Path + "/{spag}").Methods("GET").HandlerFunc(tr.ReadStreamStatus)
+	r.Path(u.Path).Methods("GET").HandlerFunc(tr.ReadStreamStatus)
+	r.Path(u.Path).Methods("POST").HandlerFunc(tr.UpdateStreamStatus)
 	u, err = url.Parse(tr.conf.AddSubjectEndpoint)
 	if err != nil {
 		panic("設定をミスってるよ" + err.Error())
 	}
 	r.PathPrefix(u.Path).Methods("POST").HandlerFunc(tr.AddSub)
+	if tr.conf.RemoveSubjectEndpoint != "" {
+		u, err = url.Parse(tr.conf.RemoveSubjectEndpoint)
+		if err != nil {
+			panic("設定をミスってるよ" + err.Error())
+		}
+		r.PathPrefix(u.Path).Methods("POST").HandlerFunc(tr.RemoveSub)
+	}
+	if tr.conf.VerificationEndpoint != "" {
+		u, err = url.Parse(tr.conf.VerificationEndpoint)
+		if err != nil {
+			panic("設定をミスってるよ" + err.Error())
+		}
+		r.PathPrefix(u.Path).Methods("POST").HandlerFunc(tr.Verify)
+	}
+	if tr.pollURL != "" {
+		u, err = url.Parse(tr.pollURL)
+		if err != nil {
+			panic("設定をミスってるよ" + err.Error())
+		}
+		r.Path(u.Path).Methods("POST").HandlerFunc(tr.Poll)
+	}
 }
 
 func (tr *tr) WellKnown(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=3600")
 	if err := tr.conf.Write(w); err != nil {
 		http.Error(w, "失敗", http.StatusInternalServerError)
 		return
@@ -115,7 +251,7 @@ func (tr *tr) WellKnown(w http.ResponseWriter, r *http.Request) {
 
 func (tr *tr) ReadStreamStatus(w http.ResponseWriter, r *http.Request) {
 	// Token の検証をして、対応する Receiver を識別する (Sec.9)
-	recvID, _, err := tr.verifier.Status(r.Header.Get("Authorization"), nil)
+	recvID, _, err := tr.verifier.Status(r.Context(), r.Header.Get("Authorization"), nil)
 	if err != nil {
 		if err, ok := err.(TransError); ok {
 			if err.Code() == TransErrorUnAuthorized {
@@ -129,13 +265,30 @@ func (tr *tr) ReadStreamStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// spagID の status を調べようとしているかチェック
-	spagID := mux.Vars(r)["spag"]
-	status, err := tr.statusRepo.Load(recvID, spagID)
+	recv, err := tr.stream(recvID, r.URL.Query().Get("stream_id"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	// subject の指定がなければ Stream 全体の status を返す
+	status := &StreamStatus{StreamID: recv.StreamConf.StreamID, Status: recv.status()}
+	if q := r.URL.Query().Get("subject"); q != "" {
+		// どの subject の status を調べようとしているかチェック
+		sub := new(Subject)
+		if err := json.Unmarshal([]byte(q), sub); err != nil {
+			http.Error(w, fmt.Sprintf("subject のパースに失敗 %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := sub.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err = tr.statusRepo.Load(recvID, recv.StreamConf.StreamID, sub.Key())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(status); err != nil {
 		http.Error(w, "失敗", http.StatusInternalServerError)
@@ -156,11 +309,15 @@ func (tr *tr) UpdateStreamStatus(w http.ResponseWriter, r *http.Request) {
 	}
 	reqStatus := new(ReqChangeOfStreamStatus)
 	if err := json.NewDecoder(r.Body).Decode(reqStatus); err != nil {
-		http.Error(w, "status update 要求のパースに失敗", http.StatusNotFound)
+		http.Error(w, "status update 要求のパースに失敗", http.StatusBadRequest)
+		return
+	}
+	if !contains([]string{StatusEnabled, StatusPaused, StatusDisabled}, reqStatus.Status) {
+		http.Error(w, fmt.Sprintf("status(%s) は enabled, paused, disabled のいずれか", reqStatus.Status), http.StatusBadRequest)
 		return
 	}
 	// Token の検証をして、対応する Receiver を識別する (Sec.9)
-	recvID, status, err := tr.verifier.Status(r.Header.Get("Authorization"), reqStatus)
+	recvID, _, err := tr.verifier.Status(r.Context(), r.Header.Get("Authorization"), reqStatus)
 	if err != nil {
 		if err, ok := err.(TransError); ok {
 			if err.Code() == TransErrorUnAuthorized {
@@ -169,12 +326,36 @@ func (tr *tr) UpdateStreamStatus(w http.ResponseWriter, r *http.Request) {
 					w.Header().Set(k, v)
 				}
 			}
+			if err.Code() == TransErrorForbidden {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
 		}
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	if err := tr.statusRepo.Save(recvID, status); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	recv, err := tr.stream(recvID, reqStatus.StreamID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// subject の指定がなければ Stream 全体の status を変更する
+	var sub *Subject
+	if !reqStatus.Subject.IsZero() {
+		sub = &reqStatus.Subject
+		// Receiver が変更できるのは status だけで、 event scopes は add subject 時の認可に従う
+		if _, err := tr.statusRepo.Load(recvID, recv.StreamConf.StreamID, sub.Key()); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	status, err := tr.changeStatus(recv, sub, reqStatus.Status, reqStatus.Reason, StatusChangedByReceiver)
+	if err != nil {
+		if errors.Is(err, errDisabledByTransmitter) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -186,7 +367,7 @@ func (tr *tr) UpdateStreamStatus(w http.ResponseWriter, r *http.Request) {
 
 func (tr *tr) ReadStreamConfig(w http.ResponseWriter, r *http.Request) {
 	// Token の検証をして、対応する Receiver を識別する (Sec.9)
-	recvID, err := tr.verifier.Stream(r.Header.Get("Authorization"))
+	recvID, err := tr.verifier.Stream(r.Context(), r.Header.Get("Authorization"))
 	if err != nil {
 		if err, ok := err.(TransError); ok {
 			if err.Code() == TransErrorUnAuthorized {
@@ -199,9 +380,28 @@ func (tr *tr) ReadStreamConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	recv, err := tr.recvRepo.Load(recvID)
+	streamID := r.URL.Query().Get("stream_id")
+	if streamID == "" {
+		// stream_id の指定がなければ Receiver の全ての Stream を返す
+		recvs, err := tr.recvRepo.List(recvID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		confs := []*StreamConfig{}
+		for _, recv := range recvs {
+			confs = append(confs, recv.StreamConf)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(confs); err != nil {
+			http.Error(w, "失敗", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+	recv, err := tr.recvRepo.Load(recvID, streamID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -211,9 +411,65 @@ func (tr *tr) ReadStreamConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (tr *tr) UpdateStreamConfig(w http.ResponseWriter, r *http.Request) {
+// CreateStreamConfig は Receiver の登録情報を雛形にして新しい Stream を作る
+func (tr *tr) CreateStreamConfig(w http.ResponseWriter, r *http.Request) {
+	recvID, req, ok := tr.parseStreamConfigReq(w, r)
+	if !ok {
+		return
+	}
+	if req.StreamID != "" {
+		http.Error(w, "既存の Stream の設定は PUT か PATCH で更新する", http.StatusBadRequest)
+		return
+	}
+	recv, err := tr.recvRepo.Registration(recvID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	conf := *recv.StreamConf
+	conf.StreamID, err = newStreamID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recv.StreamConf = &conf
+	recv.StreamConf.Replace(req)
+	tr.saveStreamConfig(w, recv, http.StatusCreated)
+}
+
+// ReplaceStreamConfig は stream_id の Stream の Receiver が設定できるフィールドを要求のもので置き換える
+func (tr *tr) ReplaceStreamConfig(w http.ResponseWriter, r *http.Request) {
+	recvID, req, ok := tr.parseStreamConfigReq(w, r)
+	if !ok {
+		return
+	}
+	recv, ok := tr.loadStreamConfig(w, recvID, req.StreamID)
+	if !ok {
+		return
+	}
+	recv.StreamConf.Replace(req)
+	tr.saveStreamConfig(w, recv, http.StatusOK)
+}
+
+// PatchStreamConfig は stream_id の Stream の設定のうち要求に含まれるフィールドだけを更新する
+func (tr *tr) PatchStreamConfig(w http.ResponseWriter, r *http.Request) {
+	recvID, req, ok := tr.parseStreamConfigReq(w, r)
+	if !ok {
+		return
+	}
+	recv, ok := tr.loadStreamConfig(w, recvID, req.StreamID)
+	if !ok {
+		return
+	}
+	recv.StreamConf.Merge(req.receiverSettable())
+	tr.saveStreamConfig(w, recv, http.StatusOK)
+}
+
+// parseStreamConfigReq は Stream の設定の作成・更新要求を検証してパースする
+// 失敗した時はエラーを応答して ok を false にする
+func (tr *tr) parseStreamConfigReq(w http.ResponseWriter, r *http.Request) (recvID string, req *StreamConfig, ok bool) {
 	// Token の検証をして、対応する Receiver を識別する (Sec.9)
-	recvID, err := tr.verifier.Stream(r.Header.Get("Authorization"))
+	recvID, err := tr.verifier.Stream(r.Context(), r.Header.Get("Authorization"))
 	if err != nil {
 		if err, ok := err.(TransError); ok {
 			if err.Code() == TransErrorUnAuthorized {
@@ -224,34 +480,141 @@ func (tr *tr) UpdateStreamConfig(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
+		return "", nil, false
 	}
-	req := new(StreamConfig)
+	req = new(StreamConfig)
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-		http.Error(w, "status update 要求のパースに失敗", http.StatusNotFound)
-		return
+		http.Error(w, fmt.Sprintf("stream config のパースに失敗 %v", err), http.StatusBadRequest)
+		return "", nil, false
 	}
-	recv, err := tr.recvRepo.Load(recvID)
+	return recvID, req, true
+}
+
+// loadStreamConfig は更新する Stream を読み込む
+// 失敗した時はエラーを応答して ok を false にする
+func (tr *tr) loadStreamConfig(w http.ResponseWriter, recvID, streamID string) (*Receiver, bool) {
+	if streamID == "" {
+		http.Error(w, "更新する Stream の stream_id がない", http.StatusBadRequest)
+		return nil, false
+	}
+	recv, err := tr.recvRepo.Load(recvID, streamID)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	// 検証に失敗した時に保存済みの設定を書き換えてしまわないようコピーする
+	conf := *recv.StreamConf
+	recv.StreamConf = &conf
+	return recv, true
+}
+
+// saveStreamConfig は作成・更新した Stream の設定を検証して保存し、 Receiver に返す
+// events_delivered は events_requested と events_supported の共通部分として計算し直す
+func (tr *tr) saveStreamConfig(w http.ResponseWriter, recv *Receiver, status int) {
+	c := recv.StreamConf
+	if err := tr.validateStreamConfig(c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.Delivery.DeliveryMethod == DeliveryMethodPoll {
+		// Poll の時の配送先は Transmitter が Stream ごとに決める (RFC 8936 Sec.2)
+		c.Delivery.URL = tr.pollURLFor(c.StreamID)
+	}
+	c.computeDelivered()
+	if err := tr.recvRepo.Save(recv); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if ismodified := recv.StreamConf.Update(req); ismodified {
-		for _, e := range recv.StreamConf.EventsRequested {
-			if contains(recv.StreamConf.EventsSupported, e) {
-				recv.StreamConf.EventsDelivered = append(recv.StreamConf.EventsDelivered, e)
-			}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		http.Error(w, "失敗", http.StatusInternalServerError)
+		return
+	}
+}
+
+// validateStreamConfig は Stream の設定が Transmitter で扱えるものか確かめる
+func (tr *tr) validateStreamConfig(c *StreamConfig) error {
+	method := c.Delivery.DeliveryMethod
+	if len(tr.conf.DeliveryMethodsSupported) > 0 && !contains(tr.conf.DeliveryMethodsSupported, method) {
+		return fmt.Errorf("delivery_method(%s) はサポートしていない", method)
+	}
+	switch method {
+	case DeliveryMethodPush:
+		u, err := url.Parse(c.Delivery.URL)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("Push の配送先 url(%s) が絶対 URL ではない", c.Delivery.URL)
 		}
-		if err := tr.recvRepo.Save(recv); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	case DeliveryMethodPoll:
+		if tr.pollURL == "" {
+			return fmt.Errorf("Poll での配送はサポートしていない")
 		}
+	default:
+		return fmt.Errorf("delivery_method(%s) はサポートしていない", method)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(recv.StreamConf); err != nil {
-		http.Error(w, "失敗", http.StatusInternalServerError)
+	if c.Encryption != nil {
+		// 暗号化できない設定を保存すると、後で全ての配送に失敗する
+		return c.Encryption.validate()
+	}
+	return nil
+}
+
+// DeleteStreamConfig は stream_id の Stream を削除する
+// その Stream のサブジェクトの status と、まだ配送していない SET も捨てる
+func (tr *tr) DeleteStreamConfig(w http.ResponseWriter, r *http.Request) {
+	// Token の検証をして、対応する Receiver を識別する (Sec.9)
+	recvID, err := tr.verifier.Stream(r.Context(), r.Header.Get("Authorization"))
+	if err != nil {
+		if err, ok := err.(TransError); ok {
+			if err.Code() == TransErrorUnAuthorized {
+				headers := err.Option().(map[string]string)
+				for k, v := range headers {
+					w.Header().Set(k, v)
+				}
+			}
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	streamID := r.URL.Query().Get("stream_id")
+	if _, err := tr.recvRepo.Load(recvID, streamID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if err := tr.recvRepo.Delete(recvID, streamID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tr.statusRepo.DeleteStream(recvID, streamID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if tr.batch != nil {
+		tr.batch.drop(recvID, streamID)
+	}
+	tr.held.take(streamID, "")
+	tr.polls.drop(streamID)
+	if err := tr.dropOutbox(recvID, streamID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stream は recvID の streamID の Stream を返す
+// streamID が空の時は Receiver が Stream を一つしか持っていなければそれを返す
+func (tr *tr) stream(recvID, streamID string) (*Receiver, error) {
+	if streamID != "" {
+		return tr.recvRepo.Load(recvID, streamID)
+	}
+	recvs, err := tr.recvRepo.List(recvID)
+	if err != nil {
+		return nil, err
+	}
+	if len(recvs) != 1 {
+		return nil, fmt.Errorf("recvID(%s) は Stream を %d 個持っているので stream_id を指定する必要がある", recvID, len(recvs))
+	}
+	return &recvs[0], nil
 }
 
 func (tr *tr) AddSub(w http.ResponseWriter, r *http.Request) {
@@ -270,9 +633,13 @@ func (tr *tr) AddSub(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("フォーマットに失敗 %v", err), http.StatusBadRequest)
 		return
 	}
+	if err := req.Sub.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Token の検証をして、対応する Receiver を識別する (Sec.9)
-	recvID, status, err := tr.verifier.AddSub(r.Header.Get("Authorization"), req)
+	recvID, status, err := tr.verifier.AddSub(r.Context(), r.Header.Get("Authorization"), req)
 	if err != nil {
 		if err, ok := err.(TransError); ok {
 			if err.Code() == TransErrorUnAuthorized {
@@ -291,42 +658,243 @@ func (tr *tr) AddSub(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
-	if err := tr.statusRepo.Save(recvID, status); err != nil {
+	recv, err := tr.stream(recvID, req.StreamID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	status.StreamID = recv.StreamConf.StreamID
+	tr.statusM.Lock()
+	err = tr.statusRepo.Save(recvID, status)
+	tr.statusM.Unlock()
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// 追加し直したサブジェクトが paused だった時に保留していたものを配送する
+	tr.resume(recv, status.Subject.Key())
 	return
 }
 
-func (tr *tr) Transmit(aud []Receiver, event *SSEEventClaim) error {
-	t := jwt.New()
-	t.Set(jwt.IssuerKey, tr.conf.Issuer)
-	for _, r := range aud {
-		t.Set(jwt.AudienceKey, r.Host)
+func (tr *tr) RemoveSub(w http.ResponseWriter, r *http.Request) {
+	// 要求をパースする
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	t.Set(jwt.IssuedAtKey, time.Now())
-	t.Set(jwt.JwtIDKey, "metyakutya-random")
-	t.Set("events", event.ToClaim())
+	if contentType != "application/json" {
+		http.Error(w, "unmached content-type", http.StatusBadRequest)
+		return
+	}
+	req := new(ReqRemoveSub)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("フォーマットに失敗 %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := req.Sub.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Token の検証をして、対応する Receiver を識別する (Sec.9)
+	recvID, err := tr.verifier.Stream(r.Context(), r.Header.Get("Authorization"))
+	if err != nil {
+		if err, ok := err.(TransError); ok {
+			if err.Code() == TransErrorUnAuthorized {
+				headers := err.Option().(map[string]string)
+				for k, v := range headers {
+					w.Header().Set(k, v)
+				}
+			}
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	recv, err := tr.stream(recvID, req.StreamID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	streamID := recv.StreamConf.StreamID
+	if _, err := tr.statusRepo.Load(recvID, streamID, req.Sub.Key()); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := tr.statusRepo.Delete(recvID, streamID, req.Sub.Key()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// 削除したサブジェクト宛に保留していたイベントはもう配送しない
+	tr.held.take(streamID, req.Sub.Key())
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	ss, err := jwt.Sign(t, jwa.HS256, []byte("secret-hs-256-key"))
+func (tr *tr) Verify(w http.ResponseWriter, r *http.Request) {
+	// 要求をパースする
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
-		return err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	fmt.Printf("署名したよ %s\n", ss)
-	for _, recv := range aud {
-		req, err := http.NewRequest(http.MethodPost, recv.StreamConf.Delivery.URL, bytes.NewBuffer(ss))
+	if contentType != "application/json" {
+		http.Error(w, "unmached content-type", http.StatusBadRequest)
+		return
+	}
+	req := new(ReqVerification)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("フォーマットに失敗 %v", err), http.StatusBadRequest)
+		return
+	}
+	// Token の検証をして、対応する Receiver を識別する (Sec.9)
+	recvID, err := tr.verifier.Stream(r.Context(), r.Header.Get("Authorization"))
+	if err != nil {
+		if err, ok := err.(TransError); ok {
+			if err.Code() == TransErrorUnAuthorized {
+				headers := err.Option().(map[string]string)
+				for k, v := range headers {
+					w.Header().Set(k, v)
+				}
+			}
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	recv, err := tr.stream(recvID, req.StreamID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// Verification Event は Stream の配送経路で非同期に送る
+	ev := &VerificationEvent{State: req.State}
+	go func() {
+		if err := tr.transmit([]Receiver{*recv}, ev); err != nil {
+			fmt.Printf("Verification Event の送信に失敗 to RecvID(%s) %v\n", recvID, err)
+		}
+	}()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (tr *tr) Transmit(aud []Receiver, events ...Event) error {
+	if tr.batch == nil {
+		return tr.transmitNow(aud, events...)
+	}
+	var rest []Event
+	for _, e := range events {
+		c, ok := e.(*SSEEventClaim)
+		if !ok {
+			rest = append(rest, e)
+			continue
+		}
+		for _, recv := range aud {
+			tr.batch.add(recv, c)
+		}
+	}
+	if len(rest) == 0 {
+		return nil
+	}
+	return tr.transmitNow(aud, rest...)
+}
+
+// transmitNow は events を一つの SET にしてすぐに送信する
+func (tr *tr) transmitNow(aud []Receiver, events ...Event) error {
+	if len(events) == 0 {
+		return fmt.Errorf("caep: 送信するイベントがない")
+	}
+	if len(eventsClaim(events...)) != len(events) {
+		return fmt.Errorf("caep: 一つの SET に同じ種類のイベントは含められない")
+	}
+	return tr.transmit(aud, events...)
+}
+
+// transmit は events を SET の events クレームとして aud のそれぞれの Stream に送信する
+// 同じ Receiver が複数の Stream を持つこともあるので、 jti は Stream ごとに分ける
+// Stream やサブジェクトが enabled でないイベントは gate で保留するか捨てる
+// SET は配送する度に sign で Stream ごとに署名する
+func (tr *tr) transmit(aud []Receiver, events ...Event) error {
+	// 一つの Stream への送信に失敗しても残りの Stream には送り、失敗したものをまとめて返す
+	var failed []string
+	for i := range aud {
+		deliverable := tr.gate(&aud[i], events)
+		if len(deliverable) == 0 {
+			continue
+		}
+		raw, err := json.Marshal(eventsClaim(deliverable...))
 		if err != nil {
 			return err
 		}
-		req.Header.Set("Content-Type", "application/secevent+jwt")
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
+		if err := tr.transmitTo(&aud[i], raw); err != nil {
+			failed = append(failed, fmt.Sprintf("recvID(%s) stream(%s): %v", aud[i].ID, aud[i].StreamConf.StreamID, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("caep: %d 個の Stream への送信に失敗 %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// transmitTo は recv の Stream に送る SET に jti を振って配送を待つ
+func (tr *tr) transmitTo(recv *Receiver, events json.RawMessage) error {
+	jti, err := newJTI()
+	if err != nil {
+		return err
+	}
+	if recv.StreamConf.Delivery.DeliveryMethod != DeliveryMethodPoll {
+		return tr.enqueue(recv, jti, events)
+	}
+	// Receiver が取りに来るまで保持する
+	if err := tr.polls.push(recv.StreamConf.StreamID, jti, events); err != nil {
+		// 溢れた SET は捨てずに dead letter に移し、運用者が確認して配送し直せるようにする
+		fmt.Printf("Poll 待ちの SET が溢れたので dead letter に移す recvID: %s stream: %s jti: %s\n", recv.ID, recv.StreamConf.StreamID, jti)
+		if err := tr.outbox.SaveDeadLetter(&OutboxSET{
+			RecvID:    recv.ID,
+			StreamID:  recv.StreamConf.StreamID,
+			JTI:       jti,
+			Events:    events,
+			URL:       recv.StreamConf.Delivery.URL,
+			CreatedAt: time.Now(),
+			LastError: err.Error(),
+		}); err != nil {
 			return err
 		}
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("respons status code unmatched : %v", resp.Status)
+		// Receiver が追いつくまで Stream を paused にして、以降のイベントは保留する
+		if _, err := tr.changeStatus(recv, nil, StatusPaused, pollOverflowReason, StatusChangedByTransmitter); err != nil {
+			fmt.Printf("stream(%s) を paused にできない %v\n", recv.StreamConf.StreamID, err)
 		}
-		fmt.Printf("送信に成功 recv: %v -> set: %s\n", recv, ss)
 	}
 	return nil
 }
+
+// sign は recv に送る jti の SET に今の時刻を iat として署名する
+// 再送する時も署名し直すので、 Receiver は iat で古い SET のリプレイを弾ける
+func (tr *tr) sign(recv *Receiver, jti string, events json.RawMessage) ([]byte, error) {
+	t := jwt.New()
+	t.Set(jwt.IssuerKey, tr.conf.Issuer)
+	t.Set(jwt.AudienceKey, recv.Host)
+	t.Set(jwt.IssuedAtKey, time.Now())
+	t.Set(jwt.JwtIDKey, jti)
+	t.Set("events", events)
+
+	ss, err := jwt.Sign(t, tr.signer.alg, tr.signer.priv)
+	if err != nil {
+		return nil, err
+	}
+	if enc := recv.StreamConf.Encryption; enc != nil {
+		// Receiver が暗号化を求めていれば署名した SET をさらに暗号化する
+		return enc.encrypt(ss)
+	}
+	return ss, nil
+}
+
+// newStreamID は Stream ごとに一意な stream_id を生成する
+func newStreamID() (string, error) {
+	return newJTI()
+}
+
+// newJTI は SET ごとに一意な jti を生成する
+func newJTI() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
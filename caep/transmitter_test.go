@@ -0,0 +1,123 @@
+package caep
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDeleteStreamConfig(t *testing.T) {
+	tr := newOutboxTr(t)
+	statuses := tr.statusRepo.(*memStatuses)
+	tr.verifier = &stubVerifier{recvID: "recv"}
+	alice := *NewIssSub("https://idp.example", "alice")
+	for _, streamID := range []string{"deleted", "kept"} {
+		tr.recvRepo.Save(&Receiver{ID: "recv", StreamConf: &StreamConfig{StreamID: streamID}})
+		statuses.Save("recv", &StreamStatus{StreamID: streamID, Status: "enabled", Subject: alice})
+		tr.outbox.Save(&OutboxSET{RecvID: "recv", StreamID: streamID, JTI: streamID, Events: json.RawMessage(`{}`)})
+	}
+	tr.polls.push("deleted", "jti", json.RawMessage(`{}`))
+
+	w := httptest.NewRecorder()
+	tr.DeleteStreamConfig(w, httptest.NewRequest(http.MethodDelete, "/stream?stream_id=deleted", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d %s", w.Code, w.Body)
+	}
+	// 削除した Stream のサブジェクトも配送待ちの SET も残さない
+	if _, err := statuses.Load("recv", "deleted", alice.Key()); err == nil {
+		t.Error("削除した Stream のサブジェクトの status が残っている")
+	}
+	if sets, _ := tr.polls.peek("deleted", 10); len(sets) != 0 {
+		t.Errorf("削除した Stream の Poll 待ちの SET が残っている %+v", sets)
+	}
+	sets, _ := tr.Outbox("recv")
+	if len(sets) != 1 || sets[0].StreamID != "kept" {
+		t.Errorf("Outbox = %+v, want kept 宛のものだけ", sets)
+	}
+	// 他の Stream には影響しない
+	if _, err := statuses.Load("recv", "kept", alice.Key()); err != nil {
+		t.Error(err)
+	}
+
+	w = httptest.NewRecorder()
+	tr.DeleteStreamConfig(w, httptest.NewRequest(http.MethodDelete, "/stream?stream_id=deleted", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("削除済みの Stream の DELETE = %d", w.Code)
+	}
+}
+
+func TestRemoveSubValidate(t *testing.T) {
+	tr := newOutboxTr(t)
+	tr.verifier = &stubVerifier{recvID: "recv"}
+	tr.recvRepo.Save(&Receiver{ID: "recv", StreamConf: &StreamConfig{StreamID: "stream"}})
+
+	r := httptest.NewRequest(http.MethodPost, "/remove", strings.NewReader(`{"subject":{"format":"email"}}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	tr.RemoveSub(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("不正な subject の remove = %d, want 400", w.Code)
+	}
+}
+
+type stubVerifier struct {
+	recvID string
+}
+
+func (v *stubVerifier) Stream(ctx context.Context, authHeader string) (string, error) {
+	return v.recvID, nil
+}
+
+func (v *stubVerifier) Status(ctx context.Context, authHeader string, req *ReqChangeOfStreamStatus) (string, *StreamStatus, error) {
+	return v.recvID, nil, nil
+}
+
+func (v *stubVerifier) AddSub(ctx context.Context, authHeader string, req *ReqAddSub) (string, *StreamStatus, error) {
+	return v.recvID, nil, nil
+}
+
+// memStatuses は recvID/streamID/subKey で status を保持する
+type memStatuses struct {
+	m  sync.Mutex
+	db map[string]StreamStatus
+}
+
+func (s *memStatuses) Load(recvID, streamID, subKey string) (*StreamStatus, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	status, ok := s.db[recvID+"/"+streamID+"/"+subKey]
+	if !ok {
+		return nil, fmt.Errorf("recvID(%s) の stream(%s) には subject(%s) のステータスがない", recvID, streamID, subKey)
+	}
+	return &status, nil
+}
+
+func (s *memStatuses) Save(recvID string, status *StreamStatus) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.db[recvID+"/"+status.StreamID+"/"+status.Subject.Key()] = *status
+	return nil
+}
+
+func (s *memStatuses) Delete(recvID, streamID, subKey string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.db, recvID+"/"+streamID+"/"+subKey)
+	return nil
+}
+
+func (s *memStatuses) DeleteStream(recvID, streamID string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for key := range s.db {
+		if strings.HasPrefix(key, recvID+"/"+streamID+"/") {
+			delete(s.db, key)
+		}
+	}
+	return nil
+}
@@ -1,14 +1,16 @@
 package caep
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"mime"
 	"net/http"
 	"net/url"
 	"path"
+
+	"github.com/hatake5051/ztf-prototype/internal/wellknown"
 )
 
 // Transmitter は caep Transmitter の設定情報を表す
@@ -60,37 +62,37 @@ func NewTransmitter(r io.Reader) (*Transmitter, error) {
 	return tr, nil
 }
 
-// NewTransmitterFetced は issuer の well-known から取得して Trasmitter を構築する
-func NewTransmitterFetced(issuer string) (*Transmitter, error) {
-	url, err := url.Parse(issuer)
+// NewTransmitterFetced は issuer の well-known から client で取得して Trasmitter を構築する
+func NewTransmitterFetced(ctx context.Context, client *http.Client, issuer string) (*Transmitter, error) {
+	d, err := transmitterDoc(client, issuer)
 	if err != nil {
-		log.Printf("CAEP Transmitter の issuer url parse に失敗: %v\n", err)
 		return nil, err
 	}
-	url.Path = path.Join("/.well-known/sse-configuration", url.Path)
-	resp, err := http.Get(url.String())
+	v, err := d.Get(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s", resp.Status)
-	}
-	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
-	if err != nil {
-		return nil, err
-	}
-	if contentType != "application/json" {
-		return nil, fmt.Errorf("contentType unmached expected application/json but %s", contentType)
-	}
-	tr, err := NewTransmitter(resp.Body)
+	return v.(*Transmitter), nil
+}
+
+// transmitterDoc は issuer の Transmitter の設定情報を必要になった時に取得してキャッシュする wellknown.Doc を返す
+func transmitterDoc(client *http.Client, issuer string) (*wellknown.Doc, error) {
+	url, err := url.Parse(issuer)
 	if err != nil {
+		log.Printf("CAEP Transmitter の issuer url parse に失敗: %v\n", err)
 		return nil, err
 	}
-	if tr.Issuer != issuer {
-		return nil, fmt.Errorf("caep: issuer did not match the issuer returned by provider, expected %q got %q", issuer, tr.Issuer)
-	}
-	return tr, nil
+	url.Path = path.Join("/.well-known/sse-configuration", url.Path)
+	return wellknown.New(url.String(), client, func(body io.Reader) (interface{}, error) {
+		tr, err := NewTransmitter(body)
+		if err != nil {
+			return nil, err
+		}
+		if tr.Issuer != issuer {
+			return nil, fmt.Errorf("caep: issuer did not match the issuer returned by provider, expected %q got %q", issuer, tr.Issuer)
+		}
+		return tr, nil
+	}), nil
 }
 
 type transmitterJSON struct {
@@ -106,6 +108,7 @@ type transmitterJSON struct {
 }
 
 // Receiver は CAEP Transmitter が管理する Receiver 情報を表す
+// 一つの Receiver は複数の Stream を持つことができ、 Receiver の値は StreamConf.StreamID の Stream を指す
 type Receiver struct {
 	// ID は Transmitter における Receiver の識別子
 	ID string
@@ -113,16 +116,35 @@ type Receiver struct {
 	Host string
 	// StreamConf は最も最近の Stream COnfig 情報を持つ
 	StreamConf *StreamConfig
+	// Status は Stream 全体の status 。空の時は enabled
+	Status string
+	// StatusReason は最後に Status を変更した理由
+	StatusReason string
+	// StatusChangedBy は最後に Status を変更したのが Transmitter か Receiver かを表す
+	StatusChangedBy string
+}
+
+// status は Stream 全体の status を返す
+func (r *Receiver) status() string {
+	if r.Status == "" {
+		return StatusEnabled
+	}
+	return r.Status
 }
 
 // StreamStatus は caep.EventStreamStatus を表す
 type StreamStatus struct {
+	// StreamID はどの Stream での status かを表す
+	StreamID string `json:"stream_id,omitempty"`
 	// Status はそのユーザに対する Stream Status を表す
+	// Subject が空の時は Stream 全体の status を表す
 	Status string `json:"status"`
-	// SpagID はユーザの識別子
-	SpagID string `json:"spag_id"`
+	// Subject はユーザの識別子
+	Subject Subject `json:"subject"`
 	// EventScopes はそのユーザに対する Stream で提供されるコンテキストとそのスコープを表す
 	EventScopes map[string][]string `json:"events_scopes"`
+	// ChangedBy は最後に Status を変更したのが Transmitter か Receiver かを表す。 Receiver には見せない
+	ChangedBy string `json:"-"`
 }
 
 // ReqChangeOfStreamStatus は CAEP Receiver が Stream Status 変更要求する時のリクエストを表す
@@ -136,6 +158,8 @@ type ReqChangeOfStreamStatus struct {
 
 // StreamConfig は caep.EventStreamConfiguration を表す
 type StreamConfig struct {
+	// StreamID は Transmitter が Stream を作る時に割り当てる識別子
+	StreamID string   `json:"stream_id,omitempty"`
 	Iss      string   `json:"iss"`
 	Aud      []string `json:"aud"`
 	Delivery struct {
@@ -145,109 +169,166 @@ type StreamConfig struct {
 	EventsSupported []string `json:"events_supported"`
 	EventsRequested []string `json:"events_requested"`
 	EventsDelivered []string `json:"events_delivered"`
+	// Encryption は Receiver が SET の暗号化を求める時に設定する
+	Encryption *StreamEncryption `json:"encryption,omitempty"`
 }
 
-// Update は StreamConfig を引数のもので上書きする
+// Merge は n のうち値のあるフィールドで c を上書きする (PATCH)
+// スライスは nil でなければ丸ごと置き換えるので、空のスライスを渡せば全て取り除ける
 // 上書きした結果、元の StreamConfig から変更があると ismodified が true になる
-func (c *StreamConfig) Update(n *StreamConfig) (ismodified bool) {
+func (c *StreamConfig) Merge(n *StreamConfig) (ismodified bool) {
+	if n.StreamID != "" && n.StreamID != c.StreamID {
+		ismodified = true
+		c.StreamID = n.StreamID
+	}
 	if n.Iss != "" && n.Iss != c.Iss {
+		ismodified = true
 		c.Iss = n.Iss
 	}
-	if len(n.Aud) > 0 && len(n.Aud) != len(c.Aud) {
+	if n.Aud != nil && !equalSet(n.Aud, c.Aud) {
+		ismodified = true
 		c.Aud = n.Aud
 	}
-	if n.Delivery.DeliveryMethod != "" {
-		if c.Delivery.DeliveryMethod != n.Delivery.DeliveryMethod {
-			ismodified = true
-			c.Delivery = n.Delivery
-		}
-	}
-	if n.Delivery.URL != "" {
-		if c.Delivery.URL != n.Delivery.URL {
-			ismodified = true
-			c.Delivery = n.Delivery
-		}
+	if n.Delivery.DeliveryMethod != "" && n.Delivery != c.Delivery {
+		ismodified = true
+		c.Delivery = n.Delivery
 	}
-	if len(n.EventsSupported) > 0 && len(c.EventsSupported) != len(n.EventsSupported) {
+	if n.EventsSupported != nil && !equalSet(n.EventsSupported, c.EventsSupported) {
+		ismodified = true
 		c.EventsSupported = n.EventsSupported
 	}
-	if len(n.EventsRequested) > 0 {
-		ne := n.EventsRequested
-		ce := c.EventsRequested
-		for _, e := range ne {
-			if !contains(ce, e) {
-				ismodified = true
-				ce = append(ce, e)
-			}
-		}
-		c.EventsRequested = ce
+	if n.EventsRequested != nil && !equalSet(n.EventsRequested, c.EventsRequested) {
+		ismodified = true
+		c.EventsRequested = n.EventsRequested
 	}
-	if len(n.EventsDelivered) > 0 && len(c.EventsDelivered) != len(n.EventsDelivered) {
+	if n.EventsDelivered != nil && !equalSet(n.EventsDelivered, c.EventsDelivered) {
+		ismodified = true
 		c.EventsDelivered = n.EventsDelivered
 	}
+	if n.Encryption != nil && !n.Encryption.equal(c.Encryption) {
+		ismodified = true
+		c.Encryption = n.Encryption
+	}
+	return ismodified
+}
+
+// Replace は Receiver が設定できるフィールド (delivery, events_requested, encryption) を n のもので置き換える (PUT)
+// n で省略されたフィールドは空になる
+func (c *StreamConfig) Replace(n *StreamConfig) (ismodified bool) {
+	if n.Delivery != c.Delivery {
+		ismodified = true
+		c.Delivery = n.Delivery
+	}
+	if !equalSet(n.EventsRequested, c.EventsRequested) {
+		ismodified = true
+		c.EventsRequested = n.EventsRequested
+	}
+	if !n.Encryption.equal(c.Encryption) {
+		ismodified = true
+		c.Encryption = n.Encryption
+	}
 	return ismodified
 }
 
+// receiverSettable は Receiver が設定できるフィールドだけを取り出す
+// iss, aud, events_supported, events_delivered は Transmitter が決める
+func (c *StreamConfig) receiverSettable() *StreamConfig {
+	n := &StreamConfig{
+		StreamID:        c.StreamID,
+		EventsRequested: c.EventsRequested,
+		Encryption:      c.Encryption,
+	}
+	n.Delivery = c.Delivery
+	return n
+}
+
+// computeDelivered は events_delivered を events_requested と events_supported の共通部分にする
+func (c *StreamConfig) computeDelivered() {
+	delivered := []string{}
+	for _, e := range c.EventsRequested {
+		if contains(c.EventsSupported, e) && !contains(delivered, e) {
+			delivered = append(delivered, e)
+		}
+	}
+	c.EventsDelivered = delivered
+}
+
+// equalSet は a と b が順序を除いて同じ要素を持つか判定する
+func equalSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		if !contains(b, x) {
+			return false
+		}
+	}
+	for _, x := range b {
+		if !contains(a, x) {
+			return false
+		}
+	}
+	return true
+}
+
 // ReqAddSub は Stream にユーザを追加要求する時のリクエストを表す
 // Stream にユーザが追加されることでそのユーザのコンテキストを受け取ることができる
 type ReqAddSub struct {
+	// StreamID はどの Stream にユーザを追加するかを表す
+	StreamID string `json:"stream_id,omitempty"`
 	// Sub は Stream に追加したいユーザ情報を表す
-	Sub struct {
-		SubType string `json:"subject_type"`
-		SpagID  string `json:"spag_id"`
-	} `json:"subject"`
+	Sub Subject `json:"subject"`
 	// ReqEventScopes はどのコンテキストをどの粒度で求めるかを表す
 	ReqEventScopes map[string][]string `json:"events_scopes_requested"`
 }
 
+// ReqRemoveSub は Stream からユーザを削除要求する時のリクエストを表す
+// Stream からユーザが削除されるとそのユーザのコンテキストは受け取らなくなる
+type ReqRemoveSub struct {
+	// StreamID はどの Stream からユーザを削除するかを表す
+	StreamID string `json:"stream_id,omitempty"`
+	// Sub は Stream から削除したいユーザ情報を表す
+	Sub Subject `json:"subject"`
+}
+
+// ReqVerification は Stream の検証を要求する時のリクエストを表す
+type ReqVerification struct {
+	// StreamID はどの Stream を検証するかを表す
+	StreamID string `json:"stream_id,omitempty"`
+	// State は Transmitter が送る Verification Event にそのまま含められる
+	State string `json:"state,omitempty"`
+}
+
+// VerificationEventType は Verification Event の event type を表す
+const VerificationEventType = "https://schemas.openid.net/secevent/sse/event-type/verification"
+
+// VerificationEvent は Stream の疎通確認のために Transmitter が送る Verification Event を表す
+type VerificationEvent struct {
+	// State は Receiver が Verification 要求時に指定した値
+	State string `json:"state,omitempty"`
+}
+
+// StreamUpdatedEventType は Stream Updated Event の event type を表す
+const StreamUpdatedEventType = "https://schemas.openid.net/secevent/sse/event-type/stream-updated"
+
+// StreamUpdatedEvent は Stream かサブジェクトの status が変わったことを Receiver に伝える
+type StreamUpdatedEvent struct {
+	// Status は変わった後の status
+	Status string `json:"status"`
+	// Reason は status が変わった理由
+	Reason string `json:"reason,omitempty"`
+	// Subject は status が変わったサブジェクト。 Stream 全体の時は nil
+	Subject *Subject `json:"subject,omitempty"`
+}
+
 // SSEEventClaim は Security Event Token のクレーム情報を表す
+// コンテキストの ID を種類とするイベントで、 Property にスコープごとの値を持つ
 type SSEEventClaim struct {
-	ID      string `json:"-"`
-	Subject struct {
-		SubType string `json:"subject_type"`
-		SpagID  string `json:"spag_id"`
-	} `json:"subject"`
+	ID       string            `json:"-"`
+	Subject  Subject           `json:"subject"`
 	Property map[string]string `json:"property"`
 }
 
-// NewSETEventsClaimFromJson は JSON を SSEEventClaim に変換する
-func NewSETEventsClaimFromJson(v interface{}) (*SSEEventClaim, bool) {
-	v2, ok := v.(map[string]interface{})
-	if !ok {
-		return nil, false
-	}
-	for k, v := range v2 {
-		v, ok := v.(map[string]interface{})
-		if !ok {
-			return nil, false
-		}
-		s, ok := v["subject"].(map[string]interface{})
-		if !ok {
-			return nil, false
-		}
-		p := make(map[string]string)
-		p2, ok := v["property"].(map[string]interface{})
-		if !ok {
-			return nil, false
-		}
-		for pk, pv := range p2 {
-			p[pk], ok = pv.(string)
-			if !ok {
-				return nil, false
-			}
-		}
-		return &SSEEventClaim{
-			ID: k,
-			Subject: struct {
-				SubType string "json:\"subject_type\""
-				SpagID  string "json:\"spag_id\""
-			}{s["subject_type"].(string), s["spag_id"].(string)},
-			Property: p,
-		}, true
-	}
-	return nil, false
-}
-
 // ToClaim は SSEEventClaim を Secutiry Event Token の event ペイロードへ
 // 当てはめる時の反感を行う。このペイロードは ID をキーにしたマップ型である
 func (e *SSEEventClaim) ToClaim() map[string]SSEEventClaim {
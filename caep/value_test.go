@@ -0,0 +1,104 @@
+package caep
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newStreamConfig() *StreamConfig {
+	c := &StreamConfig{
+		StreamID:        "stream1",
+		Iss:             "https://cap.example",
+		Aud:             []string{"https://rp.example"},
+		EventsSupported: []string{"e1", "e2", "e3"},
+		EventsRequested: []string{"e1", "e2"},
+		EventsDelivered: []string{"e1", "e2"},
+	}
+	c.Delivery.DeliveryMethod = DeliveryMethodPush
+	c.Delivery.URL = "https://rp.example/set"
+	return c
+}
+
+func TestStreamConfigMerge(t *testing.T) {
+	c := newStreamConfig()
+	if c.Merge(&StreamConfig{}) || c.Merge(&StreamConfig{EventsRequested: []string{"e2", "e1"}}) {
+		t.Error("何も変えない PATCH を変更とみなした")
+	}
+	if !reflect.DeepEqual(c, newStreamConfig()) {
+		t.Errorf("何も変えない PATCH で %+v になった", c)
+	}
+
+	// 値のあるフィールドだけ上書きし、スライスは丸ごと置き換える
+	patch := &StreamConfig{EventsRequested: []string{"e3"}}
+	patch.Delivery.DeliveryMethod = DeliveryMethodPoll
+	if !c.Merge(patch) {
+		t.Error("変更を検知しない")
+	}
+	want := newStreamConfig()
+	want.EventsRequested = []string{"e3"}
+	want.Delivery = patch.Delivery
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Merge() = %+v, want %+v", c, want)
+	}
+
+	// 空のスライスを渡せば全て取り除ける
+	if !c.Merge(&StreamConfig{EventsRequested: []string{}}) || len(c.EventsRequested) != 0 {
+		t.Errorf("空の events_requested で取り除けない %v", c.EventsRequested)
+	}
+}
+
+func TestStreamConfigReplace(t *testing.T) {
+	c := newStreamConfig()
+	c.Encryption = &StreamEncryption{Alg: "RSA-OAEP-256", Enc: "A256GCM"}
+	if c.Replace(c.receiverSettable()) {
+		t.Error("同じ設定の PUT を変更とみなした")
+	}
+
+	// Transmitter が決めるフィールドは変えず、省略されたフィールドは空になる
+	n := newStreamConfig()
+	n.Iss = "https://evil.example"
+	n.EventsSupported = []string{"e9"}
+	n.EventsRequested = nil
+	if !c.Replace(n) {
+		t.Error("変更を検知しない")
+	}
+	want := newStreamConfig()
+	want.EventsRequested = nil
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Replace() = %+v, want %+v", c, want)
+	}
+}
+
+func TestStreamConfigComputeDelivered(t *testing.T) {
+	c := newStreamConfig()
+	c.EventsRequested = []string{"e3", "unknown", "e1", "e3"}
+	c.computeDelivered()
+	if want := []string{"e3", "e1"}; !reflect.DeepEqual(c.EventsDelivered, want) {
+		t.Errorf("events_delivered = %v, want %v", c.EventsDelivered, want)
+	}
+	c.EventsRequested = nil
+	c.computeDelivered()
+	if c.EventsDelivered == nil || len(c.EventsDelivered) != 0 {
+		t.Errorf("events_delivered = %#v, want 空のスライス", c.EventsDelivered)
+	}
+}
+
+func TestValidateStreamConfig(t *testing.T) {
+	tr := newOutboxTr(t)
+	if err := tr.validateStreamConfig(newStreamConfig()); err != nil {
+		t.Fatal(err)
+	}
+	for name, f := range map[string]func(c *StreamConfig){
+		"相対 URL":          func(c *StreamConfig) { c.Delivery.URL = "/set" },
+		"知らない配送方法":        func(c *StreamConfig) { c.Delivery.DeliveryMethod = "urn:example:carrier-pigeon" },
+		"Poll をサポートしていない": func(c *StreamConfig) { c.Delivery.DeliveryMethod = DeliveryMethodPoll },
+		"知らない暗号化アルゴリズム":   func(c *StreamConfig) { c.Encryption = &StreamEncryption{Alg: "RSA1_5", Enc: "A256GCM"} },
+		"暗号化鍵がない":         func(c *StreamConfig) { c.Encryption = &StreamEncryption{Alg: "RSA-OAEP-256", Enc: "A256GCM"} },
+	} {
+		c := newStreamConfig()
+		f(c)
+		if err := tr.validateStreamConfig(c); err == nil {
+			t.Errorf("%s の設定を受け付けた", name)
+		}
+	}
+}
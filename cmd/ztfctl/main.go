@@ -0,0 +1,250 @@
+// ztfctl は CAP の管理 API を叩いて CAEP Transmitter の Stream を確認、操作する
+//
+//	ztfctl [-cap URL] [-token TOKEN] streams list [-json]
+//	ztfctl [-cap URL] [-token TOKEN] streams show [-json] <recvID>
+//	ztfctl [-cap URL] [-token TOKEN] streams disable [-subject KEY] [-reason REASON] <recvID>
+//	ztfctl [-cap URL] [-token TOKEN] dead-letters list [-json] <recvID>
+//	ztfctl [-cap URL] [-token TOKEN] dead-letters replay <recvID> <jti>
+//
+// -cap と -token を省略した時は環境変数 ZTFCTL_CAP と ZTFCTL_TOKEN を使う
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hatake5051/ztf-prototype/actors/cap"
+	"github.com/hatake5051/ztf-prototype/caep"
+)
+
+func main() {
+	capURL := flag.String("cap", os.Getenv("ZTFCTL_CAP"), "CAP の URL (例: http://cap1.ztf-proto.k3.ipv6.mobi)")
+	token := flag.String("token", os.Getenv("ZTFCTL_TOKEN"), "CAP の管理 API のトークン")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	if *capURL == "" || *token == "" {
+		fmt.Fprintln(os.Stderr, "-cap と -token (もしくは ZTFCTL_CAP と ZTFCTL_TOKEN) が必要")
+		os.Exit(2)
+	}
+	c := &client{base: *capURL, token: *token, http: &http.Client{Timeout: 30 * time.Second}}
+	var err error
+	switch args[0] + " " + args[1] {
+	case "streams list":
+		err = c.list(args[2:])
+	case "streams show":
+		err = c.show(args[2:])
+	case "streams disable":
+		err = c.disable(args[2:])
+	case "dead-letters list":
+		err = c.deadLetters(args[2:])
+	case "dead-letters replay":
+		err = c.replay(args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  ztfctl [-cap URL] [-token TOKEN] streams list [-json]
+  ztfctl [-cap URL] [-token TOKEN] streams show [-json] <recvID>
+  ztfctl [-cap URL] [-token TOKEN] streams disable [-subject KEY] [-reason REASON] <recvID>
+  ztfctl [-cap URL] [-token TOKEN] dead-letters list [-json] <recvID>
+  ztfctl [-cap URL] [-token TOKEN] dead-letters replay <recvID> <jti>`)
+	flag.PrintDefaults()
+}
+
+// client は CAP の管理 API のクライアント
+type client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func (c *client) list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "JSON で出力する")
+	fs.Parse(args)
+	var recvs []cap.AdminReceiver
+	if err := c.do(http.MethodGet, "/admin/streams", nil, &recvs); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(recvs)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RECEIVER\tHOST\tSTREAMS\tSUBJECTS\tOUTBOX\tDEAD\tLAST DELIVERY")
+	for _, r := range recvs {
+		subs := 0
+		for _, s := range r.Streams {
+			subs += len(s.Subjects)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\n", r.ID, r.Host, len(r.Streams), subs, r.OutboxDepth, r.DeadLetters, lastDelivery(r.LastDelivery))
+	}
+	return w.Flush()
+}
+
+func (c *client) show(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "JSON で出力する")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("recvID を一つ指定してください")
+	}
+	r := new(cap.AdminReceiver)
+	if err := c.do(http.MethodGet, path.Join("/admin/streams", url.PathEscape(fs.Arg(0))), nil, r); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(r)
+	}
+	fmt.Printf("receiver:      %s (%s)\n", r.ID, r.Host)
+	fmt.Printf("outbox:        %d\n", r.OutboxDepth)
+	fmt.Printf("dead letters:  %d\n", r.DeadLetters)
+	fmt.Printf("last delivery: %s\n", lastDelivery(r.LastDelivery))
+	for _, s := range r.Streams {
+		fmt.Printf("\nstream %s: %s", s.Config.StreamID, s.Status)
+		if s.StatusReason != "" {
+			fmt.Printf(" (%s)", s.StatusReason)
+		}
+		fmt.Printf("\n  delivery: %s %s\n", s.Config.Delivery.DeliveryMethod, s.Config.Delivery.URL)
+		fmt.Printf("  events delivered: %s\n", strings.Join(s.Config.EventsDelivered, ", "))
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "  SUBJECT\tSTATUS\tSCOPES")
+		for _, sub := range s.Subjects {
+			var scopes []string
+			for ctxID, ss := range sub.EventScopes {
+				scopes = append(scopes, fmt.Sprintf("%s:[%s]", ctxID, strings.Join(ss, " ")))
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", sub.Key, sub.Status, strings.Join(scopes, " "))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) disable(args []string) error {
+	fs := flag.NewFlagSet("disable", flag.ExitOnError)
+	subject := fs.String("subject", "", "disabled にするサブジェクトの key (streams show で確認できる)。省略すると Receiver の全ての Stream を disabled にする")
+	reason := fs.String("reason", "", "Receiver に伝える理由")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("recvID を一つ指定してください")
+	}
+	req := &cap.AdminDisableReq{Subject: *subject, Reason: *reason}
+	if err := c.do(http.MethodPost, path.Join("/admin/streams", url.PathEscape(fs.Arg(0)), "disable"), req, nil); err != nil {
+		return err
+	}
+	fmt.Println("disabled")
+	return nil
+}
+
+func (c *client) deadLetters(args []string) error {
+	fs := flag.NewFlagSet("dead-letters list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "JSON で出力する")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("recvID を一つ指定してください")
+	}
+	var dead []caep.OutboxSET
+	if err := c.do(http.MethodGet, path.Join("/admin/streams", url.PathEscape(fs.Arg(0)), "dead-letters"), nil, &dead); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(dead)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "JTI\tSTREAM\tCREATED\tATTEMPTS\tLAST ERROR")
+	for _, s := range dead {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", s.JTI, s.StreamID, s.CreatedAt.Format(time.RFC3339), s.Attempts, s.LastError)
+	}
+	return w.Flush()
+}
+
+func (c *client) replay(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("recvID と jti を指定してください")
+	}
+	if err := c.do(http.MethodPost, path.Join("/admin/streams", url.PathEscape(args[0]), "dead-letters", url.PathEscape(args[1]), "replay"), nil, nil); err != nil {
+		return err
+	}
+	fmt.Println("replayed")
+	return nil
+}
+
+// do は管理 API に reqBody を送り、応答を respBody に読み込む
+func (c *client) do(method, p string, reqBody, respBody interface{}) error {
+	u, err := url.Parse(c.base)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, p)
+	var body io.Reader
+	if reqBody != nil {
+		raw, err := json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s %s", method, u.String(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if respBody == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(respBody)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func lastDelivery(d *caep.Delivery) string {
+	if d == nil {
+		return "-"
+	}
+	if d.Error != "" {
+		return fmt.Sprintf("failed at %s (%s)", d.At.Format(time.RFC3339), d.Error)
+	}
+	return fmt.Sprintf("ok at %s", d.At.Format(time.RFC3339))
+}
@@ -4,6 +4,7 @@ go 1.15
 
 require (
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.1
 	github.com/lestrrat-go/jwx v1.0.5
 	golang.org/x/oauth2 v0.0.0-20201109201403-9fd604954f58
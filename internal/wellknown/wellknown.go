@@ -0,0 +1,184 @@
+// Package wellknown は well-known エンドポイントで公開される設定情報を必要になった時に取得し、キャッシュする
+// 取得に失敗しても古い設定情報があればそれを使い続けるので、相手が落ちていても起動できる
+package wellknown
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxAge は Cache-Control で max-age が指定されていない時に設定情報をキャッシュする時間
+	DefaultMaxAge = time.Hour
+	// maxAttempts は一度の Get で取得を試みる最大の回数
+	maxAttempts = 3
+	// retryBaseBackoff は取得に失敗した時に次に試みるまで待つ時間。失敗するたびに倍にする
+	retryBaseBackoff = 500 * time.Millisecond
+	// maxFailureBackoff は取得に失敗し続けている時に、次に取得を試みるまで空ける最大の時間
+	maxFailureBackoff = time.Minute
+)
+
+// Decoder は well-known エンドポイントの応答 (application/json) を設定情報に変換する
+// issuer の検証など、設定情報として受け付けられない時はエラーを返す
+type Decoder func(body io.Reader) (interface{}, error)
+
+// Error は設定情報を一度も取得できていないことを表す
+type Error struct {
+	// URL は well-known エンドポイントの URL
+	URL string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s から設定情報を取得できなかった %v", e.URL, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Doc は一つの well-known エンドポイントの設定情報を表す
+type Doc struct {
+	url    string
+	client *http.Client
+	decode Decoder
+
+	m sync.Mutex
+	// v は最後に取得できた設定情報で、 expires まで使う
+	v       interface{}
+	expires time.Time
+	// failures は続けて取得に失敗した回数で、 nextTry までは取得を試みない
+	failures int
+	nextTry  time.Time
+	lastErr  error
+}
+
+// New は url の well-known エンドポイントの設定情報を client で取得する Doc を返す
+// 設定情報は最初に Get した時に取得する
+func New(url string, client *http.Client, decode Decoder) *Doc {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Doc{url: url, client: client, decode: decode}
+}
+
+// Get は設定情報を返す
+// キャッシュが切れていれば取得し直し、失敗した時は古い設定情報があればそれを返す
+// 一度も取得できていない時は *Error を返す
+func (d *Doc) Get(ctx context.Context) (interface{}, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	now := time.Now()
+	if d.v != nil && now.Before(d.expires) {
+		return d.v, nil
+	}
+	if now.Before(d.nextTry) {
+		// 失敗が続いているので、しばらくは取得を試みない
+		return d.stale()
+	}
+	v, maxAge, err := d.fetchWithRetry(ctx)
+	if err != nil {
+		d.failures++
+		d.nextTry = time.Now().Add(failureBackoff(d.failures))
+		d.lastErr = &Error{URL: d.url, Err: err}
+		fmt.Printf("%v\n", d.lastErr)
+		return d.stale()
+	}
+	d.v = v
+	d.expires = time.Now().Add(maxAge)
+	d.failures = 0
+	d.nextTry = time.Time{}
+	d.lastErr = nil
+	return v, nil
+}
+
+// stale は取得し直せなかった時に古い設定情報を返す
+func (d *Doc) stale() (interface{}, error) {
+	if d.v != nil {
+		return d.v, nil
+	}
+	return nil, d.lastErr
+}
+
+// fetchWithRetry は ctx が終わるまでの間、 maxAttempts 回まで取得を試みる
+func (d *Doc) fetchWithRetry(ctx context.Context) (v interface{}, maxAge time.Duration, err error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(retryBaseBackoff << uint(attempt-1)):
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+		}
+		v, maxAge, err = d.fetch(ctx)
+		if err == nil {
+			return v, maxAge, nil
+		}
+	}
+	return nil, 0, err
+}
+
+func (d *Doc) fetch(ctx context.Context) (interface{}, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("statuscode: %s", resp.Status)
+	}
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if contentType != "application/json" {
+		return nil, 0, fmt.Errorf("contentType unmached expected application/json but %s", contentType)
+	}
+	v, err := d.decode(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, maxAgeOf(resp.Header.Get("Cache-Control")), nil
+}
+
+// maxAgeOf は Cache-Control ヘッダから設定情報をキャッシュしてよい時間を求める
+// no-store や no-cache の時は次の Get で取得し直す
+func maxAgeOf(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			sec, err := strconv.Atoi(strings.Trim(directive[len("max-age="):], `"`))
+			if err != nil || sec < 0 {
+				continue
+			}
+			return time.Duration(sec) * time.Second
+		}
+	}
+	return DefaultMaxAge
+}
+
+// failureBackoff は failures 回続けて失敗した後に次に取得を試みるまで空ける時間
+func failureBackoff(failures int) time.Duration {
+	if failures > 16 {
+		return maxFailureBackoff
+	}
+	d := time.Second << uint(failures-1)
+	if d > maxFailureBackoff {
+		return maxFailureBackoff
+	}
+	return d
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/hatake5051/ztf-prototype/internal/wellknown"
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/lestrrat-go/jwx/jwt/openid"
@@ -20,27 +22,25 @@ type Conf struct {
 	ClientSecret string
 	// RedirectURL は callback先のURLを表す
 	RedirectURL string
+	// HTTPClient は OP へのアクセスに使う。 nil の時は http.DefaultClient
+	HTTPClient *http.Client
 }
 
+// discoveryTimeout は Redirect の時に OP の設定情報を取得するのを待つ時間
+const discoveryTimeout = 30 * time.Second
+
 /// New は RP の設定情報をもとに OpenID RP を構築する。
+/// OP の設定情報は最初に必要になった時に取得するので、 OP が落ちていても構築できる。
 func (c *Conf) New() RP {
-	op, err := NewOPFetched(c.Issuer)
+	client := httpClientOr(c.HTTPClient)
+	disc, err := opDoc(client, c.Issuer)
 	if err != nil {
-		panic(fmt.Errorf("OP(%s)の設定取得に失敗 %v", c.Issuer, err))
-	}
-	conf := &oauth2.Config{
-		ClientID:     c.ClientID,
-		ClientSecret: c.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  op.AuthorizationEndpoint,
-			TokenURL: op.TokenEndpoint,
-		},
-		Scopes:      []string{"openid"},
-		RedirectURL: c.RedirectURL,
+		panic(fmt.Errorf("OP(%s)の issuer が正しくない %v", c.Issuer, err))
 	}
 	return &rp{
-		op:   op,
-		conf: conf,
+		disc:   disc,
+		conf:   c,
+		client: client,
 	}
 }
 
@@ -50,24 +50,58 @@ type RP interface {
 	Redirect(w http.ResponseWriter, r *http.Request)
 	/// CallbackAndExchange は OP の認可エンドポイントで認証した後
 	/// コールバックしてくる先であり、IDToken を取得しにいく
+	/// OP へのアクセスは r.Context() が終わると打ち切る
 	CallbackAndExchange(r *http.Request) (openid.Token, error)
 }
 
 type rp struct {
-	op   *OP
-	conf *oauth2.Config
+	// disc は OP の設定情報を必要になった時に取得してキャッシュする
+	disc   *wellknown.Doc
+	conf   *Conf
+	client *http.Client
+}
+
+// oauth2Config は OP の設定情報を取得して oauth2.Config を組み立てる
+func (rp *rp) oauth2Config(ctx context.Context) (*OP, *oauth2.Config, error) {
+	v, err := rp.disc.Get(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	op := v.(*OP)
+	return op, &oauth2.Config{
+		ClientID:     rp.conf.ClientID,
+		ClientSecret: rp.conf.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  op.AuthorizationEndpoint,
+			TokenURL: op.TokenEndpoint,
+		},
+		Scopes:      []string{"openid"},
+		RedirectURL: rp.conf.RedirectURL,
+	}, nil
 }
 
 func (rp *rp) Redirect(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), discoveryTimeout)
+	defer cancel()
+	_, conf, err := rp.oauth2Config(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("OP(%s) にアクセスできないため認証できない %v", rp.conf.Issuer, err), http.StatusServiceUnavailable)
+		return
+	}
 	state := "" // TODO: must implement
-	http.Redirect(w, r, rp.conf.AuthCodeURL(state), http.StatusFound)
+	http.Redirect(w, r, conf.AuthCodeURL(state), http.StatusFound)
 }
 
 func (rp *rp) CallbackAndExchange(r *http.Request) (openid.Token, error) {
 	if err := r.ParseForm(); err != nil {
 		return nil, err
 	}
-	accessToken, err := rp.conf.Exchange(context.Background(), r.Form.Get("code"))
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, rp.client)
+	op, conf, err := rp.oauth2Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := conf.Exchange(ctx, r.Form.Get("code"))
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +109,7 @@ func (rp *rp) CallbackAndExchange(r *http.Request) (openid.Token, error) {
 	if !ok {
 		return nil, fmt.Errorf("missing token")
 	}
-	jwkset, err := jwk.FetchHTTP(rp.op.JwksURI)
+	jwkset, err := jwk.FetchHTTPWithContext(ctx, op.JwksURI, jwk.WithHTTPClient(rp.client))
 	if err != nil {
 		return nil, err
 	}
@@ -85,3 +119,11 @@ func (rp *rp) CallbackAndExchange(r *http.Request) (openid.Token, error) {
 	}
 	return tok.(openid.Token), nil
 }
+
+// httpClientOr は c が nil の時に http.DefaultClient を返す
+func httpClientOr(c *http.Client) *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+	return c
+}
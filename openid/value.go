@@ -1,12 +1,15 @@
 package openid
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"mime"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
+
+	"github.com/hatake5051/ztf-prototype/internal/wellknown"
 )
 
 /// OP は OpenID Provider の 設定を表す
@@ -41,34 +44,34 @@ type OP struct {
 	TLSClientCertificateBoundAccessTokens      bool     `json:"tls_client_certificate_bound_access_tokens"`
 }
 
-/// NewOPFetched は issuer から OP の設定情報を取得する。
-func NewOPFetched(issuer string) (*OP, error) {
-	url, err := url.Parse(issuer)
+/// NewOPFetched は issuer から client で OP の設定情報を取得する。
+func NewOPFetched(ctx context.Context, client *http.Client, issuer string) (*OP, error) {
+	d, err := opDoc(client, issuer)
 	if err != nil {
 		return nil, err
 	}
-	url.Path = path.Join(url.Path, "/.well-known/openid-configuration")
-	resp, err := http.Get(url.String())
+	v, err := d.Get(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s", resp.Status)
-	}
-	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return v.(*OP), nil
+}
+
+/// opDoc は issuer の OP の設定情報を必要になった時に取得してキャッシュする wellknown.Doc を返す。
+func opDoc(client *http.Client, issuer string) (*wellknown.Doc, error) {
+	url, err := url.Parse(issuer)
 	if err != nil {
 		return nil, err
 	}
-	if contentType != "application/json" {
-		return nil, fmt.Errorf("contentType unmached expected application/json but %s", contentType)
-	}
-	op := new(OP)
-	if err := json.NewDecoder(resp.Body).Decode(op); err != nil {
-		return nil, err
-	}
-	if op.Issuer != issuer {
-		return nil, fmt.Errorf("caep: issuer did not match the issuer returned by provider, expected %q got %q", issuer, op.Issuer)
-	}
-	return op, nil
+	url.Path = path.Join(url.Path, "/.well-known/openid-configuration")
+	return wellknown.New(url.String(), httpClientOr(client), func(body io.Reader) (interface{}, error) {
+		op := new(OP)
+		if err := json.NewDecoder(body).Decode(op); err != nil {
+			return nil, err
+		}
+		if op.Issuer != issuer {
+			return nil, fmt.Errorf("caep: issuer did not match the issuer returned by provider, expected %q got %q", issuer, op.Issuer)
+		}
+		return op, nil
+	}), nil
 }
@@ -7,7 +7,9 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/hatake5051/ztf-prototype/internal/wellknown"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 )
@@ -19,14 +21,18 @@ type Conf struct {
 		ID     string
 		Secret string
 	}
+	// HTTPClient は認可サーバへのアクセスに使う。 nil の時は http.DefaultClient
+	HTTPClient *http.Client
 }
 
 // New は設定情報をもとにUMAクライアントを構築する
-// 認可サーバの情報の取得に失敗するとパニック
+// 認可サーバの情報は最初に必要になった時に取得するので、認可サーバが落ちていても構築できる
+// 認可サーバの URL が正しくないとパニック
 func (c *Conf) New() Client {
-	authZSrv, err := NewAuthZSrv(c.AuthZSrv)
+	client := httpClientOr(c.HTTPClient)
+	disc, err := authZSrvDoc(client, c.AuthZSrv)
 	if err != nil {
-		panic(fmt.Sprintf("uma.Client の構成に失敗(認可サーバの設定を取得できなかった) err: %v", err))
+		panic(fmt.Sprintf("uma.Client の構成に失敗(認可サーバの URL が正しくない) err: %v", err))
 	}
 
 	umaReqs := url.Values{}
@@ -37,21 +43,33 @@ func (c *Conf) New() Client {
 	conf := clientcredentials.Config{
 		ClientID:       c.ClientCred.ID,
 		ClientSecret:   c.ClientCred.Secret,
-		TokenURL:       authZSrv.TokenURL,
 		EndpointParams: umaReqs,
 	}
 	return &cli{
-		authZ: authZSrv,
-		conf:  conf,
+		issuer: c.AuthZSrv,
+		disc:   disc,
+		conf:   conf,
+		client: client,
 	}
 }
 
 // Client はUMAクライアントを表す
+// 認可サーバへのアクセスは ctx が終わると打ち切る
 type Client interface {
 	ExtractPermissionTicket(resp *http.Response) (*PermissionTicket, error)
-	ReqRPT(pt *PermissionTicket, rawidToken string) (*RPT, error)
+	ReqRPT(ctx context.Context, pt *PermissionTicket, rawidToken string) (*RPT, error)
+	// RefreshRPT は rpt の refresh_token を使って新しい RPT を得る
+	RefreshRPT(ctx context.Context, rpt *RPT) (*RPT, error)
 }
 
+// UMA Grant で RPT 要求に失敗した時のエラーコード (UMA Grant Sec.3.3.6)
+const (
+	// ReqRPTErrorRequestSubmitted はリソースオーナーの許可待ちであることを表す
+	ReqRPTErrorRequestSubmitted = "request_submitted"
+	// ReqRPTErrorRequestDenied はリソースオーナーが許可しなかった、もしくは許可を取り消したことを表す
+	ReqRPTErrorRequestDenied = "request_denied"
+)
+
 // ReqRPTError はRPT要求に失敗した時のエラーメッセージを表す
 type ReqRPTError struct {
 	Err            string `json:"error"`
@@ -64,8 +82,21 @@ func (e *ReqRPTError) Error() string {
 }
 
 type cli struct {
-	authZ *AuthZSrv
-	conf  clientcredentials.Config
+	issuer string
+	// disc は認可サーバの情報を必要になった時に取得してキャッシュする
+	disc *wellknown.Doc
+	// conf は TokenURL を除いた RPT 要求の設定で、 TokenURL は認可サーバの情報から埋める
+	conf   clientcredentials.Config
+	client *http.Client
+}
+
+// authZSrv は認可サーバの情報を返す。まだ取得できていなければ取得する
+func (c *cli) authZSrv(ctx context.Context) (*AuthZSrv, error) {
+	v, err := c.disc.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*AuthZSrv), nil
 }
 
 func (c *cli) ExtractPermissionTicket(resp *http.Response) (*PermissionTicket, error) {
@@ -73,14 +104,15 @@ func (c *cli) ExtractPermissionTicket(resp *http.Response) (*PermissionTicket, e
 	if err != nil {
 		return nil, err
 	}
-	if pt.InitialOption.AuthZSrv != c.authZ.Issuer {
-		return nil, fmt.Errorf("sould be equeal Metadata Issuer: %v, resp: %v", c.authZ.Issuer, pt.InitialOption.AuthZSrv)
+	if pt.InitialOption.AuthZSrv != c.issuer {
+		return nil, fmt.Errorf("sould be equeal Metadata Issuer: %v, resp: %v", c.issuer, pt.InitialOption.AuthZSrv)
 	}
 	return pt, nil
 }
 
-func (c *cli) Config(ticket, rawIDToken string) *clientcredentials.Config {
+func (c *cli) Config(authZ *AuthZSrv, ticket, rawIDToken string) *clientcredentials.Config {
 	ret := c.conf
+	ret.TokenURL = authZ.TokenURL
 	newparams := url.Values{}
 	for k, v := range ret.EndpointParams {
 		switch k {
@@ -96,11 +128,15 @@ func (c *cli) Config(ticket, rawIDToken string) *clientcredentials.Config {
 	return &ret
 }
 
-func (c *cli) ReqRPT(pt *PermissionTicket, rawidToken string) (*RPT, error) {
-	if pt.InitialOption != nil && c.authZ.Issuer != pt.InitialOption.AuthZSrv {
+func (c *cli) ReqRPT(ctx context.Context, pt *PermissionTicket, rawidToken string) (*RPT, error) {
+	if pt.InitialOption != nil && c.issuer != pt.InitialOption.AuthZSrv {
 		return nil, fmt.Errorf("この許可チケットの発行者に対するクライアントではない")
 	}
-	tok, err := c.Config(pt.Ticket, rawidToken).Token(context.Background())
+	authZ, err := c.authZSrv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := c.Config(authZ, pt.Ticket, rawidToken).Token(withClient(ctx, c.client))
 	if err != nil {
 		if err, ok := err.(*oauth2.RetrieveError); ok {
 			ee := new(ReqRPTError)
@@ -114,6 +150,49 @@ func (c *cli) ReqRPT(pt *PermissionTicket, rawidToken string) (*RPT, error) {
 	return &RPT{*tok}, nil
 }
 
+func (c *cli) RefreshRPT(ctx context.Context, rpt *RPT) (*RPT, error) {
+	if rpt.RefreshToken == "" {
+		return nil, fmt.Errorf("RPT に refresh_token がない")
+	}
+	authZ, err := c.authZSrv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conf := &oauth2.Config{
+		ClientID:     c.conf.ClientID,
+		ClientSecret: c.conf.ClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: authZ.TokenURL},
+	}
+	// 有効期限前でも更新するように期限切れとして渡す
+	expired := rpt.Token
+	expired.Expiry = time.Now().Add(-time.Second)
+	tok, err := conf.TokenSource(withClient(ctx, c.client), &expired).Token()
+	if err != nil {
+		if err, ok := err.(*oauth2.RetrieveError); ok {
+			ee := new(ReqRPTError)
+			if err := json.Unmarshal(err.Body, ee); err != nil {
+				return nil, err
+			}
+			return nil, ee
+		}
+		return nil, err
+	}
+	return &RPT{*tok}, nil
+}
+
+// httpClientOr は c が nil の時に http.DefaultClient を返す
+func httpClientOr(c *http.Client) *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+	return c
+}
+
+// withClient は oauth2 パッケージが client で token endpoint にアクセスするように ctx に設定する
+func withClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, client)
+}
+
 // InitialPermissionTicket は resp から PermissionTicket を抽出する
 func InitialPermissionTicket(resp *http.Response) (*PermissionTicket, error) {
 	if resp.StatusCode != http.StatusUnauthorized {
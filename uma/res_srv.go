@@ -9,7 +9,9 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 
+	"github.com/hatake5051/ztf-prototype/internal/wellknown"
 	"golang.org/x/oauth2/clientcredentials"
 )
 
@@ -23,33 +25,38 @@ type ResSrvConf struct {
 		ID     string
 		Secret string
 	}
+	// HTTPClient は認可サーバへのアクセスに使う。 nil の時は http.DefaultClient
+	HTTPClient *http.Client
 }
 
 // New は設定情報から ResSrv を構成する
-// UMAAuthZSrv の設定に失敗するとパニック
+// UMA認可サーバの設定は最初に必要になった時に取得するので、認可サーバが落ちていても構成できる
+// UMA認可サーバの URL が正しくないとパニック
 func (c *ResSrvConf) New() ResSrv {
-	authZSrv, err := NewAuthZSrv(c.AuthZSrv)
+	client := httpClientOr(c.HTTPClient)
+	disc, err := authZSrvDoc(client, c.AuthZSrv)
 	if err != nil {
-		panic(fmt.Sprintf("ResSrv の構成に失敗(UMA認可サーバの設定を取得できなかった) err:%v", err))
-	}
-	clientcredConf := &clientcredentials.Config{
-		ClientID:     c.ClientCred.ID,
-		ClientSecret: c.ClientCred.Secret,
-		TokenURL:     authZSrv.TokenURL,
+		panic(fmt.Sprintf("ResSrv の構成に失敗(UMA認可サーバの URL が正しくない) err:%v", err))
 	}
 	return &ressrv{
-		authZ:   authZSrv,
-		patConf: clientcredConf}
+		disc:     disc,
+		clientID: c.ClientCred.ID,
+		secret:   c.ClientCred.Secret,
+		client:   client,
+	}
 }
 
 // ResSrv は UMA-enabled なリソースサーバを表す
+// 認可サーバへのアクセスは ctx が終わると打ち切る
 type ResSrv interface {
 	// CRUD は method に基づいて res を Restful に操作する
-	CRUD(method string, res *Res) (*Res, error)
+	CRUD(ctx context.Context, method string, res *Res) (*Res, error)
 	// List は owner が UMA AuthZSrv に登録したコンテキストを一覧する
-	List(owner string) (resIDList []string, err error)
+	List(ctx context.Context, owner string) (resIDList []string, err error)
 	// PermissionTicket は reses にアクセスを求めている情報をまとめて Permission Ticket に変換する
-	PermissionTicket(reses []ResReqForPT) (*PermissionTicket, error)
+	PermissionTicket(ctx context.Context, reses []ResReqForPT) (*PermissionTicket, error)
+	// Introspect は rpt を認可サーバに Introspection して、有効かどうかと認可されている permissions を得る
+	Introspect(ctx context.Context, rpt string) (*Introspection, error)
 }
 
 // ProtectionAPIError は ProtectionAPI で error response のメッセージを表す
@@ -78,23 +85,48 @@ func (e *ProtectionAPIError) Error() string {
 
 // ResSrv の実装
 type ressrv struct {
-	host    string
-	authZ   *AuthZSrv
-	patConf *clientcredentials.Config
+	host string
+	// disc は UMA認可サーバの設定を必要になった時に取得してキャッシュする
+	disc     *wellknown.Doc
+	clientID string
+	secret   string
+	client   *http.Client
+}
+
+// authZSrv は UMA認可サーバの設定を返す。まだ取得できていなければ取得する
+func (u *ressrv) authZSrv(ctx context.Context) (*AuthZSrv, error) {
+	v, err := u.disc.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*AuthZSrv), nil
 }
 
-func (u *ressrv) PermissionTicket(reses []ResReqForPT) (*PermissionTicket, error) {
+// patClient は PAT を付けて認可サーバにアクセスする http.Client を返す
+func (u *ressrv) patClient(ctx context.Context, authZ *AuthZSrv) *http.Client {
+	conf := &clientcredentials.Config{
+		ClientID:     u.clientID,
+		ClientSecret: u.secret,
+		TokenURL:     authZ.TokenURL,
+	}
+	return conf.Client(withClient(ctx, u.client))
+}
+
+func (u *ressrv) PermissionTicket(ctx context.Context, reses []ResReqForPT) (*PermissionTicket, error) {
+	authZ, err := u.authZSrv(ctx)
+	if err != nil {
+		return nil, err
+	}
 	body, err := json.Marshal(reses)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", u.authZ.PermissionURL, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", authZ.PermissionURL, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
-	client := u.patConf.Client(context.Background())
-	resp, err := client.Do(req)
+	resp, err := u.patClient(ctx, authZ).Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -123,17 +155,62 @@ func (u *ressrv) PermissionTicket(reses []ResReqForPT) (*PermissionTicket, error
 	if err := json.NewDecoder(resp.Body).Decode(tt); err != nil {
 		return nil, err
 	}
-	return NewPermissionTicket(tt.Ticket, u.authZ.Issuer, u.host), nil
+	return NewPermissionTicket(tt.Ticket, authZ.Issuer, u.host), nil
 }
 
-func (u *ressrv) List(owner string) (resIDList []string, err error) {
-	url, err := url.Parse(u.authZ.RRegURL)
+func (u *ressrv) Introspect(ctx context.Context, rpt string) (*Introspection, error) {
+	authZ, err := u.authZSrv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if authZ.IntrospectionURL == "" {
+		return nil, fmt.Errorf("認可サーバ(%s) は introspection_endpoint を公開していない", authZ.Issuer)
+	}
+	form := url.Values{}
+	form.Set("token", rpt)
+	form.Set("token_type_hint", "requesting_party_token")
+	req, err := http.NewRequestWithContext(ctx, "POST", authZ.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := u.patClient(ctx, authZ).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %s", resp.Status)
+	}
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "application/json" {
+		return nil, fmt.Errorf("content-type unmatched, expected: application/json but %s", contentType)
+	}
+	ret := new(Introspection)
+	if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (u *ressrv) List(ctx context.Context, owner string) (resIDList []string, err error) {
+	authZ, err := u.authZSrv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	url, err := url.Parse(authZ.RRegURL)
 	if err != nil {
 		return nil, err
 	}
 	url.Query().Add("owner", owner)
-	client := u.patConf.Client(context.Background())
-	resp, err := client.Get(url.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.patClient(ctx, authZ).Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -155,9 +232,12 @@ func (u *ressrv) List(owner string) (resIDList []string, err error) {
 	return ret, nil
 }
 
-func (u *ressrv) CRUD(method string, res *Res) (*Res, error) {
-
-	url, err := url.Parse(u.authZ.RRegURL)
+func (u *ressrv) CRUD(ctx context.Context, method string, res *Res) (*Res, error) {
+	authZ, err := u.authZSrv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	url, err := url.Parse(authZ.RRegURL)
 	if err != nil {
 		return nil, err
 	}
@@ -170,22 +250,21 @@ func (u *ressrv) CRUD(method string, res *Res) (*Res, error) {
 		if err != nil {
 			return nil, err
 		}
-		req, err = http.NewRequest(method, url.String(), bytes.NewBuffer(body))
+		req, err = http.NewRequestWithContext(ctx, method, url.String(), bytes.NewBuffer(body))
 		if err != nil {
 			return nil, err
 		}
 		req.Header.Add("Content-Type", "application/json")
 	} else if method == http.MethodGet || method == http.MethodDelete {
 		url.Path = path.Join(url.Path, res.ID)
-		req, err = http.NewRequest(method, url.String(), nil)
+		req, err = http.NewRequestWithContext(ctx, method, url.String(), nil)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	// HTTP Request を送信する
-	client := u.patConf.Client(context.Background())
-	resp, err := client.Do(req)
+	resp, err := u.patClient(ctx, authZ).Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -229,7 +308,7 @@ func (u *ressrv) CRUD(method string, res *Res) (*Res, error) {
 		} `json:"owner,omitempty"`
 		OwnerManagedAccess bool `json:"ownerManagedAccess,omitempty"`
 		Scopes             []struct {
-			Name string `json:"name`
+			Name string `json:"name"`
 		} `json:"resource_scopes,omitempty"`
 	}
 	i := new(id)
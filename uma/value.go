@@ -1,13 +1,15 @@
 package uma
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"mime"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
 
+	"github.com/hatake5051/ztf-prototype/internal/wellknown"
 	"golang.org/x/oauth2"
 )
 
@@ -59,12 +61,54 @@ func (t *RPT) SetAuthHeader(r *http.Request) {
 	r.Header.Set("Authorization", t.Type()+" "+t.AccessToken)
 }
 
+// Introspection は RPT の Introspection 結果を表す (UMA Federated Authorization Sec.5)
+type Introspection struct {
+	// Active が false の時は RPT が失効しているか取り消されている
+	Active bool `json:"active"`
+	// Exp は RPT の有効期限 (NumericDate)
+	Exp int64 `json:"exp,omitempty"`
+	// Permissions は RPT で認可されているリソースとスコープ
+	Permissions []Permission `json:"permissions,omitempty"`
+}
+
+// Permission は RPT で認可されている一つのリソースとそのスコープを表す
+type Permission struct {
+	ResourceID string   `json:"resource_id"`
+	Scopes     []string `json:"resource_scopes"`
+	// Exp はこの permission の有効期限 (NumericDate)
+	Exp int64 `json:"exp,omitempty"`
+}
+
+// UnmarshalJSON は UMA の仕様の形式に加えて Keycloak の形式 (rsid, scopes) の permission も受け付ける
+func (p *Permission) UnmarshalJSON(b []byte) error {
+	var v struct {
+		ResourceID     string   `json:"resource_id"`
+		ResourceScopes []string `json:"resource_scopes"`
+		RsID           string   `json:"rsid"`
+		Scopes         []string `json:"scopes"`
+		Exp            int64    `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	p.ResourceID, p.Scopes, p.Exp = v.ResourceID, v.ResourceScopes, v.Exp
+	if p.ResourceID == "" {
+		p.ResourceID = v.RsID
+	}
+	if p.Scopes == nil {
+		p.Scopes = v.Scopes
+	}
+	return nil
+}
+
 // AuthZSrv は UMA-enabled な認可サーバのエンドポイントなどを表す
 type AuthZSrv struct {
 	Issuer        string
 	TokenURL      string
 	RRegURL       string
 	PermissionURL string
+	// IntrospectionURL は RPT を Introspection するエンドポイント。認可サーバが公開していなければ空
+	IntrospectionURL string
 }
 
 // umaJSON は UMA-enabled AuthZSrv の Well-known 設定情報
@@ -73,42 +117,44 @@ type umaJSON struct {
 	TokenURL      string `json:"token_endpoint"`
 	RRegURL       string `json:"resource_registration_endpoint"`
 	PermissionURL string `json:"permission_endpoint"`
+	// IntrospectionURL は UMA の必須メタデータではない
+	IntrospectionURL string `json:"introspection_endpoint"`
 }
 
-// NewAuthZSrv は issuer の well-known エンドポイントにアクセスして認可サーバの情報を取得する
-func NewAuthZSrv(issuer string) (*AuthZSrv, error) {
-	ur, err := url.Parse(issuer)
+// NewAuthZSrv は issuer の well-known エンドポイントに client でアクセスして認可サーバの情報を取得する
+func NewAuthZSrv(ctx context.Context, client *http.Client, issuer string) (*AuthZSrv, error) {
+	d, err := authZSrvDoc(client, issuer)
 	if err != nil {
 		return nil, err
 	}
-	ur.Path = path.Join(ur.Path, "/.well-known/uma2-configuration")
-	resp, err := http.Get(ur.String())
+	v, err := d.Get(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("statuscode: %s", resp.Status)
-	}
-	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return v.(*AuthZSrv), nil
+}
+
+// authZSrvDoc は issuer の認可サーバの情報を必要になった時に取得してキャッシュする wellknown.Doc を返す
+func authZSrvDoc(client *http.Client, issuer string) (*wellknown.Doc, error) {
+	ur, err := url.Parse(issuer)
 	if err != nil {
 		return nil, err
 	}
-	if contentType != "application/json" {
-		return nil, fmt.Errorf("contentType(%v) is not app/json", contentType)
-	}
-	u := new(umaJSON)
-	defer resp.Body.Close()
-	if err := json.NewDecoder(resp.Body).Decode(u); err != nil {
-		return nil, err
-	}
-	if u.Issuer != issuer {
-		return nil, fmt.Errorf("oidc: issuer did not match the issuer returned by provider, expected %q got %q", issuer, u.Issuer)
-	}
-
-	return &AuthZSrv{
-		Issuer:        u.Issuer,
-		TokenURL:      u.TokenURL,
-		RRegURL:       u.RRegURL,
-		PermissionURL: u.PermissionURL,
-	}, nil
+	ur.Path = path.Join(ur.Path, "/.well-known/uma2-configuration")
+	return wellknown.New(ur.String(), httpClientOr(client), func(body io.Reader) (interface{}, error) {
+		u := new(umaJSON)
+		if err := json.NewDecoder(body).Decode(u); err != nil {
+			return nil, err
+		}
+		if u.Issuer != issuer {
+			return nil, fmt.Errorf("oidc: issuer did not match the issuer returned by provider, expected %q got %q", issuer, u.Issuer)
+		}
+		return &AuthZSrv{
+			Issuer:           u.Issuer,
+			TokenURL:         u.TokenURL,
+			RRegURL:          u.RRegURL,
+			PermissionURL:    u.PermissionURL,
+			IntrospectionURL: u.IntrospectionURL,
+		}, nil
+	}), nil
 }